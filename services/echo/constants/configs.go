@@ -2,6 +2,9 @@ package constants
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -25,8 +28,194 @@ var Config = webrtc.Configuration{
 	},
 }
 
-var Features = struct {
+var Features struct {
+	// allow the hosts to record the sessions (see Recording)
 	EnableRecording bool
-}{
-	EnableRecording: os.Getenv("ENABLE_RECORDING") == "true",
+	// allow the admin api to stream the sessions live over HLS (see Live)
+	EnableLive bool
+	// allow the admin api to simulate poor network conditions on the members
+	// connections; for testing only
+	EnableNetworkSimulation bool
+}
+
+var Codecs struct {
+	// video codecs names (vp8, h264, vp9, av1) in order of preference
+	Video []string
+	// fmtp lines that override the default fmtp line of a video codec
+	Fmtp map[string]string
+}
+
+// settings of the outbound queue of each member
+var Outbound struct {
+	// maximum number of packets waiting to be sent to a member
+	QueueSize int
+	// pacing rate (bits per second) of the packets sent to a member; zero
+	// disables pacing
+	Bitrate int
+}
+
+// read an integer from the environment
+func intEnv(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// read a string from the environment
+func envOr(key string, fallback string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	return value
+}
+
+// read a comma separated list from the environment
+func listEnv(key string, fallback string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = fallback
+	}
+
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// default protection settings for the sessions; they can be changed per
+// session through the admin api.
+var Protection struct {
+	// negotiate RTX retransmissions for video
+	RTX bool
+	// forward error correction for video ("flexfec", "ulpfec" or empty)
+	FEC string
+	// negotiate redundant audio (opus red)
+	RED bool
+}
+
+// freeze detection of the published tracks
+var Stall struct {
+	// time without packets after which a track is considered stalled
+	Timeout time.Duration
+	// time without keyframes after which a video track is considered stalled
+	// (the publisher is asked for a keyframe every few seconds)
+	KeyframeTimeout time.Duration
+}
+
+// maximum bitrate (bits per second) of the screen shares; the publishers are
+// asked to stay under it (zero lets the browsers decide). A screen share
+// mostly holds still text which doesn't need the bitrate of a camera.
+var ScreenMaxBitrate int
+
+// default opus settings (speech, music, low-bandwidth or empty to keep the
+// browsers defaults) of the sessions; it can be changed per session through
+// the admin api.
+var AudioProfile string
+
+// key used to authorize the admin api requests. The admin api is disabled
+// when the key is not set.
+var AdminApiKey string
+
+// time the forwarded tracks of a member that left a session are kept; the
+// subscribers keep the same tracks in case the member rejoins in time.
+var TrackGracePeriod time.Duration
+
+// settings of the sessions recordings
+var Recording struct {
+	// directory of the recordings; each session is recorded to its own
+	// sub directory
+	Directory string
+	// duration of the recorded files; the recordings are split in segments
+	// of this duration (zero writes a single file per track)
+	SegmentDuration time.Duration
+	// recordings older than this are deleted (zero keeps them)
+	MaxAge time.Duration
+	// the oldest recordings are deleted once their files kept in the
+	// directory exceed this size in bytes (zero disables the quota)
+	Quota int64
+	// key (32 bytes encoded in base64) the recordings are encrypted with;
+	// empty keeps them unencrypted
+	MasterKey string
+}
+
+// settings of the live (HLS) streams of the sessions
+var Live struct {
+	// duration of the live segments; the viewers are a few segments behind
+	SegmentDuration time.Duration
+}
+
+// storage the finalized recordings are uploaded to
+var RecordingStorage struct {
+	// "local" (moved to Directory), "s3" or empty to keep the recordings in
+	// the recordings directory
+	Kind      string
+	Directory string
+	// s3 compatible object storage (e.g. AWS S3 or MinIO); the endpoint
+	// defaults to AWS
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// address the bucket in the path of the urls (required by MinIO)
+	PathStyle bool
+}
+
+// Load reads the settings from the environment; the .env file (if any)
+// should be loaded first (see main).
+func Load() {
+	Features.EnableRecording = os.Getenv("ENABLE_RECORDING") == "true"
+	Features.EnableLive = os.Getenv("ENABLE_LIVE") == "true"
+	Features.EnableNetworkSimulation = os.Getenv("ENABLE_NETWORK_SIMULATION") == "true"
+
+	Codecs.Video = listEnv("VIDEO_CODECS", "vp8,h264,vp9,av1")
+	Codecs.Fmtp = map[string]string{
+		"vp8":  os.Getenv("VP8_FMTP"),
+		"h264": os.Getenv("H264_FMTP"),
+		"vp9":  os.Getenv("VP9_FMTP"),
+		"av1":  os.Getenv("AV1_FMTP"),
+	}
+
+	Outbound.QueueSize = intEnv("OUTBOUND_QUEUE_SIZE", 1024)
+	Outbound.Bitrate = intEnv("OUTBOUND_BITRATE", 20_000_000)
+
+	Protection.RTX = os.Getenv("DISABLE_RTX") != "true"
+	Protection.FEC = os.Getenv("FEC")
+	Protection.RED = os.Getenv("ENABLE_RED") == "true"
+
+	Stall.Timeout = time.Duration(intEnv("STALL_TIMEOUT_MS", 2000)) * time.Millisecond
+	Stall.KeyframeTimeout = time.Duration(intEnv("KEYFRAME_TIMEOUT_MS", 10000)) * time.Millisecond
+
+	ScreenMaxBitrate = intEnv("SCREEN_MAX_BITRATE", 2_500_000)
+
+	AudioProfile = envOr("AUDIO_PROFILE", "speech")
+
+	AdminApiKey = os.Getenv("ADMIN_API_KEY")
+
+	TrackGracePeriod = time.Duration(intEnv("TRACK_GRACE_PERIOD", 30)) * time.Second
+
+	Recording.Directory = envOr("RECORDING_DIR", "recordings")
+	Recording.SegmentDuration = time.Duration(intEnv("RECORDING_SEGMENT_SECONDS", 60)) * time.Second
+	Recording.MaxAge = time.Duration(intEnv("RECORDING_RETENTION_DAYS", 0)) * 24 * time.Hour
+	Recording.Quota = int64(intEnv("RECORDING_QUOTA_MB", 0)) << 20
+	Recording.MasterKey = os.Getenv("RECORDING_MASTER_KEY")
+
+	Live.SegmentDuration = time.Duration(intEnv("LIVE_SEGMENT_SECONDS", 2)) * time.Second
+
+	RecordingStorage.Kind = os.Getenv("RECORDING_STORAGE")
+	RecordingStorage.Directory = os.Getenv("RECORDING_STORAGE_DIR")
+	RecordingStorage.Endpoint = os.Getenv("S3_ENDPOINT")
+	RecordingStorage.Region = envOr("S3_REGION", "us-east-1")
+	RecordingStorage.Bucket = os.Getenv("S3_BUCKET")
+	RecordingStorage.Prefix = os.Getenv("S3_PREFIX")
+	RecordingStorage.AccessKey = os.Getenv("S3_ACCESS_KEY_ID")
+	RecordingStorage.SecretKey = os.Getenv("S3_SECRET_ACCESS_KEY")
+	RecordingStorage.PathStyle = os.Getenv("S3_PATH_STYLE") != "false"
 }
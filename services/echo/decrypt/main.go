@@ -0,0 +1,97 @@
+// decrypt the files of a recording encrypted with RECORDING_MASTER_KEY:
+//
+//	go run ./decrypt <recording directory> [output directory]
+//
+// The recording directory holds the manifest and the key file (e.g.
+// `recordings/<session>/<start>`, or the copy downloaded from the storage).
+// The decrypted files are written next to the encrypted ones unless an
+// output directory is given.
+package main
+
+import (
+	"echo/constants"
+	"echo/lib/record"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if len(os.Args) < 2 || len(os.Args) > 3 {
+		fmt.Fprintln(os.Stderr, "usage: decrypt <recording directory> [output directory]")
+		os.Exit(2)
+	}
+	dir := os.Args[1]
+	output := dir
+	if len(os.Args) == 3 {
+		output = os.Args[2]
+	}
+
+	// the key might be set in the .env file of the service
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+	constants.Load()
+
+	master, err := record.ParseMasterKey(constants.Recording.MasterKey)
+	if err != nil {
+		log.Fatal("RECORDING_MASTER_KEY: ", err)
+	}
+	key, err := record.ReadDataKey(master, filepath.Join(dir, record.KeyName))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	decrypted := 0
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, record.EncryptedSuffix) {
+			return err
+		}
+
+		relative, err := filepath.Rel(dir, strings.TrimSuffix(path, record.EncryptedSuffix))
+		if err != nil {
+			return err
+		}
+		if err := decryptFile(path, filepath.Join(output, relative), key); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		decrypted++
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("decrypted %d files to %s", decrypted, output)
+}
+
+// decrypt a file; the output is removed unless the whole file is decrypted.
+func decryptFile(source string, destination string, key []byte) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return err
+	}
+	dst, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	err = record.Decrypt(dst, src, key)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destination)
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"echo/constants"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// middleware that only allows requests authorized with the admin api key
+// (`Authorization: Bearer <key>`). All requests are rejected when the key is
+// not configured.
+func RequireApiKey(c *fiber.Ctx) error {
+	key, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if constants.AdminApiKey == "" || !found ||
+		subtle.ConstantTimeCompare([]byte(key), []byte(constants.AdminApiKey)) != 1 {
+		return fiber.ErrUnauthorized
+	}
+	return c.Next()
+}
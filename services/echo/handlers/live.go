@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"echo/lib/record"
+	"echo/lib/state"
+	"errors"
+	"path"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type liveBody struct {
+	// the member followed by the live stream (nil when stopped)
+	Member *state.MemberId `json:"member"`
+	// path of the playlist; the viewers are authorized by the token in the
+	// path
+	Playlist string `json:"playlist,omitempty"`
+}
+
+func liveResponse(s *state.State, sid state.SessionId) liveBody {
+	member, token, ok := s.GetSessionLive(sid)
+	if !ok {
+		return liveBody{}
+	}
+	return liveBody{Member: &member, Playlist: path.Join("/live", token, record.LivePlaylistName)}
+}
+
+func GetSessionLive(state *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(liveResponse(state, c.Params("sid")))
+	}
+}
+
+// start streaming a member of the session live or follow another member.
+// The response holds the playlist path to share with the viewers.
+func SetSessionLive(s *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sid := c.Params("sid")
+		var body liveBody
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if body.Member == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "missing member")
+		}
+
+		if _, err := s.SetSessionLive(sid, *body.Member); err != nil {
+			status := fiber.StatusInternalServerError
+			if errors.Is(err, state.ErrLiveDisabled) || errors.Is(err, state.ErrNoRecordingConsent) {
+				status = fiber.StatusForbidden
+			}
+			return fiber.NewError(status, err.Error())
+		}
+
+		return c.JSON(liveResponse(s, sid))
+	}
+}
+
+func StopSessionLive(state *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sid := c.Params("sid")
+		state.StopSessionLive(sid)
+		return c.JSON(liveResponse(state, sid))
+	}
+}
+
+// the playlist and the segments of a live stream for the viewers; the token
+// of the stream authorizes the request.
+func GetLiveFile(state *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		stream := state.GetLiveStream(c.Params("token"))
+		if stream == nil {
+			return fiber.ErrNotFound
+		}
+
+		file := c.Params("file")
+		if file == record.LivePlaylistName {
+			c.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+			c.Set(fiber.HeaderCacheControl, "no-cache")
+			return c.SendString(stream.Playlist())
+		}
+
+		data, ok := stream.File(file)
+		if !ok {
+			return fiber.ErrNotFound
+		}
+		if path.Ext(file) == ".m4s" {
+			c.Set(fiber.HeaderContentType, "video/iso.segment")
+		} else {
+			c.Set(fiber.HeaderContentType, "video/mp4")
+		}
+		return c.Send(data)
+	}
+}
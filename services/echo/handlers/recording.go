@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"echo/lib/record"
+	"echo/lib/state"
+	"errors"
+	"path"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type recordingBody struct {
+	Status record.Status `json:"status"`
+	// uploads of the current (or latest) recording to the storage
+	Upload *record.UploadStatus `json:"upload,omitempty"`
+}
+
+func recordingResponse(s *state.State, sid state.SessionId) recordingBody {
+	body := recordingBody{Status: s.GetSessionRecording(sid)}
+	if upload, ok := s.GetSessionRecordingUpload(sid); ok {
+		body.Upload = &upload
+	}
+	return body
+}
+
+func GetSessionRecording(state *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(recordingResponse(state, c.Params("sid")))
+	}
+}
+
+// start (recording), pause (paused), resume (recording) or stop (stopped) the
+// session recording. The members of the session are notified.
+func SetSessionRecording(s *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sid := c.Params("sid")
+		var body recordingBody
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if err := s.SetSessionRecording(sid, body.Status); err != nil {
+			status := fiber.StatusBadRequest
+			if errors.Is(err, state.ErrRecordingDisabled) || errors.Is(err, state.ErrNoRecordingConsent) {
+				status = fiber.StatusForbidden
+			} else if errors.Is(err, state.ErrNotRecording) {
+				status = fiber.StatusConflict
+			} else if errors.Is(err, state.ErrRecordingFailed) {
+				status = fiber.StatusInternalServerError
+			}
+			return fiber.NewError(status, err.Error())
+		}
+
+		return c.JSON(recordingResponse(s, sid))
+	}
+}
+
+// the reason sent to a member whose recording request has been refused.
+func recordingRejectedReason(err error) string {
+	switch {
+	case errors.Is(err, state.ErrRecordingDisabled):
+		return "recording-disabled"
+	case errors.Is(err, state.ErrNoRecordingConsent):
+		return "no-consent"
+	case errors.Is(err, state.ErrNotRecording):
+		return "not-recording"
+	case errors.Is(err, state.ErrRecordingFailed):
+		return "recording-failed"
+	default:
+		return "invalid-status"
+	}
+}
+
+// the recordings of the session, oldest first.
+func ListSessionRecordings(s *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		recordings, err := s.ListSessionRecordings(c.Params("sid"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(recordings)
+	}
+}
+
+// the manifest of a recording listing its files and the session timeline.
+func GetSessionRecordingManifest(s *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		manifest, err := s.GetSessionRecordingManifest(c.Params("sid"), c.Params("rid"))
+		if err != nil {
+			return recordingFileError(err)
+		}
+		return c.JSON(manifest)
+	}
+}
+
+// stream a file of a recording (range requests are supported); the file is
+// sent as an attachment when the `download` query parameter is set.
+func GetSessionRecordingFile(s *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		file := c.Params("*")
+		object, err := s.OpenSessionRecordingFile(c.Context(), c.Params("sid"), c.Params("rid"), file, c.Get(fiber.HeaderRange))
+		if err != nil {
+			return recordingFileError(err)
+		}
+
+		if c.QueryBool("download") {
+			c.Attachment(path.Base(file))
+		} else {
+			c.Type(path.Ext(file))
+		}
+		c.Set(fiber.HeaderAcceptRanges, "bytes")
+		if object.Range != "" {
+			c.Status(fiber.StatusPartialContent)
+			c.Set(fiber.HeaderContentRange, object.Range)
+		}
+		return c.SendStream(object.Body, int(object.Length))
+	}
+}
+
+func recordingFileError(err error) error {
+	if errors.Is(err, record.ErrRecordingNotFound) || errors.Is(err, record.ErrFileNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if errors.Is(err, record.ErrInvalidRange) {
+		return fiber.NewError(fiber.StatusRequestedRangeNotSatisfiable, err.Error())
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"echo/lib/state"
+	"encoding/json"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func GetSessionOptions(state *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(state.GetSessionOptions(c.Params("sid")))
+	}
+}
+
+// update the session options. Omitted fields keep their current values; the
+// member simulations and the hosts are replaced as a whole. The new options
+// only apply to the members who join the session afterwards (except for the
+// screen share policy and the recording consent). The hosts of a session can
+// also change the screen share policy over the signaling connection (see
+// wss.ClientMessageTypeSetScreenShares and IssueSessionHostToken).
+func SetSessionOptions(state *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		sid := c.Params("sid")
+		current := state.GetSessionOptions(sid)
+		// the maps, slices and pointers are decoded into fresh values and
+		// replace the current ones: decoding into them would merge the member
+		// simulations (an entry could never be removed) and modify the options
+		// in use
+		options := current
+		options.Simulation = nil
+		options.MemberSimulations = nil
+		options.Hosts = nil
+		if err := c.BodyParser(&options); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(c.Body(), &fields); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if _, ok := fields["simulation"]; !ok {
+			options.Simulation = current.Simulation
+		}
+		if _, ok := fields["memberSimulations"]; !ok {
+			options.MemberSimulations = current.MemberSimulations
+		}
+		if _, ok := fields["hosts"]; !ok {
+			options.Hosts = current.Hosts
+		}
+
+		if err := state.SetSessionOptions(sid, options); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(options)
+	}
+}
+
+type hostTokenBody struct {
+	Token string `json:"token"`
+}
+
+// issue the token authenticating a host of the session over the signaling
+// connection (the `hostToken` query parameter of the socket). The member
+// must be one of the hosts of the session (see state.Options.Hosts).
+func IssueSessionHostToken(s *state.State) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		mid, err := c.ParamsInt("mid")
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid member")
+		}
+
+		token, err := s.IssueHostToken(c.Params("sid"), mid)
+		if errors.Is(err, state.ErrNotHost) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(hostTokenBody{Token: token})
+	}
+}
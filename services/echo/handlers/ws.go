@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"echo/lib/forward"
+	"echo/lib/record"
 	"echo/lib/state"
 	"echo/lib/utils"
 	"echo/lib/wss"
@@ -31,6 +33,14 @@ func NewSocketConn(s *state.State) fiber.Handler {
 
 		log.Printf("socket: session=%s user=%d", sid, mid)
 
+		// track sources and tracks declared before the member is created
+		pending := map[string]forward.Source{}
+		var declared map[string]wss.TrackMetadata
+		// members on a slow connection can join without receiving video
+		audioOnly := socket.Query("audioOnly") == "true"
+		// authenticates the hosts of the session (see IssueSessionHostToken)
+		hostToken := socket.Query("hostToken")
+
 		utils.IncreaseThread()
 		defer utils.DecreaseThread()
 		for {
@@ -68,19 +78,46 @@ func NewSocketConn(s *state.State) fiber.Handler {
 				// add or reiterative the member for the state
 				current := s.GetSessionMember(sid, mid)
 				if current == nil {
-					current = utils.Must(state.NewMember(mid, &socket))
+					options := s.GetSessionOptions(sid)
+					current = utils.Must(state.NewMember(mid, &socket, options, s.GetSessionPublications(sid)))
+					// the audio profile applies to the whole member connection
+					socket.SendAudioProfileMessage(options.AudioProfile)
+					socket.SendRecordingMessage(string(s.GetSessionRecording(sid)))
+					for transceiver, source := range pending {
+						if err := current.SetTrackSource(transceiver, source); err != nil {
+							log.Printf("unable to set transceiver %s source for %d: %s", transceiver, mid, err)
+						}
+					}
 				}
 
 				utils.Unwrap(current.Conn.SetRemoteDescription(sessionDescription))
+				current.RestrictReceivedCodecs()
 				localSdp := utils.Must(current.Conn.CreateAnswer(nil))
 				utils.Unwrap(current.Conn.SetLocalDescription(localSdp))
 				socket.SendAnswerMessage(&localSdp)
 
+				// the renegotiated offer might have removed some tracks
+				current.UnpublishInactiveTracks()
+
 				// add member to session
 				if !s.IsMemberExist(sid, mid) {
 					s.AddSessionMember(sid, current)
 				}
 
+				if audioOnly {
+					if err := s.GetSession(sid).SetMemberAudioOnly(mid, true); err != nil {
+						log.Printf("unable to set the audio only mode of %d: %s", mid, err)
+					}
+					audioOnly = false
+				}
+
+				if declared != nil {
+					if err := s.GetSession(sid).SetMemberTracks(mid, declared); err != nil {
+						log.Printf("unable to set the tracks of %d: %s", mid, err)
+					}
+					declared = nil
+				}
+
 				// share other members tracks with the current member
 				members := s.GetSessionMembers(sid)
 
@@ -90,9 +127,13 @@ func NewSocketConn(s *state.State) fiber.Handler {
 						continue
 					}
 
-					for _, track := range member.Tracks {
+					if declared := member.GetDeclaredTracks(); len(declared) > 0 {
+						socket.SendMemberTracksMessage(member.Id, declared)
+					}
+
+					for _, track := range member.GetTracks() {
 						log.Printf("sending %s track from %d to %d", track.Kind().String(), member.Id, mid)
-						current.SendTrack(track)
+						current.SendTrack(member.Id, track)
 					}
 				}
 			}
@@ -135,6 +176,152 @@ func NewSocketConn(s *state.State) fiber.Handler {
 				session.SetMemberAudio(mid, audio)
 			}
 
+			if kind == wss.ClientMessageTypePauseTrack || kind == wss.ClientMessageTypeResumeTrack {
+				// parse message body
+				var message wss.TrackMessage
+				if err := json.Unmarshal(body, &message); err != nil {
+					log.Println("failed to parse track message body")
+					continue
+				}
+
+				member := s.GetSessionMember(sid, mid)
+				if member == nil {
+					continue
+				}
+
+				var err error
+				if kind == wss.ClientMessageTypePauseTrack {
+					err = member.PauseTrack(message.Track)
+				} else {
+					err = member.ResumeTrack(message.Track)
+				}
+
+				if err != nil {
+					log.Printf("unable to update track %s for %d: %s", message.Track, mid, err)
+				}
+			}
+
+			if kind == wss.ClientMessageTypeSetTrackSource {
+				// parse message body
+				var message wss.TrackSourceMessage
+				if err := json.Unmarshal(body, &message); err != nil {
+					log.Println("failed to parse track source message body")
+					continue
+				}
+
+				// the member is created by its first offer which might carry
+				// the announced tracks
+				member := s.GetSessionMember(sid, mid)
+				if member == nil {
+					pending[message.Transceiver] = forward.Source(message.Source)
+					continue
+				}
+
+				if err := member.SetTrackSource(message.Transceiver, forward.Source(message.Source)); err != nil {
+					log.Printf("unable to set transceiver %s source for %d: %s", message.Transceiver, mid, err)
+				}
+			}
+
+			if kind == wss.ClientMessageTypePublish {
+				// parse message body
+				var message wss.PublishMessage
+				if err := json.Unmarshal(body, &message); err != nil {
+					log.Println("failed to parse publish message body")
+					continue
+				}
+
+				// the tracks are declared once the member joins the session
+				if session == nil || session.GetMember(mid) == nil {
+					declared = message.Tracks
+					for transceiver, metadata := range message.Tracks {
+						pending[transceiver] = forward.Source(metadata.Source)
+					}
+					continue
+				}
+
+				if err := session.SetMemberTracks(mid, message.Tracks); err != nil {
+					log.Printf("unable to set the tracks of %d: %s", mid, err)
+				}
+			}
+
+			if kind == wss.ClientMessageTypeSetAudioOnly {
+				// parse message body
+				var enabled bool
+				if err := json.Unmarshal(body, &enabled); err != nil {
+					log.Println("failed to parse audio only message body")
+					continue
+				}
+
+				// applied once the member joins the session
+				if session == nil || session.GetMember(mid) == nil {
+					audioOnly = enabled
+					continue
+				}
+
+				if err := session.SetMemberAudioOnly(mid, enabled); err != nil {
+					log.Printf("unable to set the audio only mode of %d: %s", mid, err)
+				}
+			}
+
+			if kind == wss.ClientMessageTypeSetRecording {
+				// parse message body
+				var message wss.RecordingMessage
+				if err := json.Unmarshal(body, &message); err != nil {
+					log.Println("failed to parse recording message body")
+					continue
+				}
+
+				// only the hosts can record the session
+				if !s.IsSessionHost(sid, mid, hostToken) {
+					socket.SendRecordingRejectedMessage(message.Status, "not-host")
+					continue
+				}
+
+				if err := s.SetSessionRecording(sid, record.Status(message.Status)); err != nil {
+					log.Printf("unable to set the session %s recording to %s by %d: %s", sid, message.Status, mid, err)
+					socket.SendRecordingRejectedMessage(message.Status, recordingRejectedReason(err))
+				}
+			}
+
+			if kind == wss.ClientMessageTypeSetScreenShares {
+				// parse message body
+				var message wss.ScreenSharesMessage
+				if err := json.Unmarshal(body, &message); err != nil {
+					log.Println("failed to parse screen shares message body")
+					continue
+				}
+
+				// only the hosts can change the screen share policy
+				if !s.IsSessionHost(sid, mid, hostToken) {
+					socket.SendScreenSharesRejectedMessage(message.Multiple, "not-host")
+					continue
+				}
+
+				if err := s.SetSessionScreenShares(sid, message.Multiple); err != nil {
+					log.Printf("unable to set the session %s screen shares by %d: %s", sid, mid, err)
+					socket.SendScreenSharesRejectedMessage(message.Multiple, "invalid-options")
+				}
+			}
+
+			if kind == wss.ClientMessageTypeSetTrackLayer {
+				// parse message body
+				var message wss.TrackLayerMessage
+				if err := json.Unmarshal(body, &message); err != nil {
+					log.Println("failed to parse track layer message body")
+					continue
+				}
+
+				member := s.GetSessionMember(sid, mid)
+				if member == nil {
+					continue
+				}
+
+				layer := forward.Layer{Spatial: message.Spatial, Temporal: message.Temporal}
+				if err := member.SetTrackLayer(message.Track, layer); err != nil {
+					log.Printf("unable to set track %s layer for %d: %s", message.Track, mid, err)
+				}
+			}
+
 		}
 	})
 }
@@ -0,0 +1,427 @@
+package codecs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+var ErrUnknownAudioProfile = errors.New("unknown audio profile")
+
+const (
+	MimeTypeRED       = "audio/red"
+	MimeTypeFlexFEC03 = "video/flexfec-03"
+	// the ulpfec packets are sent along with the media wrapped in red
+	MimeTypeVideoRED = "video/red"
+	MimeTypeULPFEC   = "video/ulpfec"
+)
+
+// a video codec and the payload type of its RTX (retransmission) stream.
+type variant struct {
+	codec webrtc.RTPCodecParameters
+	rtx   webrtc.PayloadType
+}
+
+// supported video codecs by name. The name is the one used in the codecs
+// preference list (see constants.Codecs). A codec can have more than one
+// variant (e.g. different H.264 profiles); variants are registered in order.
+var video = map[string][]variant{
+	"vp8": {
+		{
+			codec: webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+				PayloadType:        96,
+			},
+			rtx: 97,
+		},
+	},
+	"h264": {
+		// constrained baseline, supported by all browsers and most hardware encoders
+		{
+			codec: webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:    webrtc.MimeTypeH264,
+					ClockRate:   90000,
+					SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+				},
+				PayloadType: 102,
+			},
+			rtx: 103,
+		},
+		// baseline
+		{
+			codec: webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:    webrtc.MimeTypeH264,
+					ClockRate:   90000,
+					SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+				},
+				PayloadType: 104,
+			},
+			rtx: 105,
+		},
+	},
+	"vp9": {
+		{
+			codec: webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:    webrtc.MimeTypeVP9,
+					ClockRate:   90000,
+					SDPFmtpLine: "profile-id=0",
+				},
+				PayloadType: 98,
+			},
+			rtx: 99,
+		},
+	},
+	"av1": {
+		{
+			codec: webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:    webrtc.MimeTypeAV1,
+					ClockRate:   90000,
+					SDPFmtpLine: "level-idx=5;profile=0;tier=0",
+				},
+				PayloadType: 45,
+			},
+			rtx: 46,
+		},
+	},
+}
+
+var Opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}
+
+const opusPayloadType = 111
+
+// opus fmtp parameters by audio profile. The parameters are announced to both
+// publishers (how to encode the audio they send) and subscribers.
+var audioProfiles = map[string]string{
+	// mono voice with discontinuous transmission and in-band fec
+	"speech": "minptime=10;useinbandfec=1;usedtx=1",
+	// full band stereo at a high bitrate; dtx would cut quiet passages
+	"music": "minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1;maxplaybackrate=48000;maxaveragebitrate=128000",
+	// wide band voice for poor connections
+	"low-bandwidth": "minptime=10;useinbandfec=1;usedtx=1;maxplaybackrate=16000;maxaveragebitrate=16000",
+}
+
+// check if the name is a known audio profile. An empty profile keeps the
+// browsers defaults.
+func IsAudioProfile(name string) bool {
+	_, ok := audioProfiles[name]
+	return ok || name == ""
+}
+
+// redundant audio (RFC 2198) wrapping opus frames.
+var red = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType:    MimeTypeRED,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: fmt.Sprintf("%d/%d", opusPayloadType, opusPayloadType),
+	},
+	PayloadType: 63,
+}
+
+var flexfec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType:    MimeTypeFlexFEC03,
+		ClockRate:   90000,
+		SDPFmtpLine: "repair-window=10000000",
+	},
+	PayloadType: 118,
+}
+
+var videoRED = variant{
+	codec: webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeVideoRED, ClockRate: 90000},
+		PayloadType:        123,
+	},
+	rtx: 124,
+}
+
+var ulpfec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeULPFEC, ClockRate: 90000},
+	PayloadType:        125,
+}
+
+type Options struct {
+	// video codecs names in order of preference
+	Video []string
+	// fmtp lines that override the default fmtp line of a video codec; an
+	// overridden codec will have a single variant.
+	Fmtp map[string]string
+	// negotiate RTX retransmissions for video
+	RTX bool
+	// negotiate forward error correction for video ("flexfec", "ulpfec" or
+	// empty)
+	FEC string
+	// negotiate redundant audio (opus red) and prefer it over plain opus
+	RED bool
+	// opus settings (speech, music, low-bandwidth or empty)
+	AudioProfile string
+}
+
+// register the audio and video codecs, along with the protection (RTX, FEC
+// and RED) codecs, to the media engine.
+func Register(mediaEngine *webrtc.MediaEngine, options Options) error {
+	for _, name := range options.Video {
+		variants, ok := video[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+		}
+
+		if line := options.Fmtp[strings.ToLower(name)]; line != "" {
+			override := variants[0]
+			override.codec.SDPFmtpLine = line
+			variants = []variant{override}
+		}
+
+		for _, v := range variants {
+			if err := registerVideo(mediaEngine, v, options.RTX); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch options.FEC {
+	case "":
+	case "flexfec":
+		if err := mediaEngine.RegisterCodec(flexfec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	case "ulpfec":
+		// the retransmissions of the media wrapped in red need their own
+		// rtx payload type
+		if err := registerVideo(mediaEngine, videoRED, options.RTX); err != nil {
+			return err
+		}
+		if err := mediaEngine.RegisterCodec(ulpfec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownCodec, options.FEC)
+	}
+
+	// red must be registered before opus to be preferred
+	if options.RED {
+		if err := mediaEngine.RegisterCodec(red, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+
+	if !IsAudioProfile(options.AudioProfile) {
+		return fmt.Errorf("%w: %s", ErrUnknownAudioProfile, options.AudioProfile)
+	}
+
+	opus := Opus
+	opus.SDPFmtpLine = audioProfiles[options.AudioProfile]
+	return mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: opus,
+		PayloadType:        opusPayloadType,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+// register a video codec and its rtx codec (when enabled).
+func registerVideo(mediaEngine *webrtc.MediaEngine, v variant, rtx bool) error {
+	if err := mediaEngine.RegisterCodec(v.codec, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	if !rtx {
+		return nil
+	}
+
+	return mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeRTX,
+			ClockRate:   90000,
+			SDPFmtpLine: fmt.Sprintf("apt=%d", v.codec.PayloadType),
+		},
+		PayloadType: v.rtx,
+	}, webrtc.RTPCodecTypeVideo)
+}
+
+// the codecs the server accepts from the publishers. The server generates the
+// ulpfec stream of the subscribers itself; a publisher sending red and ulpfec
+// would wrap all of its media in red, so both (and the rtx of red) are
+// excluded.
+func Receivable(codecs []webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters {
+	excluded := map[webrtc.PayloadType]bool{}
+	for _, codec := range codecs {
+		if strings.EqualFold(codec.MimeType, MimeTypeVideoRED) || strings.EqualFold(codec.MimeType, MimeTypeULPFEC) {
+			excluded[codec.PayloadType] = true
+		}
+	}
+
+	receivable := []webrtc.RTPCodecParameters{}
+	for _, codec := range codecs {
+		if excluded[codec.PayloadType] {
+			continue
+		}
+		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX) {
+			apt, err := strconv.Atoi(parseFmtp(codec.SDPFmtpLine).get("apt", ""))
+			if err == nil && excluded[webrtc.PayloadType(apt)] {
+				continue
+			}
+		}
+		receivable = append(receivable, codec)
+	}
+	return receivable
+}
+
+// the codec a track can be converted to in case the subscriber doesn't
+// support the track codec (e.g. opus red can be unwrapped to plain opus).
+func Fallback(codec webrtc.RTPCodecCapability) (webrtc.RTPCodecCapability, bool) {
+	if strings.EqualFold(codec.MimeType, MimeTypeRED) {
+		return Opus, true
+	}
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// check if a stream encoded with codec `a` can be decoded by a peer that
+// negotiated codec `b`.
+func Compatible(a, b webrtc.RTPCodecCapability) bool {
+	if !strings.EqualFold(a.MimeType, b.MimeType) {
+		return false
+	}
+
+	fa := parseFmtp(a.SDPFmtpLine)
+	fb := parseFmtp(b.SDPFmtpLine)
+
+	switch strings.ToLower(a.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return fa.get("packetization-mode", "0") == fb.get("packetization-mode", "0") &&
+			h264ProfileIdc(fa.get("profile-level-id", "42001f")) == h264ProfileIdc(fb.get("profile-level-id", "42001f"))
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return fa.get("profile-id", "0") == fb.get("profile-id", "0")
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return fa.get("profile", "0") == fb.get("profile", "0")
+	default:
+		return true
+	}
+}
+
+// find the negotiated codec that is compatible with the given codec. Codecs
+// with the exact same fmtp line are preferred.
+func Match(codec webrtc.RTPCodecCapability, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	found := -1
+	for i, candidate := range negotiated {
+		if !Compatible(codec, candidate.RTPCodecCapability) {
+			continue
+		}
+		if candidate.SDPFmtpLine == codec.SDPFmtpLine {
+			return candidate, true
+		}
+		if found == -1 {
+			found = i
+		}
+	}
+
+	if found == -1 {
+		return webrtc.RTPCodecParameters{}, false
+	}
+	return negotiated[found], true
+}
+
+// check if any of the given codecs is compatible with the codec or with its
+// fallback codec.
+func Supported(codec webrtc.RTPCodecCapability, list []webrtc.RTPCodecCapability) bool {
+	for _, candidate := range list {
+		if Compatible(codec, candidate) {
+			return true
+		}
+	}
+
+	if fallback, ok := Fallback(codec); ok {
+		return Supported(fallback, list)
+	}
+	return false
+}
+
+// find the negotiated payload type of the given mime type.
+func PayloadType(mimeType string, negotiated []webrtc.RTPCodecParameters) (webrtc.PayloadType, bool) {
+	codec, ok := Find(mimeType, negotiated)
+	return codec.PayloadType, ok
+}
+
+// find the negotiated codec of the given mime type.
+func Find(mimeType string, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	for _, codec := range negotiated {
+		if strings.EqualFold(codec.MimeType, mimeType) {
+			return codec, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// list the codecs (of the given kind) included in the session description.
+func FromSessionDescription(desc *webrtc.SessionDescription, kind webrtc.RTPCodecType) ([]webrtc.RTPCodecCapability, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []webrtc.RTPCodecCapability{}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != kind.String() {
+			continue
+		}
+
+		for _, format := range media.MediaName.Formats {
+			pt, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+
+			codec, err := parsed.GetCodecForPayloadType(uint8(pt))
+			if err != nil {
+				continue
+			}
+
+			result = append(result, fromSdpCodec(kind, codec))
+		}
+	}
+
+	return result, nil
+}
+
+func fromSdpCodec(kind webrtc.RTPCodecType, codec sdp.Codec) webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:    kind.String() + "/" + codec.Name,
+		ClockRate:   codec.ClockRate,
+		SDPFmtpLine: codec.Fmtp,
+	}
+}
+
+type fmtpParams map[string]string
+
+func parseFmtp(line string) fmtpParams {
+	params := fmtpParams{}
+	for _, part := range strings.Split(line, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if key == "" {
+			continue
+		}
+		params[strings.ToLower(key)] = strings.ToLower(value)
+	}
+	return params
+}
+
+func (p fmtpParams) get(key string, defaultValue string) string {
+	if value, ok := p[key]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+func h264ProfileIdc(profileLevelId string) string {
+	if len(profileLevelId) < 2 {
+		return ""
+	}
+	return profileLevelId[:2]
+}
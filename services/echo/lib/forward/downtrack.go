@@ -0,0 +1,546 @@
+package forward
+
+import (
+	"echo/lib/codecs"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// DownTrack is the writer between a forwarded track and a single subscriber.
+// It implements webrtc.TrackLocal so it can be added directly to the
+// subscriber peer connection. Pausing a down track stops the packets from
+// reaching the subscriber without any renegotiation. Once the down track is
+// bound (or resumed) it starts with the cached keyframe of the track so the
+// subscriber can decode the stream right away.
+//
+// For scalable streams (VP9/AV1 SVC) the down track only forwards the layers
+// up to its target layer. The target is set by the subscriber and lowered by
+// the server when the subscriber reports sustained packet loss.
+//
+// Packets are not written directly to the subscriber connection; they are
+// pushed to the outbound queue of the subscriber (shared by all of its down
+// tracks). The down tracks are guarded by the lock of the queue so that a
+// packet is patched and queued with a single lock.
+type DownTrack struct {
+	// the lock of the queue
+	mu          *sync.Mutex
+	track       *Track
+	queue       *Queue
+	bound       bool
+	paused      bool
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+	// priority of the packets in the outbound queue
+	priority priority
+	// forward error correction stream generated for the subscriber (video only)
+	fec *fecEncoder
+	// the media is wrapped in red along with the ulpfec packets generated for
+	// the subscriber (video only): payload type of the media inside red and
+	// the red header of the ulpfec placeholders (see writeULPFEC)
+	redPayloadType webrtc.PayloadType
+	ulpfecHeader   []byte
+	// media packets sent since the latest ulpfec packets
+	ulpfecPackets int
+	// the subscriber doesn't support opus red; only the primary encoding is sent
+	unwrapRED bool
+	munger    munger
+	// the cached keyframe should be sent before the next live packet
+	needsReplay bool
+	// the track has been restarted; the next packet continues the stream
+	// `restartGap` (in clock rate units) after the last sent packet
+	restarted  bool
+	restartGap uint32
+	// a packet was dropped by the outbound queue; the subscriber needs a new
+	// keyframe to continue decoding the stream
+	resync atomic.Bool
+	// highest layer requested by the subscriber
+	requested Layer
+	// highest layer to be forwarded; it is lower than the requested layer in
+	// case the subscriber is losing packets
+	target Layer
+	// layer being forwarded; it follows the target at frame boundaries
+	current Layer
+	// highest layer seen in the stream
+	seen         Layer
+	lossyReports int
+	cleanReports int
+}
+
+const (
+	// fraction lost (out of 256) above which a receiver report is considered lossy (~10%)
+	lossyFractionLost = 25
+	// fraction lost (out of 256) below which a receiver report is considered clean (~2%)
+	cleanFractionLost = 5
+	// number of consecutive lossy reports needed to lower the target layer
+	lossyReportsThreshold = 3
+	// number of consecutive clean reports needed to raise the target layer
+	cleanReportsThreshold = 10
+)
+
+func newDownTrack(track *Track, queue *Queue) *DownTrack {
+	return &DownTrack{
+		mu:        &queue.mu,
+		track:     track,
+		queue:     queue,
+		priority:  priorityOf(track.kind, track.source),
+		requested: maxLayer,
+		target:    maxLayer,
+		current:   maxLayer,
+	}
+}
+
+// Bind is called by the subscriber peer connection once the negotiation is
+// done. It picks the negotiated codec that matches the forwarded track.
+func (d *DownTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	negotiated := ctx.CodecParameters()
+	codec, ok := codecs.Match(d.track.codec, negotiated)
+	d.unwrapRED = false
+	if fallback, hasFallback := codecs.Fallback(d.track.codec); !ok && hasFallback {
+		codec, ok = codecs.Match(fallback, negotiated)
+		d.unwrapRED = ok
+	}
+
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	d.bound = true
+	d.needsReplay = d.Kind() == webrtc.RTPCodecTypeVideo
+	d.ssrc = ctx.SSRC()
+	d.payloadType = codec.PayloadType
+	d.writeStream = ctx.WriteStream()
+
+	// the fec ssrc is only set when both peers negotiated flexfec
+	if d.fec != nil {
+		d.fec.reset()
+	}
+	d.fec = nil
+	if fecPayloadType, ok := codecs.PayloadType(codecs.MimeTypeFlexFEC03, negotiated); ok &&
+		ctx.SSRCForwardErrorCorrection() != 0 &&
+		d.Kind() == webrtc.RTPCodecTypeVideo {
+		d.fec = newFecEncoder(fecPayloadType, ctx.SSRC(), ctx.SSRCForwardErrorCorrection())
+	}
+
+	// the stream is sent as red once both peers negotiated red and ulpfec
+	d.redPayloadType = 0
+	d.ulpfecPackets = 0
+	red, hasRED := codecs.Find(codecs.MimeTypeVideoRED, negotiated)
+	if ulpfecPayloadType, ok := codecs.PayloadType(codecs.MimeTypeULPFEC, negotiated); ok && hasRED &&
+		d.Kind() == webrtc.RTPCodecTypeVideo {
+		d.redPayloadType = codec.PayloadType
+		d.payloadType = red.PayloadType
+		d.ulpfecHeader = []byte{byte(ulpfecPayloadType)}
+		return red, nil
+	}
+
+	return codec, nil
+}
+
+// Unbind is called by the subscriber peer connection when the track is no
+// longer sent (e.g. the sender has been stopped).
+func (d *DownTrack) Unbind(_ webrtc.TrackLocalContext) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.bound = false
+	d.writeStream = nil
+	if d.fec != nil {
+		d.fec.reset()
+	}
+	return nil
+}
+
+func (d *DownTrack) ID() string {
+	return d.track.id
+}
+
+func (d *DownTrack) RID() string {
+	return ""
+}
+
+func (d *DownTrack) StreamID() string {
+	return d.track.streamId
+}
+
+func (d *DownTrack) Kind() webrtc.RTPCodecType {
+	return d.track.Kind()
+}
+
+// the forwarded track this down track is reading from.
+func (d *DownTrack) Track() *Track {
+	return d.track
+}
+
+// stop sending packets to the subscriber.
+func (d *DownTrack) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paused = true
+}
+
+// continue sending packets to the subscriber starting from the cached
+// keyframe (or a new keyframe requested from the publisher) so that the
+// subscriber doesn't have to wait for the next one.
+func (d *DownTrack) Resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.paused && d.Kind() == webrtc.RTPCodecTypeVideo {
+		d.needsReplay = true
+	}
+	d.paused = false
+}
+
+// the track switched to a new remote track. The sequence numbers and
+// timestamps of the new stream are rebased on the last sent packet and video
+// subscribers wait for a keyframe of the new stream.
+func (d *DownTrack) restart(gap uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.restarted = true
+	d.restartGap = gap
+	if !d.paused && d.Kind() == webrtc.RTPCodecTypeVideo {
+		d.needsReplay = true
+	}
+}
+
+func (d *DownTrack) IsPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// the negotiated ssrc of the down track.
+func (d *DownTrack) SSRC() webrtc.SSRC {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ssrc
+}
+
+// set the highest spatial and temporal layers the subscriber wants to
+// receive. Only applicable to scalable streams (VP9/AV1 SVC).
+func (d *DownTrack) SetTargetLayer(layer Layer) {
+	d.mu.Lock()
+	d.requested = layer
+	d.target = layer
+	d.lossyReports = 0
+	d.cleanReports = 0
+	switchingUp := layer.Spatial > d.current.Spatial
+	d.mu.Unlock()
+
+	// a higher spatial layer can only be decoded starting from a keyframe
+	if switchingUp {
+		d.track.RequestKeyframe()
+	}
+}
+
+// the layers being forwarded to the subscriber.
+func (d *DownTrack) TargetLayer() Layer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.target
+}
+
+// adapt the target layer to the packet loss reported by the subscriber (in
+// its receiver reports). The target is lowered after a few consecutive lossy
+// reports and raised back (up to the requested layer) once the loss is gone.
+func (d *DownTrack) HandleFractionLost(fractionLost uint8) {
+	d.mu.Lock()
+
+	switch {
+	case fractionLost >= lossyFractionLost:
+		d.lossyReports++
+		d.cleanReports = 0
+	case fractionLost <= cleanFractionLost:
+		d.cleanReports++
+		d.lossyReports = 0
+	default:
+		d.lossyReports = 0
+		d.cleanReports = 0
+	}
+
+	switchingUp := false
+	if d.lossyReports >= lossyReportsThreshold {
+		d.lowerTarget()
+		d.lossyReports = 0
+	} else if d.cleanReports >= cleanReportsThreshold {
+		switchingUp = d.raiseTarget()
+		d.cleanReports = 0
+	}
+	d.mu.Unlock()
+
+	if switchingUp {
+		d.track.RequestKeyframe()
+	}
+}
+
+// lower the target layer one step. A screen share keeps its resolution (the
+// shared content should stay readable) and lowers its frame rate (temporal
+// layer) first; a camera keeps its motion smooth and lowers its resolution
+// (spatial layer) first.
+func (d *DownTrack) lowerTarget() {
+	target := Layer{
+		Spatial:  min(d.target.Spatial, d.seen.Spatial),
+		Temporal: min(d.target.Temporal, d.seen.Temporal),
+	}
+
+	if d.track.source == SourceScreen {
+		if target.Temporal > 0 {
+			target.Temporal--
+		} else if target.Spatial > 0 {
+			target.Spatial--
+		}
+	} else {
+		if target.Spatial > 0 {
+			target.Spatial--
+		} else if target.Temporal > 0 {
+			target.Temporal--
+		}
+	}
+
+	d.target = target
+}
+
+// raise the target layer in the reverse order of lowerTarget. Returns true
+// in case the spatial layer has been raised.
+func (d *DownTrack) raiseTarget() bool {
+	limit := Layer{
+		Spatial:  min(d.requested.Spatial, d.seen.Spatial),
+		Temporal: min(d.requested.Temporal, d.seen.Temporal),
+	}
+
+	if d.target.Spatial >= limit.Spatial && d.target.Temporal >= limit.Temporal {
+		// the stream might gain new layers later on
+		d.target = d.requested
+		return false
+	}
+
+	// the layer lowered last is raised first
+	raiseSpatial := d.target.Temporal >= limit.Temporal
+	if d.track.source == SourceScreen {
+		raiseSpatial = d.target.Spatial < limit.Spatial
+	}
+
+	if raiseSpatial {
+		d.target.Spatial++
+		return true
+	}
+
+	d.target.Temporal++
+	return false
+}
+
+// decide if the packet should be forwarded based on its layer. Switching to
+// a lower layer happens at the start of a frame; switching to a higher
+// temporal layer happens at a switching point and to a higher spatial layer
+// at a keyframe.
+func (d *DownTrack) selectLayer(info layerInfo) bool {
+	if !info.ok {
+		return true
+	}
+
+	d.seen.Spatial = max(d.seen.Spatial, info.layer.Spatial)
+	d.seen.Temporal = max(d.seen.Temporal, info.layer.Temporal)
+
+	if info.start {
+		if d.target.Spatial < d.current.Spatial || (d.target.Spatial > d.current.Spatial && info.keyframe) {
+			d.current.Spatial = d.target.Spatial
+		}
+		if d.target.Temporal < d.current.Temporal || (d.target.Temporal > d.current.Temporal && info.switchUp) {
+			d.current.Temporal = d.target.Temporal
+		}
+	}
+
+	return info.layer.Spatial <= d.current.Spatial && info.layer.Temporal <= d.current.Temporal
+}
+
+// forward a packet of the track to the subscriber. New (or resumed)
+// subscribers start with the cached keyframe which already includes the
+// packet. Returns true in case the subscriber is waiting for a keyframe and
+// the cache is empty; a keyframe should be requested from the publisher.
+func (d *DownTrack) writeRTP(packet *Packet, info layerInfo, cache []cachedPacket, refs *packetRefs) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.takeReplay(len(cache)) {
+		if !d.bound {
+			return false, nil
+		}
+		return false, d.write(packet, info, refs)
+	}
+	if len(cache) == 0 {
+		return true, d.write(packet, info, refs)
+	}
+	return false, d.replay(cache, refs)
+}
+
+// check if the down track is waiting for the cached keyframe of `cached`
+// packets. The flag is cleared, the caller is expected to replay the cache
+// (or request a keyframe when the cache is empty). A down track that dropped
+// packets waits for its queue to drain before the replay; the replayed
+// packets would be dropped as well otherwise.
+func (d *DownTrack) takeReplay(cached int) bool {
+	// the flag is only set by the queue when it drops a packet
+	if d.resync.Load() {
+		if !d.queue.hasRoom(cached) {
+			return false
+		}
+		d.resync.Store(false)
+		d.needsReplay = true
+	}
+
+	if !d.bound || d.paused || !d.needsReplay {
+		return false
+	}
+	d.needsReplay = false
+	return true
+}
+
+// send the cached packets (starting with a keyframe) to the subscriber. The
+// packets are rewritten to directly follow the last packet sent to the
+// subscriber.
+func (d *DownTrack) replay(cache []cachedPacket, refs *packetRefs) error {
+	// leave a single frame (at 30 fps) between the last sent frame and the
+	// cached keyframe
+	d.munger.rebase(&cache[0].packet.Header, max(d.track.codec.ClockRate/30, d.restartGap))
+	d.restarted = false
+	errs := []error{}
+	for _, cached := range cache {
+		if err := d.write(cached.packet, cached.info, refs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// patch the header of the packet for the subscriber and push it to the
+// subscriber queue.
+func (d *DownTrack) write(packet *Packet, info layerInfo, refs *packetRefs) error {
+	payload := packet.Payload
+	if d.unwrapRED {
+		var err error
+		if payload, err = unwrapRED(payload); err != nil {
+			payload = nil
+		}
+	}
+
+	if d.paused || payload == nil || !d.selectLayer(info) {
+		d.munger.skip()
+		return nil
+	}
+
+	if d.restarted {
+		d.munger.rebase(&packet.Header, max(d.restartGap, 1))
+		d.restarted = false
+	}
+
+	header := packet.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	d.munger.rewrite(&header)
+	// the last packet of the highest forwarded spatial layer ends the frame
+	if info.ok && info.end && info.layer.Spatial == d.current.Spatial {
+		header.Marker = true
+	}
+
+	prio := d.priority
+	if d.redPayloadType != 0 {
+		d.writeULPFEC(header, payload, packet, refs, prio)
+		return nil
+	}
+
+	if slot := d.queue.reserve(d, prio); slot != nil {
+		refs.retain(packet)
+		*slot = outgoing{
+			downTrack: d,
+			writer:    d.writeStream,
+			header:    header,
+			payload:   payload,
+			packet:    packet,
+		}
+	}
+
+	if d.fec == nil {
+		return nil
+	}
+
+	for _, fecPacket := range d.fec.push(&header, payload, packet) {
+		d.queue.push(&outgoing{writer: d.writeStream, header: fecPacket.Header, payload: fecPacket.Payload}, prio)
+	}
+	return nil
+}
+
+// send the media packet wrapped in red. Every group of media packets is
+// followed by the placeholders of the ulpfec packets protecting the group;
+// they take their place in the sequence numbers of the stream and are
+// completed right before they are sent (see ULPFECFactory). A packet too
+// large to be wrapped is sent as is (with the media payload type) and left
+// unprotected; it still takes its place in the stream and in the group.
+func (d *DownTrack) writeULPFEC(header rtp.Header, payload []byte, packet *Packet, refs *packetRefs, prio priority) {
+	wrapped := NewPacket()
+	buffer := wrapped.Buffer()
+	if 1+len(payload) <= len(buffer) {
+		buffer[0] = byte(d.redPayloadType)
+		n := 1 + copy(buffer[1:], payload)
+		d.queue.push(&outgoing{
+			downTrack: d,
+			writer:    d.writeStream,
+			header:    header,
+			payload:   buffer[:n],
+			packet:    wrapped,
+		}, prio)
+	} else {
+		wrapped.Release()
+		header.PayloadType = uint8(d.redPayloadType)
+		refs.retain(packet)
+		d.queue.push(&outgoing{
+			downTrack: d,
+			writer:    d.writeStream,
+			header:    header,
+			payload:   payload,
+			packet:    packet,
+		}, prio)
+	}
+
+	d.ulpfecPackets++
+	if d.ulpfecPackets < fecMediaPackets {
+		return
+	}
+	d.ulpfecPackets = 0
+
+	for range fecRepairPackets {
+		d.queue.push(&outgoing{
+			writer: d.writeStream,
+			header: rtp.Header{
+				Version:        2,
+				PayloadType:    uint8(d.payloadType),
+				SequenceNumber: d.munger.insert(),
+				Timestamp:      header.Timestamp,
+				SSRC:           header.SSRC,
+			},
+			payload: d.ulpfecHeader,
+		}, prio)
+	}
+}
+
+func kindOf(codec webrtc.RTPCodecCapability) webrtc.RTPCodecType {
+	kind, _, _ := strings.Cut(codec.MimeType, "/")
+	switch {
+	case strings.EqualFold(kind, "audio"):
+		return webrtc.RTPCodecTypeAudio
+	case strings.EqualFold(kind, "video"):
+		return webrtc.RTPCodecTypeVideo
+	default:
+		return webrtc.RTPCodecType(0)
+	}
+}
@@ -0,0 +1,153 @@
+package forward
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// maximum number of packets kept since the latest keyframe. The cache is
+// dropped in case the keyframe interval is too long; new subscribers will
+// fallback to requesting a keyframe from the publisher.
+const maxKeyframeCachePackets = 1000
+
+// the video codecs the packets of which are inspected (e.g. to detect the
+// keyframes). The codec of a track is resolved once from its mime type.
+type videoCodec uint8
+
+const (
+	videoCodecOther videoCodec = iota
+	videoCodecVP8
+	videoCodecH264
+	videoCodecVP9
+	videoCodecAV1
+)
+
+func videoCodecOf(codec webrtc.RTPCodecCapability) videoCodec {
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		return videoCodecVP8
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		return videoCodecH264
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		return videoCodecVP9
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeAV1):
+		return videoCodecAV1
+	default:
+		return videoCodecOther
+	}
+}
+
+// scalable codecs (VP9/AV1 SVC) carry the layer of every packet.
+func (c videoCodec) scalable() bool {
+	return c == videoCodecVP9 || c == videoCodecAV1
+}
+
+// check if the packet is the first packet of a keyframe.
+func isKeyframe(codec videoCodec, payload []byte, info layerInfo) bool {
+	switch codec {
+	case videoCodecVP8:
+		return isVP8Keyframe(payload)
+	case videoCodecH264:
+		return isH264Keyframe(payload)
+	case videoCodecVP9:
+		return info.keyframe
+	case videoCodecAV1:
+		// the N bit of the aggregation header marks the first packet of a
+		// coded video sequence
+		return info.keyframe || (len(payload) > 0 && payload[0]&0x08 != 0)
+	default:
+		return false
+	}
+}
+
+// check if the packet is the first packet of a keyframe without the layer
+// information of the track; the vp9 keyframes cannot be detected.
+func IsKeyframe(codec webrtc.RTPCodecCapability, payload []byte) bool {
+	return isKeyframe(videoCodecOf(codec), payload, layerInfo{})
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc7741#section-4.2
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	x := payload[0]&0x80 != 0
+	s := payload[0]&0x10 != 0
+	pid := payload[0] & 0x07
+	if !s || pid != 0 {
+		return false
+	}
+
+	offset := 1
+	if x {
+		if len(payload) < 2 {
+			return false
+		}
+		i := payload[1]&0x80 != 0
+		l := payload[1]&0x40 != 0
+		t := payload[1]&0x20 != 0
+		k := payload[1]&0x10 != 0
+		offset++
+
+		if i {
+			if len(payload) <= offset {
+				return false
+			}
+			// extended (15 bits) picture id
+			if payload[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		if l {
+			offset++
+		}
+		if t || k {
+			offset++
+		}
+	}
+
+	if len(payload) <= offset {
+		return false
+	}
+
+	// the P bit of the VP8 payload header is not set for keyframes
+	return payload[offset]&0x01 == 0
+}
+
+const (
+	h264NaluIDR   = 5
+	h264NaluSPS   = 7
+	h264NaluSTAPA = 24
+	h264NaluFUA   = 28
+)
+
+// see: https://datatracker.ietf.org/doc/html/rfc6184#section-5.2
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalu := payload[0] & 0x1F; nalu {
+	case h264NaluIDR, h264NaluSPS:
+		return true
+	case h264NaluSTAPA:
+		offset := 1
+		for offset+2 < len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if nalu := payload[offset] & 0x1F; nalu == h264NaluIDR || nalu == h264NaluSPS {
+				return true
+			}
+			offset += size
+		}
+		return false
+	case h264NaluFUA:
+		// start of a fragmented IDR
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == h264NaluIDR
+	default:
+		return false
+	}
+}
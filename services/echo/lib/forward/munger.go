@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"math/rand/v2"
+
+	"github.com/pion/rtp"
+)
+
+// munger rewrites the sequence numbers and timestamps of the packets sent to
+// a subscriber so that the subscriber sees a single continuous stream even
+// when packets are dropped (paused track, dropped layers) or replayed (cached
+// keyframe).
+type munger struct {
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTs    uint32
+}
+
+// continue the outgoing stream from the given packet: the packet will get the
+// sequence number following the last sent packet and a timestamp `tsGap`
+// after the last sent timestamp. The first packet of the stream gets a random
+// sequence number and timestamp.
+func (m *munger) rebase(header *rtp.Header, tsGap uint32) {
+	if !m.started {
+		m.lastSeq = uint16(rand.Uint32())
+		m.lastTs = rand.Uint32()
+		m.started = true
+	}
+
+	m.seqOffset = header.SequenceNumber - (m.lastSeq + 1)
+	m.tsOffset = header.Timestamp - (m.lastTs + tsGap)
+}
+
+// remove the sequence number of a dropped packet from the outgoing stream.
+func (m *munger) skip() {
+	if m.started {
+		m.seqOffset++
+	}
+}
+
+// add a packet generated for the subscriber (e.g. ulpfec) to the outgoing
+// stream right after the last sent packet; returns its sequence number. The
+// following packets are shifted accordingly.
+func (m *munger) insert() uint16 {
+	m.lastSeq++
+	m.seqOffset--
+	return m.lastSeq
+}
+
+func (m *munger) rewrite(header *rtp.Header) {
+	if !m.started {
+		m.rebase(header, 0)
+	}
+
+	header.SequenceNumber -= m.seqOffset
+	header.Timestamp -= m.tsOffset
+
+	// retransmitted packets shouldn't move the stream backwards
+	if int16(header.SequenceNumber-m.lastSeq) > 0 {
+		m.lastSeq = header.SequenceNumber
+		m.lastTs = header.Timestamp
+	}
+}
@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+// size of the packet buffers; large enough for any RTP packet received over
+// the network.
+const mtu = 1500
+
+var packetPool = sync.Pool{
+	New: func() any {
+		return &Packet{buf: make([]byte, mtu)}
+	},
+}
+
+// Packet is a pooled RTP packet. The packet is read into its own buffer and
+// only the header is parsed (the payload points into the buffer) so that
+// forwarding a packet doesn't allocate. A packet is shared by all of the
+// subscribers of a track; it is reference counted and returned to the pool
+// once the last reference is released.
+type Packet struct {
+	rtp.Packet
+	buf  []byte
+	refs atomic.Int32
+}
+
+// get a packet from the pool. The caller owns a single reference.
+func NewPacket() *Packet {
+	packet := packetPool.Get().(*Packet)
+	packet.refs.Store(1)
+	return packet
+}
+
+// the buffer the packet should be read into.
+func (p *Packet) Buffer() []byte {
+	return p.buf
+}
+
+// parse the first `n` bytes of the buffer. The header slices (csrc and
+// extensions) of the pooled packet are reused.
+func (p *Packet) Unmarshal(n int) error {
+	if err := p.Packet.Unmarshal(p.buf[:n]); err != nil {
+		return err
+	}
+
+	// the payload excludes the padding
+	p.Header.Padding = false
+	p.PaddingSize = 0
+	return nil
+}
+
+func (p *Packet) Retain() {
+	p.refs.Add(1)
+}
+
+func (p *Packet) Release() {
+	if p.refs.Add(-1) == 0 {
+		packetPool.Put(p)
+	}
+}
+
+// references of a packet retained at once for all of the down tracks of a
+// track (a single atomic operation instead of one per subscriber). The down
+// tracks queueing the packet take one of them; the unused ones are released
+// once the packet is written.
+type packetRefs struct {
+	packet *Packet
+	count  int
+}
+
+func newPacketRefs(packet *Packet, count int) packetRefs {
+	packet.refs.Add(int32(count))
+	return packetRefs{packet: packet, count: count}
+}
+
+// retain the packet, with one of the references in case it is the packet of
+// the references (the cached packets are retained one by one).
+func (r *packetRefs) retain(packet *Packet) {
+	if packet == r.packet && r.count > 0 {
+		r.count--
+		return
+	}
+	packet.Retain()
+}
+
+func (r *packetRefs) release() {
+	if r.count > 0 && r.packet.refs.Add(-int32(r.count)) == 0 {
+		packetPool.Put(r.packet)
+	}
+	r.count = 0
+}
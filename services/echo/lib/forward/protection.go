@@ -0,0 +1,97 @@
+package forward
+
+import (
+	"errors"
+
+	"github.com/pion/interceptor/pkg/flexfec"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// number of media packets protected by a group of fec packets
+	fecMediaPackets = 5
+	// number of fec packets generated for each group of media packets
+	fecRepairPackets = 2
+)
+
+// generates a flexfec (draft 03) stream for the packets sent to a single
+// subscriber.
+type fecEncoder struct {
+	ssrc    webrtc.SSRC
+	encoder *flexfec.FlexEncoder03
+	packets []rtp.Packet
+	// the pooled packets the payloads of the group point into; they are
+	// retained until the group is encoded
+	sources []*Packet
+}
+
+func newFecEncoder(payloadType webrtc.PayloadType, mediaSSRC webrtc.SSRC, fecSSRC webrtc.SSRC) *fecEncoder {
+	return &fecEncoder{
+		ssrc: fecSSRC,
+		// the encoder writes the given ssrc as the protected ssrc
+		encoder: flexfec.NewFlexEncoder03(uint8(payloadType), uint32(mediaSSRC)),
+		packets: make([]rtp.Packet, 0, fecMediaPackets),
+		sources: make([]*Packet, 0, fecMediaPackets),
+	}
+}
+
+// add a sent media packet to the current group; the payload points into the
+// `source` packet. Returns the fec packets once the group is complete.
+func (e *fecEncoder) push(header *rtp.Header, payload []byte, source *Packet) []rtp.Packet {
+	source.Retain()
+	e.sources = append(e.sources, source)
+	e.packets = append(e.packets, rtp.Packet{Header: *header, Payload: payload})
+
+	if len(e.packets) < fecMediaPackets {
+		return nil
+	}
+
+	packets := e.encoder.EncodeFec(e.packets, fecRepairPackets)
+	for i := range packets {
+		packets[i].SSRC = uint32(e.ssrc)
+	}
+	e.reset()
+	return packets
+}
+
+// drop the current group and release its packets.
+func (e *fecEncoder) reset() {
+	for i, source := range e.sources {
+		source.Release()
+		e.sources[i] = nil
+		e.packets[i] = rtp.Packet{}
+	}
+	e.sources = e.sources[:0]
+	e.packets = e.packets[:0]
+}
+
+var errInvalidRED = errors.New("invalid red payload")
+
+// extract the primary encoding from a redundant audio (RFC 2198) payload.
+func unwrapRED(payload []byte) ([]byte, error) {
+	offset := 0
+	redundant := 0
+	for {
+		if offset >= len(payload) {
+			return nil, errInvalidRED
+		}
+
+		// last block header (F bit is not set) is a single byte
+		if payload[offset]&0x80 == 0 {
+			offset++
+			break
+		}
+
+		if offset+4 > len(payload) {
+			return nil, errInvalidRED
+		}
+		redundant += int(payload[offset+2]&0x03)<<8 | int(payload[offset+3])
+		offset += 4
+	}
+
+	if offset+redundant > len(payload) {
+		return nil, errInvalidRED
+	}
+	return payload[offset+redundant:], nil
+}
@@ -0,0 +1,306 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// maximum number of packets taken from the queue at once (see Queue.Run).
+const popBatch = 32
+
+// a packet waiting in the outbound queue of a subscriber. The header is the
+// header of the source packet patched for the subscriber; the payload points
+// into the source packet which is retained until the packet is sent (or
+// dropped).
+type outgoing struct {
+	downTrack *DownTrack
+	writer    webrtc.TrackLocalWriter
+	header    rtp.Header
+	payload   []byte
+	// nil for packets generated for the subscriber (e.g. fec)
+	packet *Packet
+}
+
+func (o *outgoing) size() int {
+	return o.header.MarshalSize() + len(o.payload)
+}
+
+func (o *outgoing) release() {
+	if o.packet != nil {
+		o.packet.Release()
+	}
+}
+
+// fixed size fifo of outgoing packets.
+type ring struct {
+	items []outgoing
+	head  int
+	size  int
+}
+
+func newRing(capacity int) ring {
+	return ring{items: make([]outgoing, capacity)}
+}
+
+// the slot of a new packet at the end of the ring.
+func (r *ring) reserve() *outgoing {
+	slot := &r.items[(r.head+r.size)%len(r.items)]
+	r.size++
+	return slot
+}
+
+func (r *ring) pop() outgoing {
+	packet := r.items[r.head]
+	r.items[r.head] = outgoing{}
+	r.head = (r.head + 1) % len(r.items)
+	r.size--
+	return packet
+}
+
+func (r *ring) clear() {
+	for r.size > 0 {
+		packet := r.pop()
+		packet.release()
+	}
+}
+
+// Queue is the outbound queue of a single subscriber. Down tracks push their
+// packets into the queue of their subscriber instead of writing them
+// directly; the queue is drained by its own goroutine (see Run) at a paced
+// rate. This way a slow (or stuck) subscriber only delays itself and never
+// the publisher nor the other subscribers.
+//
+// The queue is bounded. When it is full, lower priority packets are dropped
+// first: camera video, then screen share video and audio last. An incoming
+// packet replaces the oldest queued packet of a lower priority (an incoming
+// audio packet replaces the oldest audio packet in case the queue is full of
+// audio) or is dropped. The down track that lost a video packet resyncs from
+// the next keyframe.
+type Queue struct {
+	mu sync.Mutex
+	// packets by priority
+	rings    [priorities]ring
+	size     int
+	capacity int
+	// pacing rate in bytes per second (zero disables pacing)
+	rate   int
+	burst  int
+	signal chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// create a queue that holds up to `capacity` packets and sends them at
+// `bitrate` bits per second (zero disables pacing).
+func NewQueue(capacity int, bitrate int) *Queue {
+	rate := bitrate / 8
+	rings := [priorities]ring{}
+	for i := range rings {
+		rings[i] = newRing(capacity)
+	}
+
+	return &Queue{
+		rings:    rings,
+		capacity: capacity,
+		rate:     rate,
+		// allow sending up to 20ms worth of data at once
+		burst:  max(rate/50, 1500*4),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// add a packet to the queue. The queue takes over the packet reference. The
+// caller holds the queue lock (see DownTrack.mu).
+func (q *Queue) push(packet *outgoing, prio priority) {
+	if slot := q.reserve(packet.downTrack, prio); slot != nil {
+		*slot = *packet
+	} else {
+		packet.release()
+	}
+}
+
+// reserve the slot of a new packet of the down track (nil for the packets
+// generated for the subscriber); the caller fills it before releasing the
+// queue lock. Returns nil in case the packet is dropped.
+func (q *Queue) reserve(downTrack *DownTrack, prio priority) *outgoing {
+	if q.closed {
+		return nil
+	}
+
+	if q.size == q.capacity {
+		victim, ok := q.victim(prio)
+		if !ok {
+			q.resync(downTrack)
+			return nil
+		}
+		dropped := q.rings[victim].pop()
+		q.resync(dropped.downTrack)
+		dropped.release()
+		q.size--
+	}
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	q.size++
+	return q.rings[prio].reserve()
+}
+
+// a down track that lost a video packet resyncs from the next keyframe.
+func (q *Queue) resync(downTrack *DownTrack) {
+	if downTrack != nil && downTrack.Kind() == webrtc.RTPCodecTypeVideo {
+		downTrack.resync.Store(true)
+	}
+}
+
+// find the priority of the packet to drop to make room for a packet of the
+// given priority. Audio packets replace each other as a last resort.
+func (q *Queue) victim(prio priority) (priority, bool) {
+	for victim := range prio {
+		if q.rings[victim].size > 0 {
+			return victim, true
+		}
+	}
+
+	if prio == priorityAudio && q.rings[prio].size > 0 {
+		return prio, true
+	}
+	return 0, false
+}
+
+// move the packets that can be sent right away to `packets` and return
+// their number: up to len(packets) packets of at most `budget` bytes (the
+// first packet is always taken). Higher priority packets are always sent
+// first.
+func (q *Queue) pop(packets []outgoing, budget int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for prio := priorities - 1; prio >= 0 && n < len(packets); prio-- {
+		ring := &q.rings[prio]
+		for ring.size > 0 && n < len(packets) {
+			size := ring.items[ring.head].size()
+			if n > 0 && size > budget {
+				return n
+			}
+			budget -= size
+			packets[n] = ring.pop()
+			q.size--
+			n++
+		}
+	}
+	return n
+}
+
+// number of packets waiting in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// check if `count` more packets fit in the queue without dropping any (or
+// if the queue is empty in case it can't hold them all). The caller holds
+// the queue lock.
+func (q *Queue) hasRoom(count int) bool {
+	return q.capacity-q.size >= min(count, q.capacity)
+}
+
+// drain the queue until it is closed. Must be called in its own goroutine.
+func (q *Queue) Run() {
+	tokens := q.burst
+	last := time.Now()
+	// the written header escapes to the interceptors and is reused to avoid
+	// allocating it for every packet. The interceptors may add header
+	// extensions; the extensions are copied so that the source packet is never
+	// modified.
+	header := &rtp.Header{}
+	extensions := []rtp.Extension{}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	// the packets are taken from the queue in batches (a single lock) of the
+	// packets that fit in the tokens
+	batch := make([]outgoing, popBatch)
+
+	for {
+		budget := math.MaxInt
+		if q.rate > 0 {
+			now := time.Now()
+			tokens = min(q.burst, tokens+int(now.Sub(last).Seconds()*float64(q.rate)))
+			last = now
+			budget = tokens
+		}
+
+		n := q.pop(batch, budget)
+		if n == 0 {
+			select {
+			case <-q.signal:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		for i := range n {
+			packet := &batch[i]
+			if q.rate > 0 {
+				// only the first packet of a batch might not fit in the tokens
+				size := packet.size()
+				if tokens < size {
+					wait := time.Duration(float64(size-tokens) / float64(q.rate) * float64(time.Second))
+					timer.Reset(wait)
+					select {
+					case <-timer.C:
+					case <-q.done:
+						for _, pending := range batch[i:n] {
+							pending.release()
+						}
+						return
+					}
+					tokens = size
+					last = time.Now()
+				}
+				tokens -= size
+			}
+
+			*header = packet.header
+			header.Extensions = append(extensions[:0], packet.header.Extensions...)
+
+			_, err := packet.writer.WriteRTP(header, packet.payload)
+			// ErrClosedPipe means the subscriber connection is closed or not ready yet
+			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Println("[queue]", err)
+			}
+
+			extensions = header.Extensions[:0]
+			packet.release()
+			*packet = outgoing{}
+		}
+	}
+}
+
+// stop the queue goroutine and drop the queued packets.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for i := range q.rings {
+		q.rings[i].clear()
+	}
+	q.size = 0
+	close(q.done)
+}
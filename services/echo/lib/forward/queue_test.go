@@ -0,0 +1,444 @@
+package forward
+
+import (
+	"encoding/binary"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// push a packet of the down track to the queue; the test keeps its own
+// reference to the packet to check that the queue released it.
+func pushTestPacket(queue *Queue, downTrack *DownTrack, sequenceNumber uint16) *Packet {
+	packet := NewPacket()
+	packet.Retain()
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.push(&outgoing{
+		downTrack: downTrack,
+		writer:    &benchWriter{},
+		header:    rtp.Header{SequenceNumber: sequenceNumber},
+		packet:    packet,
+	}, downTrack.priority)
+	return packet
+}
+
+// pop the next packet to send.
+func popTestPacket(queue *Queue) (outgoing, bool) {
+	packets := make([]outgoing, 1)
+	if queue.pop(packets, math.MaxInt) == 0 {
+		return outgoing{}, false
+	}
+	return packets[0], true
+}
+
+func TestQueueDropOrder(t *testing.T) {
+	queue := NewQueue(3, 0)
+	defer queue.Close()
+
+	vp8 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	camera := NewTrack(vp8, "camera", "stream", SourceCamera).NewDownTrack(queue)
+	screen := NewTrack(vp8, "screen", "stream", SourceScreen).NewDownTrack(queue)
+	audio := NewTrack(opus, "audio", "stream", SourceMicrophone).NewDownTrack(queue)
+
+	packets := []*Packet{
+		pushTestPacket(queue, camera, 1),
+		pushTestPacket(queue, screen, 2),
+		pushTestPacket(queue, audio, 3),
+	}
+	if camera.resync.Load() || screen.resync.Load() {
+		t.Fatal("resync requested before the queue was full")
+	}
+
+	// each incoming audio packet replaces the lowest priority packet: camera,
+	// screen then the oldest audio packet
+	steps := []struct {
+		dropped *Packet
+		resync  *DownTrack
+	}{
+		{dropped: packets[0], resync: camera},
+		{dropped: packets[1], resync: screen},
+		{dropped: packets[2]},
+	}
+	for i, step := range steps {
+		packets = append(packets, pushTestPacket(queue, audio, uint16(4+i)))
+		if refs := step.dropped.refs.Load(); refs != 1 {
+			t.Fatalf("step %d: the dropped packet holds %d references", i, refs)
+		}
+		if step.resync != nil && !step.resync.resync.Load() {
+			t.Fatalf("step %d: the down track of the dropped video packet doesn't resync", i)
+		}
+		if queue.Len() != 3 {
+			t.Fatalf("step %d: %d packets queued, expected 3", i, queue.Len())
+		}
+	}
+	if audio.resync.Load() {
+		t.Fatal("resync requested for audio")
+	}
+
+	// the video packets are dropped when the queue is full of audio
+	camera.resync.Store(false)
+	dropped := pushTestPacket(queue, camera, 7)
+	if refs := dropped.refs.Load(); refs != 1 || !camera.resync.Load() {
+		t.Fatal("the camera packet was queued instead of dropped")
+	}
+
+	for _, expected := range []uint16{4, 5, 6} {
+		sent, ok := popTestPacket(queue)
+		if !ok || sent.header.SequenceNumber != expected || sent.downTrack != audio {
+			t.Fatalf("popped %d, expected audio packet %d", sent.header.SequenceNumber, expected)
+		}
+		sent.release()
+	}
+	if _, ok := popTestPacket(queue); ok {
+		t.Fatal("the queue is not empty")
+	}
+}
+
+func TestQueuePopBudget(t *testing.T) {
+	queue := NewQueue(8, 0)
+	defer queue.Close()
+
+	vp8 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	camera := NewTrack(vp8, "camera", "stream", SourceCamera).NewDownTrack(queue)
+	audio := NewTrack(opus, "audio", "stream", SourceMicrophone).NewDownTrack(queue)
+	for i, downTrack := range []*DownTrack{camera, camera, audio, audio} {
+		pushTestPacket(queue, downTrack, uint16(i)).Release()
+	}
+
+	// the packets (12 bytes headers) are taken by priority while they fit in
+	// the budget; the first one is always taken
+	steps := []struct {
+		batch    int
+		budget   int
+		expected []uint16
+	}{
+		{batch: 4, budget: 30, expected: []uint16{2, 3}},
+		{batch: 4, budget: 0, expected: []uint16{0}},
+		{batch: 1, budget: math.MaxInt, expected: []uint16{1}},
+		{batch: 4, budget: math.MaxInt},
+	}
+	for i, step := range steps {
+		packets := make([]outgoing, step.batch)
+		n := queue.pop(packets, step.budget)
+		if n != len(step.expected) {
+			t.Fatalf("step %d: %d packets popped, expected %d", i, n, len(step.expected))
+		}
+		for j, packet := range packets[:n] {
+			if packet.header.SequenceNumber != step.expected[j] {
+				t.Fatalf("step %d: popped %d, expected %d", i, packet.header.SequenceNumber, step.expected[j])
+			}
+			packet.release()
+		}
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	queue := NewQueue(8, 0)
+
+	vp8 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	camera := NewTrack(vp8, "camera", "stream", SourceCamera).NewDownTrack(queue)
+	audio := NewTrack(opus, "audio", "stream", SourceMicrophone).NewDownTrack(queue)
+
+	packets := []*Packet{}
+	for i := range 6 {
+		downTrack := camera
+		if i%2 == 0 {
+			downTrack = audio
+		}
+		packets = append(packets, pushTestPacket(queue, downTrack, uint16(i)))
+	}
+
+	queue.Close()
+	// the packets pushed after closing are released right away
+	packets = append(packets, pushTestPacket(queue, camera, 6))
+
+	for i, packet := range packets {
+		if refs := packet.refs.Load(); refs != 1 {
+			t.Fatalf("packet %d holds %d references after closing the queue", i, refs)
+		}
+		packet.Release()
+	}
+	if queue.Len() != 0 {
+		t.Fatalf("%d packets queued after closing the queue", queue.Len())
+	}
+}
+
+// a subscriber connection that counts the written packets. A stuck writer
+// blocks forever, simulating a receiver that stopped reading.
+type benchWriter struct {
+	written atomic.Int64
+	stuck   chan struct{}
+}
+
+func (w *benchWriter) WriteRTP(_ *rtp.Header, payload []byte) (int, error) {
+	if w.stuck != nil {
+		<-w.stuck
+	}
+	w.written.Add(1)
+	return len(payload), nil
+}
+
+func (w *benchWriter) Write(b []byte) (int, error) {
+	return w.WriteRTP(nil, b)
+}
+
+type benchContext struct {
+	id     string
+	writer webrtc.TrackLocalWriter
+}
+
+func (c *benchContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}, PayloadType: 111},
+	}
+}
+
+func (c *benchContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (c *benchContext) SSRC() webrtc.SSRC                                      { return 1234 }
+func (c *benchContext) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (c *benchContext) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (c *benchContext) WriteStream() webrtc.TrackLocalWriter                   { return c.writer }
+func (c *benchContext) ID() string                                             { return c.id }
+func (c *benchContext) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+type benchSubscriber struct {
+	queue  *Queue
+	writer *benchWriter
+}
+
+// packets pushed by the benchmarks before waiting for the healthy subscribers
+// to catch up; the queues hold them all so that the healthy subscribers never
+// drop. The queues are kept small: a queue sized for all of the benchmark
+// packets is scanned by the garbage collector over and over and dominates
+// the measure.
+const benchBatch = 256
+
+// create a track forwarded to `count` subscribers; the first `stuck`
+// subscribers never read their packets. The queues are drained by their
+// goroutines unless `run` is false.
+func newBenchTrack(b *testing.B, codec webrtc.RTPCodecCapability, count int, stuck int, run bool) (*Track, []benchSubscriber) {
+	track := NewTrack(codec, "track", "stream", DefaultSource(kindOf(codec)))
+	subscribers := []benchSubscriber{}
+
+	for i := range count {
+		writer := &benchWriter{}
+		if i < stuck {
+			writer.stuck = make(chan struct{})
+		}
+
+		queue := NewQueue(benchBatch, 0)
+		if run {
+			go queue.Run()
+		}
+
+		downTrack := track.NewDownTrack(queue)
+		if _, err := downTrack.Bind(&benchContext{id: "sub", writer: writer}); err != nil {
+			b.Fatal(err)
+		}
+
+		subscribers = append(subscribers, benchSubscriber{queue: queue, writer: writer})
+	}
+
+	b.Cleanup(func() {
+		for _, subscriber := range subscribers {
+			if subscriber.writer.stuck != nil {
+				close(subscriber.writer.stuck)
+			}
+			subscriber.queue.Close()
+		}
+	})
+
+	return track, subscribers
+}
+
+// an opus packet as received from the network
+func benchRawPacket(b *testing.B, payloadSize int) []byte {
+	return benchMarshal(b, 111, make([]byte, payloadSize))
+}
+
+// a vp8 packet holding a whole frame as received from the network; the
+// payload starts with the payload descriptor (start of partition 0) and the
+// frame tag of a keyframe or of an interframe.
+func benchRawVP8Packet(b *testing.B, payloadSize int, keyframe bool) []byte {
+	payload := make([]byte, payloadSize)
+	payload[0] = 0x10
+	if !keyframe {
+		payload[1] = 0x01
+	}
+	return benchMarshal(b, 96, payload)
+}
+
+func benchMarshal(b *testing.B, payloadType uint8, payload []byte) []byte {
+	raw, err := (&rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			PayloadType: payloadType,
+			SSRC:        5678,
+		},
+		Payload: payload,
+	}).Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return raw
+}
+
+// simulate reading the i-th packet from the network into a pooled packet
+func readBenchPacket(b *testing.B, raw []byte, i int) *Packet {
+	packet := NewPacket()
+	n := copy(packet.Buffer(), raw)
+	binary.BigEndian.PutUint16(packet.Buffer()[2:], uint16(i))
+	binary.BigEndian.PutUint32(packet.Buffer()[4:], uint32(i)*960)
+	if err := packet.Unmarshal(n); err != nil {
+		b.Fatal(err)
+	}
+	return packet
+}
+
+// forward the packets returned by `raw` for every index to 10 subscribers;
+// the first `stuck` subscribers never read their packets. The measure
+// includes the delivery of the packets to the healthy subscribers by the
+// goroutines of their queues (see BenchmarkForwardWrite for the publisher
+// side alone).
+func benchmarkForward(b *testing.B, codec webrtc.RTPCodecCapability, stuck int, raw func(i int) []byte) {
+	track, subscribers := newBenchTrack(b, codec, 10, stuck, true)
+	healthy := subscribers[stuck:]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		packet := readBenchPacket(b, raw(i), i)
+		if err := track.Write(packet); err != nil {
+			b.Fatal(err)
+		}
+		packet.Release()
+
+		// let the healthy subscribers catch up before their queues are full
+		if (i+1)%benchBatch == 0 {
+			waitBenchSubscribers(healthy, i+1)
+		}
+	}
+	waitBenchSubscribers(healthy, b.N)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
+
+// the publisher side of the forwarding: Track.Write patches the opus packets
+// for 10 subscribers and queues them. The queues have no goroutine; they are
+// emptied outside of the measure before they are full.
+func BenchmarkForwardWrite(b *testing.B) {
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}
+	track, subscribers := newBenchTrack(b, opus, 10, 0, false)
+	raw := benchRawPacket(b, 160)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		packet := readBenchPacket(b, raw, i)
+		if err := track.Write(packet); err != nil {
+			b.Fatal(err)
+		}
+		packet.Release()
+
+		if (i+1)%benchBatch == 0 {
+			b.StopTimer()
+			for _, subscriber := range subscribers {
+				for {
+					sent, ok := popTestPacket(subscriber.queue)
+					if !ok {
+						break
+					}
+					sent.release()
+				}
+			}
+			b.StartTimer()
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
+
+// wait for the subscribers to receive `count` packets.
+func waitBenchSubscribers(subscribers []benchSubscriber, count int) {
+	for _, subscriber := range subscribers {
+		for subscriber.writer.written.Load() < int64(count) {
+			runtime.Gosched()
+		}
+	}
+}
+
+func benchmarkForwardOpus(b *testing.B, stuck int) {
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}
+	raw := benchRawPacket(b, 160)
+	benchmarkForward(b, opus, stuck, func(int) []byte { return raw })
+}
+
+// a keyframe every 100 frames; the packets since the latest keyframe are
+// cached for the new subscribers.
+func benchmarkForwardVP8(b *testing.B, stuck int) {
+	vp8 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	keyframe := benchRawVP8Packet(b, 1000, true)
+	interframe := benchRawVP8Packet(b, 1000, false)
+	benchmarkForward(b, vp8, stuck, func(i int) []byte {
+		if i%100 == 0 {
+			return keyframe
+		}
+		return interframe
+	})
+}
+
+// forward pooled opus packets to 10 subscribers. Run with -cpu 1 to get the
+// packets per second per core.
+func BenchmarkForward(b *testing.B) {
+	benchmarkForwardOpus(b, 0)
+}
+
+// a stuck subscriber must not slow down the publisher or the other subscribers.
+func BenchmarkForwardStuckReceiver(b *testing.B) {
+	benchmarkForwardOpus(b, 1)
+}
+
+// forward pooled vp8 packets to 10 subscribers; unlike opus, the packets are
+// inspected for keyframes and cached.
+func BenchmarkForwardVP8(b *testing.B) {
+	benchmarkForwardVP8(b, 0)
+}
+
+// the queue of the stuck subscriber drops video packets once it is full.
+func BenchmarkForwardVP8StuckReceiver(b *testing.B) {
+	benchmarkForwardVP8(b, 1)
+}
+
+// the queue of a stuck subscriber fills up and drops video before audio.
+func BenchmarkQueueOverflow(b *testing.B) {
+	queue := NewQueue(64, 0)
+	writer := &benchWriter{}
+	payload := make([]byte, 1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		prio := priorityCamera
+		if i%4 == 0 {
+			prio = priorityAudio
+		}
+		header := rtp.Header{SequenceNumber: uint16(i)}
+		queue.mu.Lock()
+		queue.push(&outgoing{writer: writer, header: header, payload: payload}, prio)
+		queue.mu.Unlock()
+	}
+	b.StopTimer()
+
+	if queue.Len() > 64 {
+		b.Fatalf("queue exceeded its capacity: %d", queue.Len())
+	}
+}
@@ -0,0 +1,111 @@
+package forward
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Sink receives the packets of a track besides its subscribers (e.g. a
+// recorder). Like a subscriber, a sink sees a single continuous stream: the
+// sequence numbers and timestamps are rewritten when the track is restarted
+// with another remote track.
+//
+// WritePacket is called from the publisher read loop and must not block. The
+// header is only valid during the call and the packet should be retained to
+// keep it after returning.
+type Sink interface {
+	WritePacket(header *rtp.Header, packet *Packet)
+	Close() error
+}
+
+// SenderReportSink is a sink that maps the timestamps of the packets to the
+// wall clock (e.g. to align the audio and video of a recording). The RTP time
+// of the sender reports is in the timeline of the sink packets.
+type SenderReportSink interface {
+	Sink
+	WriteSenderReport(ntpTime time.Time, rtpTime uint32)
+}
+
+// the state of a sink is guarded by its own lock so that the track writes to
+// its sinks without holding the track lock.
+type sink struct {
+	Sink
+	mu     sync.Mutex
+	munger munger
+	// the sink has been removed from the track (or closed); nothing is
+	// written to it anymore
+	removed bool
+	// the packets are not written to a paused sink
+	paused bool
+	// the track has been restarted; the next packet continues the stream
+	// `restartGap` (in clock rate units) after the last written packet
+	restarted  bool
+	restartGap uint32
+	// generation of the track the sink is following; the packets of a
+	// previous generation still being written are dropped
+	generation uint64
+}
+
+func (s *sink) write(packet *Packet, generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused || s.removed || s.generation != generation {
+		return
+	}
+
+	header := packet.Header
+	if s.restarted {
+		s.munger.rebase(&header, max(s.restartGap, 1))
+		s.restarted = false
+	}
+	s.munger.rewrite(&header)
+	s.WritePacket(&header, packet)
+}
+
+// forward the sender report of the publisher. The report is skipped until the
+// stream of the sink continues after a restart or a pause (the RTP time
+// cannot be translated yet).
+func (s *sink) writeSenderReport(ntpTime time.Time, rtpTime uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reportSink, ok := s.Sink.(SenderReportSink)
+	if !ok || s.paused || s.removed || s.restarted || !s.munger.started {
+		return
+	}
+	reportSink.WriteSenderReport(ntpTime, rtpTime-s.munger.tsOffset)
+}
+
+// set the pause state of the sink; returns whether it changed.
+func (s *sink) setPaused(paused bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused == paused {
+		return false
+	}
+	s.paused = paused
+	s.restarted = true
+	s.restartGap = 0
+	return true
+}
+
+func (s *sink) restart(gap uint32, generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restarted = true
+	s.restartGap = gap
+	s.generation = generation
+}
+
+// stop writing to the sink. A write in progress completes before it returns.
+func (s *sink) remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removed = true
+}
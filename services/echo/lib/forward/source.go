@@ -0,0 +1,54 @@
+package forward
+
+import "github.com/pion/webrtc/v4"
+
+// Source is what a published track is capturing. A member publishes at most
+// one track per source.
+type Source string
+
+const (
+	SourceMicrophone Source = "microphone"
+	SourceCamera     Source = "camera"
+	SourceScreen     Source = "screen"
+	// audio captured along with a screen share (e.g. a shared tab)
+	SourceScreenAudio Source = "screen-audio"
+)
+
+func (s Source) IsValid() bool {
+	switch s {
+	case SourceMicrophone, SourceCamera, SourceScreen, SourceScreenAudio:
+		return true
+	default:
+		return false
+	}
+}
+
+// the source of a track that wasn't announced by its publisher.
+func DefaultSource(kind webrtc.RTPCodecType) Source {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return SourceMicrophone
+	}
+	return SourceCamera
+}
+
+// priority of the packets in the outbound queue of a subscriber. Lower
+// priority packets are dropped first when the queue is full and sent last.
+type priority int
+
+const (
+	priorityCamera priority = iota
+	priorityScreen
+	priorityAudio
+	priorities
+)
+
+func priorityOf(kind webrtc.RTPCodecType, source Source) priority {
+	switch {
+	case kind == webrtc.RTPCodecTypeAudio:
+		return priorityAudio
+	case source == SourceScreen:
+		return priorityScreen
+	default:
+		return priorityCamera
+	}
+}
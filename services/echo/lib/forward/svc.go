@@ -0,0 +1,195 @@
+package forward
+
+import "errors"
+
+// uri of the AV1 dependency descriptor RTP header extension.
+// see: https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension
+const DependencyDescriptorURI = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
+
+// highest spatial/temporal layer id that can be signaled by VP9 and AV1.
+const MaxLayer = 7
+
+var errShortPacket = errors.New("packet is too short")
+
+// a spatial and temporal layer of a scalable (SVC) video stream.
+type Layer struct {
+	Spatial  int `json:"spatial"`
+	Temporal int `json:"temporal"`
+}
+
+var maxLayer = Layer{Spatial: MaxLayer, Temporal: MaxLayer}
+
+// scalability information of a single RTP packet.
+type layerInfo struct {
+	// false in case the packet doesn't carry any layer information (e.g. non
+	// scalable codec or a scalable stream with a single layer)
+	ok    bool
+	layer Layer
+	// first/last packet of a layer frame
+	start bool
+	end   bool
+	// the frame doesn't depend on any previous frame
+	keyframe bool
+	// switching to a higher temporal layer is possible starting from this frame
+	switchUp bool
+}
+
+// parse the VP9 payload descriptor.
+// see: https://datatracker.ietf.org/doc/html/rfc9628#section-4.2
+func parseVP9(payload []byte) (layerInfo, error) {
+	info := layerInfo{}
+	if len(payload) < 1 {
+		return info, errShortPacket
+	}
+
+	i := payload[0]&0x80 != 0
+	p := payload[0]&0x40 != 0
+	l := payload[0]&0x20 != 0
+	info.start = payload[0]&0x08 != 0
+	info.end = payload[0]&0x04 != 0
+
+	offset := 1
+	if i {
+		if len(payload) <= offset {
+			return info, errShortPacket
+		}
+		// extended (15 bits) picture id
+		if payload[offset]&0x80 != 0 {
+			offset++
+		}
+		offset++
+	}
+
+	if !l {
+		info.keyframe = !p && info.start
+		return info, nil
+	}
+
+	if len(payload) <= offset {
+		return info, errShortPacket
+	}
+
+	info.ok = true
+	info.layer.Temporal = int(payload[offset] >> 5)
+	info.switchUp = payload[offset]&0x10 != 0
+	info.layer.Spatial = int((payload[offset] >> 1) & 0x07)
+	info.keyframe = !p && info.start && info.layer.Spatial == 0
+	return info, nil
+}
+
+// the part of the AV1 dependency descriptor template structure needed to map
+// the frame template to its spatial and temporal layers.
+type av1Structure struct {
+	templateIdOffset int
+	layers           []Layer
+}
+
+type bitReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *bitReader) read(bits int) (int, error) {
+	value := 0
+	for range bits {
+		index := r.offset / 8
+		if index >= len(r.data) {
+			return 0, errShortPacket
+		}
+		bit := (r.data[index] >> (7 - r.offset%8)) & 1
+		value = value<<1 | int(bit)
+		r.offset++
+	}
+	return value, nil
+}
+
+// parse the AV1 dependency descriptor. The template dependency structure is
+// only sent with keyframes (or when it changes); it is stored in `structure`
+// to be used by the following packets.
+// see: https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-format
+func parseAV1DependencyDescriptor(data []byte, structure *av1Structure) (layerInfo, error) {
+	info := layerInfo{}
+	reader := bitReader{data: data}
+
+	start, err := reader.read(1)
+	if err != nil {
+		return info, err
+	}
+	end, _ := reader.read(1)
+	templateId, _ := reader.read(6)
+	if _, err := reader.read(16); err != nil { // frame number
+		return info, err
+	}
+
+	info.start = start == 1
+	info.end = end == 1
+
+	if len(data) > 3 {
+		structurePresent, err := reader.read(1)
+		if err != nil {
+			return info, err
+		}
+		// active decode targets, custom dtis, custom fdiffs and custom chains flags
+		if _, err := reader.read(4); err != nil {
+			return info, err
+		}
+
+		if structurePresent == 1 {
+			if err := parseAV1TemplateLayers(&reader, structure); err != nil {
+				return info, err
+			}
+			info.keyframe = info.start
+		}
+	}
+
+	if len(structure.layers) == 0 {
+		return info, nil
+	}
+
+	index := (templateId + 64 - structure.templateIdOffset) % 64
+	if index >= len(structure.layers) {
+		return info, errors.New("unknown frame dependency template")
+	}
+
+	info.ok = true
+	info.layer = structure.layers[index]
+	info.switchUp = info.start
+	return info, nil
+}
+
+func parseAV1TemplateLayers(reader *bitReader, structure *av1Structure) error {
+	offset, err := reader.read(6)
+	if err != nil {
+		return err
+	}
+	// decode targets count minus one
+	if _, err := reader.read(5); err != nil {
+		return err
+	}
+
+	layers := []Layer{}
+	current := Layer{}
+	for {
+		layers = append(layers, current)
+		nextLayerIdc, err := reader.read(2)
+		if err != nil {
+			return err
+		}
+
+		switch nextLayerIdc {
+		case 1:
+			current.Temporal++
+		case 2:
+			current.Temporal = 0
+			current.Spatial++
+		case 3:
+			structure.templateIdOffset = offset
+			structure.layers = layers
+			return nil
+		}
+
+		if len(layers) >= 64 {
+			return errors.New("too many frame dependency templates")
+		}
+	}
+}
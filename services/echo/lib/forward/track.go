@@ -0,0 +1,376 @@
+package forward
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Track is the server side copy of a track published by a member. Packets
+// read from the publisher are written into the track which fans them out to
+// every subscriber through a dedicated DownTrack. Unlike
+// webrtc.TrackLocalStaticRTP, every subscriber owns its own writer which
+// makes it possible to control the forwarding per subscriber (e.g. pause it)
+// without touching the other subscribers or renegotiating.
+//
+// A track outlives the remote track it is reading from: when the publisher
+// renegotiates or reconnects, the track is restarted with the new remote
+// track and the subscribers keep receiving a single continuous stream.
+type Track struct {
+	mu                sync.RWMutex
+	id                string
+	streamId          string
+	source            Source
+	codec             webrtc.RTPCodecCapability
+	kind              webrtc.RTPCodecType
+	video             videoCodec
+	downTracks        []*DownTrack
+	onKeyframeRequest func()
+	// negotiated id of the AV1 dependency descriptor header extension
+	dependencyDescriptorId uint8
+	av1Structure           av1Structure
+	// packets received since the latest keyframe (video only)
+	keyframeCache []cachedPacket
+	// incremented every time the track is restarted with a new remote track
+	generation uint64
+	activity   Activity
+	// replaced (never modified in place) when a sink is added or removed so
+	// that the packets are written to a snapshot without holding the lock
+	sinks []*sink
+}
+
+// seconds between the NTP (1900) and the unix (1970) epochs
+const ntpEpochOffset = 2_208_988_800
+
+// Activity of the remote track the track is reading from.
+type Activity struct {
+	// number of packets received
+	Packets uint64
+	// arrival time of the latest packet
+	LastPacket time.Time
+	// arrival time of the latest keyframe (video only)
+	LastKeyframe time.Time
+}
+
+// a retained packet of the keyframe cache.
+type cachedPacket struct {
+	packet *Packet
+	info   layerInfo
+}
+
+func NewTrack(codec webrtc.RTPCodecCapability, id string, streamId string, source Source) *Track {
+	return &Track{
+		id:         id,
+		streamId:   streamId,
+		source:     source,
+		codec:      codec,
+		kind:       kindOf(codec),
+		video:      videoCodecOf(codec),
+		downTracks: []*DownTrack{},
+	}
+}
+
+func (t *Track) ID() string {
+	return t.id
+}
+
+func (t *Track) StreamID() string {
+	return t.streamId
+}
+
+func (t *Track) Source() Source {
+	return t.source
+}
+
+func (t *Track) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+func (t *Track) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+// create a new subscriber writer for this track. The returned down track
+// should be added to the subscriber peer connection. `queue` is the outbound
+// queue of the subscriber.
+func (t *Track) NewDownTrack(queue *Queue) *DownTrack {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	downTrack := newDownTrack(t, queue)
+	t.downTracks = append(t.downTracks, downTrack)
+	return downTrack
+}
+
+func (t *Track) RemoveDownTrack(downTrack *DownTrack) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.downTracks = slices.DeleteFunc(t.downTracks, func(d *DownTrack) bool {
+		return d == downTrack
+	})
+}
+
+// write the packets of the track to the sink until the sink is removed or
+// the track is closed. A paused sink doesn't receive any packet until it is
+// resumed.
+func (t *Track) AddSink(s Sink, paused bool) {
+	t.mu.Lock()
+	t.sinks = append(t.sinks, &sink{Sink: s, paused: paused, generation: t.generation})
+	t.mu.Unlock()
+
+	// the sink stream starts with a keyframe as soon as possible
+	if !paused {
+		t.RequestKeyframe()
+	}
+}
+
+// stop (or start again) writing the packets to the sink. A resumed sink
+// continues its stream right after the last packet written before the pause
+// as if the packets in between were never sent.
+func (t *Track) SetSinkPaused(s Sink, paused bool) {
+	t.mu.RLock()
+	sinks := t.sinks
+	t.mu.RUnlock()
+
+	changed := false
+	for _, sink := range sinks {
+		if sink.Sink == s && sink.setPaused(paused) {
+			changed = true
+		}
+	}
+
+	if changed && !paused {
+		t.RequestKeyframe()
+	}
+}
+
+// stop writing to the sink; the sink is not closed. Nothing is written to the
+// sink once it returns.
+func (t *Track) RemoveSink(s Sink) {
+	t.mu.Lock()
+	var removed []*sink
+	t.sinks = slices.DeleteFunc(slices.Clone(t.sinks), func(sink *sink) bool {
+		if sink.Sink == s {
+			removed = append(removed, sink)
+			return true
+		}
+		return false
+	})
+	t.mu.Unlock()
+
+	for _, sink := range removed {
+		sink.remove()
+	}
+}
+
+// set the negotiated id of the AV1 dependency descriptor header extension; it
+// is needed to find the layers of the AV1 packets.
+func (t *Track) SetDependencyDescriptorId(id uint8) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dependencyDescriptorId = id
+}
+
+// register the function that will be used to ask the publisher for a new
+// keyframe (e.g. by sending a PLI).
+func (t *Track) OnKeyframeRequest(callback func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onKeyframeRequest = callback
+}
+
+func (t *Track) RequestKeyframe() {
+	t.mu.RLock()
+	callback := t.onKeyframeRequest
+	t.mu.RUnlock()
+
+	if callback != nil && t.Kind() == webrtc.RTPCodecTypeVideo {
+		callback()
+	}
+}
+
+// the current generation of the track. The reader of a remote track should
+// stop once the track has been restarted with another remote track.
+func (t *Track) Generation() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.generation
+}
+
+// start reading from a new remote track (e.g. the publisher switched camera
+// or reconnected). The state of the previous stream is dropped and the
+// subscribers continue their stream from the next packet as if the packets
+// in between were never sent. Returns the new generation of the track.
+func (t *Track) Restart() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.generation++
+	t.clearCache()
+	t.av1Structure = av1Structure{}
+
+	// keep the timestamps of the subscribers streams in line with the time
+	// that passed since the latest packet
+	gap := uint32(0)
+	if !t.activity.LastPacket.IsZero() {
+		gap = uint32(time.Since(t.activity.LastPacket).Seconds() * float64(t.codec.ClockRate))
+	}
+
+	for _, downTrack := range t.downTracks {
+		downTrack.restart(gap)
+	}
+	for _, sink := range t.sinks {
+		sink.restart(gap, t.generation)
+	}
+	return t.generation
+}
+
+// stop forwarding the track (e.g. the publisher removed it). The reader of
+// the remote track stops and the cached packets are released; the down
+// tracks should be removed by their subscribers. The sinks are closed.
+func (t *Track) Close() {
+	t.mu.Lock()
+	t.generation++
+	t.clearCache()
+	sinks := t.sinks
+	t.sinks = nil
+	t.mu.Unlock()
+
+	for _, sink := range sinks {
+		sink.remove()
+		if err := sink.Close(); err != nil {
+			log.Printf("unable to close %s track %s sink: %s", t.Kind().String(), t.id, err)
+		}
+	}
+}
+
+func (t *Track) Activity() Activity {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.activity
+}
+
+// write the packet to all subscribers and sinks. A failing subscriber doesn't stop the
+// packet from being delivered to the rest of the subscribers; the returned
+// error joins all of the subscribers errors. The packet is retained by the
+// track (and its subscribers) as long as needed; the caller keeps its own
+// reference.
+func (t *Track) Write(packet *Packet) error {
+	t.mu.Lock()
+	t.activity.Packets++
+	t.activity.LastPacket = time.Now()
+	info := t.parseLayer(packet)
+	t.cache(packet, info)
+	sinks := t.sinks
+	generation := t.generation
+	t.mu.Unlock()
+
+	// the sinks are written without the track lock (e.g. a slow sink doesn't
+	// hold back the subscribers or the keyframe requests)
+	for _, sink := range sinks {
+		sink.write(packet, generation)
+	}
+
+	t.mu.RLock()
+	refs := newPacketRefs(packet, len(t.downTracks))
+	requestKeyframe := false
+	var errs []error
+	for _, downTrack := range t.downTracks {
+		keyframe, err := downTrack.writeRTP(packet, info, t.keyframeCache, &refs)
+		requestKeyframe = requestKeyframe || keyframe
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.mu.RUnlock()
+	refs.release()
+
+	if requestKeyframe {
+		t.RequestKeyframe()
+	}
+
+	return errors.Join(errs...)
+}
+
+// forward a sender report of the publisher to the sinks. `ntpTime` is the
+// 64 bits NTP timestamp of the report.
+func (t *Track) WriteSenderReport(ntpTime uint64, rtpTime uint32) {
+	t.mu.RLock()
+	sinks := t.sinks
+	t.mu.RUnlock()
+
+	// seconds since 1900 and the fraction of the second
+	seconds := int64(ntpTime>>32) - ntpEpochOffset
+	nanoseconds := int64((ntpTime & 0xFFFFFFFF) * 1e9 >> 32)
+	wallclock := time.Unix(seconds, nanoseconds)
+
+	for _, sink := range sinks {
+		sink.writeSenderReport(wallclock, rtpTime)
+	}
+}
+
+// keep the packets since the latest keyframe to be replayed to the new
+// subscribers.
+func (t *Track) cache(packet *Packet, info layerInfo) {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	// a keyframe might span more than one packet that are detected as
+	// keyframe start (e.g. h264 sps and idr); they share the same timestamp
+	if isKeyframe(t.video, packet.Payload, info) &&
+		(len(t.keyframeCache) == 0 || t.keyframeCache[0].packet.Timestamp != packet.Timestamp) {
+		t.clearCache()
+		t.activity.LastKeyframe = t.activity.LastPacket
+	} else if len(t.keyframeCache) == 0 {
+		// waiting for a keyframe
+		return
+	}
+
+	if len(t.keyframeCache) >= maxKeyframeCachePackets {
+		t.clearCache()
+		return
+	}
+
+	packet.Retain()
+	t.keyframeCache = append(t.keyframeCache, cachedPacket{packet: packet, info: info})
+}
+
+func (t *Track) clearCache() {
+	for i := range t.keyframeCache {
+		t.keyframeCache[i].packet.Release()
+		t.keyframeCache[i] = cachedPacket{}
+	}
+	t.keyframeCache = t.keyframeCache[:0]
+}
+
+// find the spatial and temporal layer of a packet of a scalable (VP9/AV1)
+// stream.
+func (t *Track) parseLayer(packet *Packet) layerInfo {
+	if !t.video.scalable() {
+		return layerInfo{}
+	}
+
+	var info layerInfo
+	var err error
+	if t.video == videoCodecVP9 {
+		info, err = parseVP9(packet.Payload)
+	} else if t.dependencyDescriptorId != 0 {
+		extension := packet.GetExtension(t.dependencyDescriptorId)
+		if extension == nil {
+			return layerInfo{}
+		}
+		info, err = parseAV1DependencyDescriptor(extension, &t.av1Structure)
+	}
+
+	if err != nil {
+		// forward the packet as is
+		return layerInfo{}
+	}
+	return info
+}
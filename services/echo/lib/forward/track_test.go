@@ -0,0 +1,44 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// the previous forwarding path: every packet is parsed into a newly allocated
+// rtp.Packet (as TrackRemote.ReadRTP does) and written to all subscribers by
+// a single webrtc.TrackLocalStaticRTP which marshals it for every subscriber.
+// Compare with BenchmarkForward and BenchmarkForwardWrite; run with -cpu 1 to
+// get the packets per second per core.
+func BenchmarkForwardTrackLocalStaticRTP(b *testing.B) {
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}
+	track, err := webrtc.NewTrackLocalStaticRTP(opus, "track", "stream")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for range 10 {
+		if _, err := track.Bind(&benchContext{id: "sub", writer: &benchWriter{}}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	raw := benchRawPacket(b, 160)
+	buf := make([]byte, mtu)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		n := copy(buf, raw)
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+			b.Fatal(err)
+		}
+		if err := track.WriteRTP(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
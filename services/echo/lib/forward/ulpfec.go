@@ -0,0 +1,194 @@
+package forward
+
+import (
+	"echo/lib/codecs"
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+const (
+	// size of the fixed part of the rtp header; the ulpfec packets protect
+	// everything after it
+	rtpFixedHeaderSize = 12
+	// ulpfec header with the level 0 header (short mask)
+	ulpfecHeaderSize = 10 + 4
+	// the short mask covers 16 consecutive packets
+	ulpfecMaskSize = 16
+)
+
+// ULPFECFactory creates the interceptors completing the ulpfec packets of
+// the streams sent to a member. A down track sending ulpfec wraps its media
+// in red and reserves the sequence numbers of the ulpfec packets with empty
+// placeholders (see DownTrack.writeULPFEC); the interceptor fills them in
+// right before they are sent. The ulpfec packets protect the packets as the
+// subscriber receives them, including the header extensions added by the
+// other interceptors (e.g. the transport wide sequence number), so the
+// interceptor must be the closest one to the network (after the network
+// simulation).
+type ULPFECFactory struct{}
+
+func (f *ULPFECFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &ulpfecInterceptor{}, nil
+}
+
+type ulpfecInterceptor struct {
+	interceptor.NoOp
+}
+
+func (i *ulpfecInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.EqualFold(info.MimeType, codecs.MimeTypeVideoRED) {
+		return writer
+	}
+
+	generator := &ulpfecGenerator{}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		// the media packets too large to be wrapped in red are sent with the
+		// media payload type and are not protected
+		if header.SSRC == info.SSRC && header.PayloadType == info.PayloadType {
+			payload = generator.process(header, payload)
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// the xor of the protected packets of an ulpfec packet (see RFC 5109).
+type ulpfecParity struct {
+	packets int
+	base    uint16
+	mask    uint16
+	// xor of the first two bytes of the rtp headers, of the timestamps and of
+	// the lengths (after the fixed header)
+	header    [2]byte
+	timestamp uint32
+	length    uint16
+	// xor of the packets after the fixed header
+	payload [mtu]byte
+	size    int
+}
+
+// add a packet to the parity; false in case the packet is too far from the
+// first one to be covered by the mask.
+func (p *ulpfecParity) add(packet []byte, sequenceNumber uint16) bool {
+	if p.packets == 0 {
+		p.base = sequenceNumber
+	}
+	offset := sequenceNumber - p.base
+	if offset >= ulpfecMaskSize {
+		return false
+	}
+
+	p.packets++
+	p.mask |= 0x8000 >> offset
+	p.header[0] ^= packet[0]
+	p.header[1] ^= packet[1]
+	p.timestamp ^= binary.BigEndian.Uint32(packet[4:])
+	p.length ^= uint16(len(packet) - rtpFixedHeaderSize)
+	for i, b := range packet[rtpFixedHeaderSize:] {
+		p.payload[i] ^= b
+	}
+	p.size = max(p.size, len(packet)-rtpFixedHeaderSize)
+	return true
+}
+
+// write the red encapsulated ulpfec packet of the parity to the buffer and
+// reset the parity. Returns the size of the packet.
+func (p *ulpfecParity) encode(buffer []byte, payloadType uint8) int {
+	buffer[0] = payloadType
+	fec := buffer[1:]
+	// the extension (E) and long mask (L) flags are not set
+	fec[0] = p.header[0] & 0x3F
+	fec[1] = p.header[1]
+	binary.BigEndian.PutUint16(fec[2:], p.base)
+	binary.BigEndian.PutUint32(fec[4:], p.timestamp)
+	binary.BigEndian.PutUint16(fec[8:], p.length)
+	binary.BigEndian.PutUint16(fec[10:], uint16(p.size))
+	binary.BigEndian.PutUint16(fec[12:], p.mask)
+	n := copy(fec[ulpfecHeaderSize:], p.payload[:p.size])
+
+	*p = ulpfecParity{}
+	return 1 + ulpfecHeaderSize + n
+}
+
+// generates the ulpfec packets of a stream of media wrapped in red. The media
+// packets of a group are protected by interleaved ulpfec packets: the first
+// ulpfec packet protects the first, third... media packets of the group and
+// the second one the others (see fecMediaPackets and fecRepairPackets).
+type ulpfecGenerator struct {
+	mu      sync.Mutex
+	started bool
+	lastSeq uint16
+	// media packets of the current group
+	packets  int
+	parities [fecRepairPackets]ulpfecParity
+	// ulpfec packets (placeholders) of the current group already sent
+	repairs int
+	scratch [mtu]byte
+	repair  [mtu]byte
+}
+
+// protect a media packet or complete a placeholder; returns the payload to
+// send.
+func (g *ulpfecGenerator) process(header *rtp.Header, payload []byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// the retransmissions sent on the media stream are not protected again
+	if g.started && int16(header.SequenceNumber-g.lastSeq) <= 0 {
+		return payload
+	}
+	g.started = true
+	g.lastSeq = header.SequenceNumber
+
+	// a placeholder only holds the red header with the ulpfec payload type
+	if len(payload) == 1 {
+		return g.complete(payload[0])
+	}
+	if len(payload) < 2 {
+		return payload
+	}
+
+	// a new group starts with the first media packet after the placeholders
+	if g.repairs > 0 {
+		g.packets = 0
+		g.repairs = 0
+		g.parities = [fecRepairPackets]ulpfecParity{}
+	}
+
+	// the subscriber recovers the media packet without the red header (with
+	// the media payload type)
+	size := header.MarshalSize()
+	if size+len(payload)-1 > len(g.scratch) {
+		return payload
+	}
+	if _, err := header.MarshalTo(g.scratch[:]); err != nil {
+		return payload
+	}
+	g.scratch[1] = g.scratch[1]&0x80 | payload[0]&0x7F
+	size += copy(g.scratch[size:], payload[1:])
+
+	parity := &g.parities[g.packets%fecRepairPackets]
+	if parity.add(g.scratch[:size], header.SequenceNumber) {
+		g.packets++
+	}
+	return payload
+}
+
+// fill the next placeholder of the group with its ulpfec packet.
+func (g *ulpfecGenerator) complete(payloadType byte) []byte {
+	if g.repairs >= fecRepairPackets {
+		return []byte{payloadType}
+	}
+
+	parity := &g.parities[g.repairs]
+	g.repairs++
+	if parity.packets == 0 {
+		// nothing to protect (e.g. the media packets were dropped)
+		return []byte{payloadType}
+	}
+	n := parity.encode(g.repair[:], payloadType)
+	return g.repair[:n]
+}
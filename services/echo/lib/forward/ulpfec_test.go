@@ -0,0 +1,203 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// recover a lost media packet from an ulpfec packet and the other packets it
+// protects (see RFC 5109 section 8).
+func recoverULPFEC(t *testing.T, fec []byte, received [][]byte) []byte {
+	t.Helper()
+
+	header := fec[:ulpfecHeaderSize]
+	length := binary.BigEndian.Uint16(header[8:])
+	recovered := make([]byte, rtpFixedHeaderSize+int(binary.BigEndian.Uint16(header[10:])))
+	recovered[0] = header[0]
+	recovered[1] = header[1]
+	timestamp := binary.BigEndian.Uint32(header[4:])
+	copy(recovered[rtpFixedHeaderSize:], fec[ulpfecHeaderSize:])
+
+	for _, packet := range received {
+		recovered[0] ^= packet[0]
+		recovered[1] ^= packet[1]
+		timestamp ^= binary.BigEndian.Uint32(packet[4:])
+		length ^= uint16(len(packet) - rtpFixedHeaderSize)
+		for i, b := range packet[rtpFixedHeaderSize:] {
+			recovered[rtpFixedHeaderSize+i] ^= b
+		}
+	}
+
+	// version 2
+	recovered[0] = recovered[0]&0x3F | 0x80
+	binary.BigEndian.PutUint32(recovered[4:], timestamp)
+	return recovered[:rtpFixedHeaderSize+int(length)]
+}
+
+func TestULPFECRecovery(t *testing.T) {
+	const (
+		redPayloadType    = 123
+		mediaPayloadType  = 96
+		ulpfecPayloadType = 125
+		ssrc              = 1234
+	)
+
+	tests := []struct {
+		name string
+		// index of the lost media packet in the group
+		lost int
+	}{
+		{name: "first packet of the first ulpfec packet", lost: 0},
+		{name: "middle packet of the first ulpfec packet", lost: 2},
+		{name: "last packet of the group", lost: 4},
+		{name: "first packet of the second ulpfec packet", lost: 1},
+		{name: "last packet of the second ulpfec packet", lost: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			generator := &ulpfecGenerator{}
+
+			// media packets of various sizes and headers as received by the
+			// subscriber (without red)
+			media := [][]byte{}
+			for i := range fecMediaPackets {
+				header := rtp.Header{
+					Version:        2,
+					PayloadType:    redPayloadType,
+					SequenceNumber: 65533 + uint16(i),
+					Timestamp:      3000 * uint32(i/2),
+					SSRC:           ssrc,
+					Marker:         i%2 == 1,
+				}
+				if err := header.SetExtension(1, []byte{byte(i), 0xAB, 0xCD}); err != nil {
+					t.Fatal(err)
+				}
+				payload := bytes.Repeat([]byte{byte(i + 1)}, 100+i*37)
+				red := append([]byte{mediaPayloadType}, payload...)
+				if sent := generator.process(&header, red); !bytes.Equal(sent, red) {
+					t.Fatal("the media packet has been modified")
+				}
+
+				header.PayloadType = mediaPayloadType
+				packet, err := (&rtp.Packet{Header: header, Payload: payload}).Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				media = append(media, packet)
+			}
+
+			repairs := [][]byte{}
+			for i := range fecRepairPackets {
+				header := rtp.Header{
+					Version:        2,
+					PayloadType:    redPayloadType,
+					SequenceNumber: uint16(65533 + fecMediaPackets + i),
+					SSRC:           ssrc,
+				}
+				repair := generator.process(&header, []byte{ulpfecPayloadType})
+				if repair[0] != ulpfecPayloadType {
+					t.Fatalf("unexpected red header %d", repair[0])
+				}
+				repairs = append(repairs, append([]byte(nil), repair[1:]...))
+			}
+
+			// the lost packet is protected by the ulpfec packet of its parity
+			fec := repairs[test.lost%fecRepairPackets]
+			received := [][]byte{}
+			for i := test.lost % fecRepairPackets; i < fecMediaPackets; i += fecRepairPackets {
+				if i != test.lost {
+					received = append(received, media[i])
+				}
+			}
+
+			base := binary.BigEndian.Uint16(fec[2:])
+			mask := binary.BigEndian.Uint16(fec[12:])
+			sequenceNumber := uint16(65533 + test.lost)
+			if mask&(0x8000>>(sequenceNumber-base)) == 0 {
+				t.Fatalf("the lost packet is not covered by the mask %016b", mask)
+			}
+
+			recovered := recoverULPFEC(t, fec, received)
+			binary.BigEndian.PutUint16(recovered[2:], sequenceNumber)
+			binary.BigEndian.PutUint32(recovered[8:], ssrc)
+			if !bytes.Equal(recovered, media[test.lost]) {
+				t.Fatalf("recovered %x, expected %x", recovered, media[test.lost])
+			}
+		})
+	}
+}
+
+func TestWriteULPFECOversizedPayload(t *testing.T) {
+	const (
+		redPayloadType    = 123
+		mediaPayloadType  = 96
+		ulpfecPayloadType = 125
+	)
+
+	queue := NewQueue(64, 0)
+	defer queue.Close()
+	downTrack := &DownTrack{
+		mu:             &queue.mu,
+		queue:          queue,
+		payloadType:    redPayloadType,
+		redPayloadType: mediaPayloadType,
+		ulpfecHeader:   []byte{ulpfecPayloadType},
+	}
+
+	sizes := []int{100, mtu, 100, mtu - 1, 100}
+	for i, size := range sizes {
+		packet := NewPacket()
+		payload := packet.Buffer()[:size]
+		header := rtp.Header{
+			Version:        2,
+			PayloadType:    redPayloadType,
+			SequenceNumber: downTrack.munger.lastSeq + 1,
+			SSRC:           1234,
+		}
+		downTrack.munger.lastSeq++
+		refs := newPacketRefs(packet, 1)
+		downTrack.mu.Lock()
+		downTrack.writeULPFEC(header, payload, packet, &refs, priorityCamera)
+		downTrack.mu.Unlock()
+		refs.release()
+		packet.Release()
+
+		if i < len(sizes)-1 && downTrack.ulpfecPackets != i+1 {
+			t.Fatalf("%d media packets counted, expected %d", downTrack.ulpfecPackets, i+1)
+		}
+	}
+
+	if queue.Len() != fecMediaPackets+fecRepairPackets {
+		t.Fatalf("%d packets queued, expected %d", queue.Len(), fecMediaPackets+fecRepairPackets)
+	}
+
+	var lastSeq uint16
+	for i := range fecMediaPackets + fecRepairPackets {
+		sent, _ := popTestPacket(queue)
+		if i > 0 && sent.header.SequenceNumber != lastSeq+1 {
+			t.Fatalf("packet %d: sequence number %d follows %d", i, sent.header.SequenceNumber, lastSeq)
+		}
+		lastSeq = sent.header.SequenceNumber
+
+		switch {
+		case i >= fecMediaPackets:
+			if sent.header.PayloadType != redPayloadType || !bytes.Equal(sent.payload, []byte{ulpfecPayloadType}) {
+				t.Fatalf("packet %d: expected an ulpfec placeholder", i)
+			}
+		case sizes[i] == mtu:
+			// too large to be wrapped in red
+			if sent.header.PayloadType != mediaPayloadType || len(sent.payload) != mtu {
+				t.Fatalf("packet %d: expected the unwrapped media packet", i)
+			}
+		default:
+			if sent.header.PayloadType != redPayloadType || sent.payload[0] != mediaPayloadType || len(sent.payload) != sizes[i]+1 {
+				t.Fatalf("packet %d: expected the media packet wrapped in red", i)
+			}
+		}
+		sent.release()
+	}
+}
@@ -0,0 +1,162 @@
+package netsim
+
+import (
+	"echo/lib/utils"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// Factory creates the network simulation interceptor of a peer connection.
+// It should be the first interceptor added to the registry so that it is the
+// closest one to the network.
+type Factory struct {
+	config Config
+}
+
+func NewFactory(config Config) *Factory {
+	return &Factory{config: config}
+}
+
+func (f *Factory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &Interceptor{
+		inbound:  newLink(f.config.Inbound),
+		outbound: newLink(f.config.Outbound),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// Interceptor applies the simulated network conditions to the RTP packets
+// sent (outbound) and received (inbound) by a peer connection. RTCP packets
+// are not affected.
+type Interceptor struct {
+	interceptor.NoOp
+	inbound   *link
+	outbound  *link
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (i *Interceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if i.outbound == nil {
+		return writer
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		size := header.MarshalSize() + len(payload)
+		delay, ok := i.outbound.schedule(size)
+		if !ok {
+			// lost on the way
+			return size, nil
+		}
+
+		if delay == 0 {
+			return writer.Write(header, payload, attributes)
+		}
+
+		// the header and the payload are owned by the caller
+		delayedHeader := header.Clone()
+		delayedPayload := append([]byte(nil), payload...)
+		time.AfterFunc(delay, func() {
+			select {
+			case <-i.closed:
+			default:
+				writer.Write(&delayedHeader, delayedPayload, attributes)
+			}
+		})
+		return size, nil
+	})
+}
+
+func (i *Interceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	if i.inbound == nil {
+		return reader
+	}
+
+	stream := &inboundStream{
+		interceptor: i,
+		reader:      reader,
+		packets:     make(chan inboundPacket, 1024),
+	}
+	return interceptor.RTPReaderFunc(stream.read)
+}
+
+func (i *Interceptor) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.closed)
+	})
+	return nil
+}
+
+type inboundPacket struct {
+	data       []byte
+	attributes interceptor.Attributes
+	err        error
+}
+
+// a received stream. The packets are read from the network by a goroutine
+// and delivered to the reader after their simulated delay.
+type inboundStream struct {
+	interceptor *Interceptor
+	reader      interceptor.RTPReader
+	start       sync.Once
+	packets     chan inboundPacket
+}
+
+func (s *inboundStream) read(b []byte, _ interceptor.Attributes) (int, interceptor.Attributes, error) {
+	s.start.Do(func() {
+		go func() {
+			utils.IncreaseThread()
+			defer utils.DecreaseThread()
+			s.receive()
+		}()
+	})
+
+	select {
+	case packet := <-s.packets:
+		if packet.err != nil {
+			return 0, nil, packet.err
+		}
+		if len(b) < len(packet.data) {
+			return 0, nil, io.ErrShortBuffer
+		}
+		return copy(b, packet.data), packet.attributes, nil
+	case <-s.interceptor.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (s *inboundStream) receive() {
+	for {
+		buf := make([]byte, 1500)
+		n, attributes, err := s.reader.Read(buf, nil)
+		if err != nil {
+			s.deliver(inboundPacket{err: err})
+			return
+		}
+
+		delay, ok := s.interceptor.inbound.schedule(n)
+		if !ok {
+			continue
+		}
+
+		packet := inboundPacket{data: buf[:n], attributes: attributes}
+		if delay == 0 {
+			s.deliver(packet)
+			continue
+		}
+		time.AfterFunc(delay, func() {
+			s.deliver(packet)
+		})
+	}
+}
+
+func (s *inboundStream) deliver(packet inboundPacket) {
+	select {
+	case s.packets <- packet:
+	case <-s.interceptor.closed:
+	}
+}
@@ -0,0 +1,138 @@
+// Package netsim simulates poor network conditions (loss, burst loss,
+// jitter, reordering and bandwidth caps) on the RTP packets of a peer
+// connection. It is meant to reproduce network related issues while testing
+// and should never be enabled in production.
+package netsim
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Link describes the simulated conditions of one direction of a connection.
+type Link struct {
+	// probability (0-1) of losing a packet
+	Loss float64 `json:"loss"`
+	// probability (0-1) of starting a burst of lost packets
+	BurstLoss float64 `json:"burstLoss"`
+	// average number of packets lost in a burst
+	BurstLength int `json:"burstLength"`
+	// maximum random delay (milliseconds) added to a packet
+	Jitter int `json:"jitter"`
+	// probability (0-1) of delivering a packet after the following ones
+	Reorder float64 `json:"reorder"`
+	// bandwidth cap (bits per second); zero disables the cap
+	Bitrate int `json:"bitrate"`
+}
+
+// Config is the simulated network of a peer connection.
+type Config struct {
+	// conditions of the packets received by the server
+	Inbound *Link `json:"inbound,omitempty"`
+	// conditions of the packets sent by the server
+	Outbound *Link `json:"outbound,omitempty"`
+}
+
+var ErrInvalidConfig = errors.New("invalid network simulation config")
+
+func (c Config) Validate() error {
+	for _, link := range []*Link{c.Inbound, c.Outbound} {
+		if link == nil {
+			continue
+		}
+
+		for _, probability := range []float64{link.Loss, link.BurstLoss, link.Reorder} {
+			if probability < 0 || probability > 1 {
+				return ErrInvalidConfig
+			}
+		}
+
+		if link.BurstLength < 0 || link.Jitter < 0 || link.Bitrate < 0 {
+			return ErrInvalidConfig
+		}
+	}
+	return nil
+}
+
+const (
+	// packets waiting longer than this for the capped bandwidth are dropped
+	// (the buffer of the bottleneck is full)
+	maxQueueDelay = time.Second
+	// delay of a reordered packet when there is no jitter
+	reorderDelay = 20 * time.Millisecond
+)
+
+// the state of a simulated link.
+type link struct {
+	mu       sync.Mutex
+	config   Link
+	random   *rand.Rand
+	bursting bool
+	// departure time of the latest packet sent through the capped bandwidth
+	next time.Time
+}
+
+func newLink(config *Link) *link {
+	if config == nil {
+		return nil
+	}
+
+	return &link{
+		config: *config,
+		random: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+	}
+}
+
+// decide what happens to a packet of `size` bytes. Returns the delay before
+// the packet reaches the other side, or false in case the packet is lost.
+func (l *link) schedule(size int) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	config := l.config
+	if l.bursting {
+		// the burst ends with a probability that gives the average length
+		if l.random.Float64() < 1/float64(max(config.BurstLength, 1)) {
+			l.bursting = false
+		}
+		return 0, false
+	}
+
+	if l.random.Float64() < config.BurstLoss {
+		l.bursting = config.BurstLength > 1
+		return 0, false
+	}
+
+	if l.random.Float64() < config.Loss {
+		return 0, false
+	}
+
+	delay := time.Duration(0)
+	if config.Bitrate > 0 {
+		now := time.Now()
+		departure := now
+		if l.next.After(now) {
+			departure = l.next
+		}
+
+		if departure.Sub(now) > maxQueueDelay {
+			return 0, false
+		}
+
+		l.next = departure.Add(time.Duration(float64(size*8) / float64(config.Bitrate) * float64(time.Second)))
+		delay = departure.Sub(now)
+	}
+
+	jitter := time.Duration(config.Jitter) * time.Millisecond
+	if jitter > 0 {
+		delay += time.Duration(l.random.Int64N(int64(jitter) + 1))
+	}
+
+	if l.random.Float64() < config.Reorder {
+		delay += max(jitter, reorderDelay)
+	}
+
+	return delay, true
+}
@@ -0,0 +1,138 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRecordingNotFound = errors.New("recording not found")
+	ErrFileNotFound      = errors.New("file not found")
+)
+
+// the recordings are identified (within their session) by their start time
+const idFormat = "20060102T150405Z"
+
+// Summary of a recording of a session.
+type Summary struct {
+	Id    string     `json:"id"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+	Files int        `json:"files"`
+	// size of the media files
+	Size int64 `json:"size"`
+}
+
+// directories of the recordings being written (or uploaded) by this
+// process; they are never deleted by the retention policy.
+var openRecordings = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+func setOpen(dir string, open bool) {
+	openRecordings.Lock()
+	defer openRecordings.Unlock()
+
+	if open {
+		openRecordings.dirs[dir] = true
+	} else {
+		delete(openRecordings.dirs, dir)
+	}
+}
+
+func isOpen(dir string) bool {
+	openRecordings.Lock()
+	defer openRecordings.Unlock()
+	return openRecordings.dirs[dir]
+}
+
+func validId(id string) bool {
+	_, err := time.Parse(idFormat, id)
+	return err == nil
+}
+
+func readManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// the recordings of the session in the directory, oldest first.
+func ListRecordings(dir string, session string) ([]Summary, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, fileName(session)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Summary{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the entries are sorted by name (the start time)
+	summaries := []Summary{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validId(entry.Name()) {
+			continue
+		}
+
+		manifest, err := readManifest(filepath.Join(dir, fileName(session), entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		summary := Summary{Id: entry.Name(), Start: manifest.Start, End: manifest.End, Files: len(manifest.Files)}
+		for _, file := range manifest.Files {
+			summary.Size += file.Size
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// the manifest of a recording of the session.
+func ReadManifest(dir string, session string, id string) (Manifest, error) {
+	if !validId(id) {
+		return Manifest{}, ErrRecordingNotFound
+	}
+
+	manifest, err := readManifest(filepath.Join(dir, fileName(session), id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return manifest, ErrRecordingNotFound
+	}
+	return manifest, err
+}
+
+// open a file (listed in the manifest) of a recording. The uploaded files
+// are read from the storage. The content is limited to the byte range (the
+// value of a Range header) unless empty.
+func OpenFile(ctx context.Context, dir string, storage Storage, session string, id string, file string, byteRange string) (Object, error) {
+	manifest, err := ReadManifest(dir, session, id)
+	if err != nil {
+		return Object{}, err
+	}
+
+	index := slices.IndexFunc(manifest.Files, func(f ManifestFile) bool {
+		return f.Path == file
+	})
+	if index < 0 {
+		return Object{}, ErrFileNotFound
+	}
+
+	key := path.Join(fileName(session), id, file)
+	if manifest.Files[index].Upload == UploadUploaded && storage != nil {
+		return storage.Get(ctx, key, byteRange)
+	}
+	return LocalStorage{Directory: dir}.Get(ctx, key, byteRange)
+}
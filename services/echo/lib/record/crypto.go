@@ -0,0 +1,267 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// name of the sidecar file holding the wrapped data key of a recording
+	KeyName = "key.json"
+	// suffix of the encrypted files
+	EncryptedSuffix = ".enc"
+	// size of the plaintext of every chunk but the last one
+	encryptionChunkSize = 64 << 10
+	// largest chunk size accepted when decrypting
+	maxEncryptionChunkSize = 16 << 20
+	// magic of the encrypted files
+	encryptionMagic = "ECHOENC1"
+	// length of the random prefix of the chunk nonces
+	noncePrefixSize = 7
+	// additional data of the wrapped data keys
+	keyWrapData = "echo recording data key"
+)
+
+var (
+	ErrInvalidMasterKey = errors.New("the master key should be 32 bytes encoded in base64")
+	ErrWrongMasterKey   = errors.New("the data key is wrapped with another master key")
+	ErrCorruptedFile    = errors.New("corrupted or truncated encrypted file")
+)
+
+// Sidecar is the content of the key file written next to the manifest of an
+// encrypted recording.
+type Sidecar struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+	// identifies the master key the data key is wrapped with
+	MasterKeyId string `json:"masterKeyId"`
+	// nonce and ciphertext (AES-256-GCM) of the data key
+	WrappedKey string `json:"wrappedKey"`
+}
+
+// decode a master key (32 bytes encoded in base64).
+func ParseMasterKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidMasterKey
+	}
+	return key, nil
+}
+
+func masterKeyId(master []byte) string {
+	hash := sha256.Sum256(master)
+	return hex.EncodeToString(hash[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryption encrypts the files of a recording with its data key.
+type encryption struct {
+	key []byte
+}
+
+// create a data key for a recording and write it (wrapped with the master
+// key) to the sidecar file of the recording directory.
+func newEncryption(master []byte, dir string) (*encryption, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped := gcm.Seal(nonce, nonce, key, []byte(keyWrapData))
+
+	data, err := json.MarshalIndent(Sidecar{
+		Version:     1,
+		Algorithm:   "AES-256-GCM",
+		MasterKeyId: masterKeyId(master),
+		WrappedKey:  base64.StdEncoding.EncodeToString(wrapped),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, KeyName)
+	if err := os.WriteFile(path+partialSuffix, data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := commitFile(path+partialSuffix, path); err != nil {
+		return nil, err
+	}
+	return &encryption{key: key}, nil
+}
+
+// read the data key of a recording from its sidecar file.
+func ReadDataKey(master []byte, path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sidecar Sidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, err
+	}
+	if sidecar.MasterKeyId != masterKeyId(master) {
+		return nil, ErrWrongMasterKey
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(sidecar.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, ErrCorruptedFile
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte(keyWrapData))
+}
+
+// encrypt a file to another file.
+func (e *encryption) encryptFile(source string, destination string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	err = Encrypt(dst, src, e.key)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Encrypt the content of the reader in chunks (AES-256-GCM) so that the
+// files can be decrypted as they are streamed. The file starts with a header
+// (the magic, the chunk size and the random prefix of the nonces) which is
+// authenticated along with every chunk. The nonce of a chunk is made of the
+// prefix, the chunk index and whether it is the last chunk; the chunks
+// cannot be reordered and a truncated file is detected.
+func Encrypt(dst io.Writer, src io.Reader, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, len(encryptionMagic)+4+noncePrefixSize)
+	header = append(header, encryptionMagic...)
+	header = binary.BigEndian.AppendUint32(header, encryptionChunkSize)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(src, encryptionChunkSize)
+	chunk := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+gcm.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := reader.Peek(1)
+		last := n < encryptionChunkSize || peekErr == io.EOF
+
+		sealed = gcm.Seal(sealed[:0], chunkNonce(prefix, index, last), chunk[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypt the content of a file encrypted with Encrypt.
+func Decrypt(dst io.Writer, src io.Reader, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, len(encryptionMagic)+4+noncePrefixSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return ErrCorruptedFile
+	}
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return fmt.Errorf("%w: not an encrypted recording", ErrCorruptedFile)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(encryptionMagic):]))
+	if chunkSize == 0 || chunkSize > maxEncryptionChunkSize {
+		return ErrCorruptedFile
+	}
+	prefix := header[len(encryptionMagic)+4:]
+
+	reader := bufio.NewReaderSize(src, chunkSize+gcm.Overhead())
+	chunk := make([]byte, chunkSize+gcm.Overhead())
+	opened := make([]byte, 0, chunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return ErrCorruptedFile
+		}
+		_, peekErr := reader.Peek(1)
+		last := n < len(chunk) || peekErr == io.EOF
+
+		opened, err = gcm.Open(opened[:0], chunkNonce(prefix, index, last), chunk[:n], header)
+		if err != nil {
+			return ErrCorruptedFile
+		}
+		if _, err := dst.Write(opened); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := binary.BigEndian.AppendUint32(append([]byte(nil), prefix...), index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
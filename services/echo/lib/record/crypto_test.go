@@ -0,0 +1,146 @@
+package record
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+const (
+	// size of the header of the encrypted files
+	testEncryptionHeaderSize = len(encryptionMagic) + 4 + noncePrefixSize
+	// size of an encrypted chunk (but the last one)
+	testSealedChunkSize = encryptionChunkSize + 16
+)
+
+func testEncryptionKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "single byte", size: 1},
+		{name: "shorter than a chunk", size: encryptionChunkSize - 1},
+		{name: "one chunk", size: encryptionChunkSize},
+		{name: "longer than a chunk", size: encryptionChunkSize + 1},
+		{name: "two chunks", size: 2 * encryptionChunkSize},
+		{name: "several chunks", size: 3*encryptionChunkSize + 123},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := testEncryptionKey(t)
+			plaintext := make([]byte, test.size)
+			rand.Read(plaintext)
+
+			var encrypted bytes.Buffer
+			if err := Encrypt(&encrypted, bytes.NewReader(plaintext), key); err != nil {
+				t.Fatal(err)
+			}
+			chunks := max((test.size+encryptionChunkSize-1)/encryptionChunkSize, 1)
+			if expected := testEncryptionHeaderSize + test.size + chunks*16; encrypted.Len() != expected {
+				t.Fatalf("encrypted size %d, expected %d", encrypted.Len(), expected)
+			}
+
+			var decrypted bytes.Buffer
+			if err := Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), key); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Fatal("the decrypted content differs from the plaintext")
+			}
+		})
+	}
+}
+
+func TestDecryptCorrupted(t *testing.T) {
+	key := testEncryptionKey(t)
+	plaintext := make([]byte, 3*encryptionChunkSize+100)
+	rand.Read(plaintext)
+	var buffer bytes.Buffer
+	if err := Encrypt(&buffer, bytes.NewReader(plaintext), key); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := buffer.Bytes()
+
+	// the offset of an encrypted chunk
+	chunk := func(index int) int {
+		return testEncryptionHeaderSize + index*testSealedChunkSize
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		corrupt func(data []byte) []byte
+	}{
+		{name: "header only", corrupt: func(data []byte) []byte {
+			return data[:testEncryptionHeaderSize]
+		}},
+		{name: "truncated header", corrupt: func(data []byte) []byte {
+			return data[:testEncryptionHeaderSize-1]
+		}},
+		{name: "truncated at a chunk boundary", corrupt: func(data []byte) []byte {
+			return data[:chunk(3)]
+		}},
+		{name: "truncated within a chunk", corrupt: func(data []byte) []byte {
+			return data[:chunk(2)+100]
+		}},
+		{name: "truncated last chunk", corrupt: func(data []byte) []byte {
+			return data[:len(data)-1]
+		}},
+		{name: "reordered chunks", corrupt: func(data []byte) []byte {
+			reordered := append([]byte(nil), data[:chunk(0)]...)
+			reordered = append(reordered, data[chunk(1):chunk(2)]...)
+			reordered = append(reordered, data[chunk(0):chunk(1)]...)
+			return append(reordered, data[chunk(2):]...)
+		}},
+		{name: "dropped chunk", corrupt: func(data []byte) []byte {
+			dropped := append([]byte(nil), data[:chunk(1)]...)
+			return append(dropped, data[chunk(2):]...)
+		}},
+		{name: "modified chunk", corrupt: func(data []byte) []byte {
+			data[chunk(1)+10] ^= 1
+			return data
+		}},
+		{name: "modified header", corrupt: func(data []byte) []byte {
+			data[testEncryptionHeaderSize-1] ^= 1
+			return data
+		}},
+		{name: "modified chunk size", corrupt: func(data []byte) []byte {
+			data[len(encryptionMagic)+3] ^= 1
+			return data
+		}},
+		{name: "not encrypted", corrupt: func(data []byte) []byte {
+			return plaintext
+		}},
+		{name: "wrong key", key: testEncryptionKey(t), corrupt: func(data []byte) []byte {
+			return data
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.corrupt(append([]byte(nil), encrypted...))
+			decryptionKey := key
+			if test.key != nil {
+				decryptionKey = test.key
+			}
+
+			var decrypted bytes.Buffer
+			err := Decrypt(&decrypted, bytes.NewReader(data), decryptionKey)
+			if !errors.Is(err, ErrCorruptedFile) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// sample flags of the keyframes (depends on no other sample) and of the
+	// other frames (depends on other samples, not a sync sample)
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+	// the offsets of the track fragments are relative to the moof box
+	tfhdDefaultBaseIsMoof = 0x020000
+	// the track runs carry the data offset and the duration, size and flags
+	// of every sample
+	trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400
+	// iso 639-2 "und" packed in 15 bits
+	languageUndetermined = 0x55C4
+)
+
+// a track of a fragmented mp4 stream.
+type mp4Track struct {
+	id        uint32
+	video     bool
+	timescale uint32
+	// video only
+	width  int
+	height int
+	// audio only
+	channels   int
+	sampleRate int
+}
+
+// a frame of a track fragment.
+type mp4Sample struct {
+	data     []byte
+	duration uint32
+	keyframe bool
+}
+
+// the samples of a track in a fragment along with the decode time (in the
+// track timescale) of the first sample.
+type mp4TrackFragment struct {
+	track      uint32
+	decodeTime uint64
+	samples    []mp4Sample
+}
+
+// the init segment (ftyp and moov) of a fragmented mp4 stream of vp8 and
+// opus tracks. The sample tables are empty; the samples are in the
+// fragments (see mp4Fragment).
+func mp4InitSegment(tracks []mp4Track) []byte {
+	var b bytes.Buffer
+	writeBox(&b, "ftyp", func(b *bytes.Buffer) {
+		b.WriteString("iso6")
+		putUint32(b, 0)
+		b.WriteString("iso6mp41")
+	})
+
+	writeBox(&b, "moov", func(b *bytes.Buffer) {
+		writeFullBox(b, "mvhd", 0, 0, func(b *bytes.Buffer) {
+			putUint32(b, 0) // creation time
+			putUint32(b, 0) // modification time
+			putUint32(b, 1000)
+			putUint32(b, 0) // duration
+			putUint32(b, 0x00010000)
+			putUint16(b, 0x0100)
+			b.Write(make([]byte, 10))
+			writeMatrix(b)
+			b.Write(make([]byte, 24))
+			putUint32(b, uint32(len(tracks)+1))
+		})
+		for _, track := range tracks {
+			writeTrak(b, track)
+		}
+		writeBox(b, "mvex", func(b *bytes.Buffer) {
+			for _, track := range tracks {
+				writeFullBox(b, "trex", 0, 0, func(b *bytes.Buffer) {
+					putUint32(b, track.id)
+					putUint32(b, 1) // sample description index
+					putUint32(b, 0)
+					putUint32(b, 0)
+					putUint32(b, 0)
+				})
+			}
+		})
+	})
+	return b.Bytes()
+}
+
+func writeTrak(b *bytes.Buffer, track mp4Track) {
+	writeBox(b, "trak", func(b *bytes.Buffer) {
+		// enabled and in movie
+		writeFullBox(b, "tkhd", 0, 3, func(b *bytes.Buffer) {
+			putUint32(b, 0) // creation time
+			putUint32(b, 0) // modification time
+			putUint32(b, track.id)
+			putUint32(b, 0)
+			putUint32(b, 0) // duration
+			b.Write(make([]byte, 8))
+			putUint16(b, 0) // layer
+			putUint16(b, 0) // alternate group
+			if track.video {
+				putUint16(b, 0)
+			} else {
+				putUint16(b, 0x0100)
+			}
+			putUint16(b, 0)
+			writeMatrix(b)
+			putUint32(b, uint32(track.width)<<16)
+			putUint32(b, uint32(track.height)<<16)
+		})
+
+		writeBox(b, "mdia", func(b *bytes.Buffer) {
+			writeFullBox(b, "mdhd", 0, 0, func(b *bytes.Buffer) {
+				putUint32(b, 0) // creation time
+				putUint32(b, 0) // modification time
+				putUint32(b, track.timescale)
+				putUint32(b, 0) // duration
+				putUint16(b, languageUndetermined)
+				putUint16(b, 0)
+			})
+
+			handler, name := "soun", "SoundHandler"
+			if track.video {
+				handler, name = "vide", "VideoHandler"
+			}
+			writeFullBox(b, "hdlr", 0, 0, func(b *bytes.Buffer) {
+				putUint32(b, 0)
+				b.WriteString(handler)
+				b.Write(make([]byte, 12))
+				b.WriteString(name)
+				b.WriteByte(0)
+			})
+
+			writeBox(b, "minf", func(b *bytes.Buffer) {
+				if track.video {
+					writeFullBox(b, "vmhd", 0, 1, func(b *bytes.Buffer) {
+						b.Write(make([]byte, 8))
+					})
+				} else {
+					writeFullBox(b, "smhd", 0, 0, func(b *bytes.Buffer) {
+						b.Write(make([]byte, 4))
+					})
+				}
+
+				// the samples are in the same file
+				writeBox(b, "dinf", func(b *bytes.Buffer) {
+					writeFullBox(b, "dref", 0, 0, func(b *bytes.Buffer) {
+						putUint32(b, 1)
+						writeFullBox(b, "url ", 0, 1, func(b *bytes.Buffer) {})
+					})
+				})
+
+				writeBox(b, "stbl", func(b *bytes.Buffer) {
+					writeFullBox(b, "stsd", 0, 0, func(b *bytes.Buffer) {
+						putUint32(b, 1)
+						if track.video {
+							writeVP8SampleEntry(b, track)
+						} else {
+							writeOpusSampleEntry(b, track)
+						}
+					})
+					for _, table := range []string{"stts", "stsc", "stco"} {
+						writeFullBox(b, table, 0, 0, func(b *bytes.Buffer) {
+							putUint32(b, 0)
+						})
+					}
+					writeFullBox(b, "stsz", 0, 0, func(b *bytes.Buffer) {
+						putUint32(b, 0)
+						putUint32(b, 0)
+					})
+				})
+			})
+		})
+	})
+}
+
+// the vp8 sample entry and its configuration (vp codec iso media file format
+// binding).
+func writeVP8SampleEntry(b *bytes.Buffer, track mp4Track) {
+	writeBox(b, "vp08", func(b *bytes.Buffer) {
+		b.Write(make([]byte, 6))
+		putUint16(b, 1) // data reference index
+		b.Write(make([]byte, 16))
+		putUint16(b, uint16(track.width))
+		putUint16(b, uint16(track.height))
+		// 72 dpi
+		putUint32(b, 0x00480000)
+		putUint32(b, 0x00480000)
+		putUint32(b, 0)
+		putUint16(b, 1) // frame count
+		b.Write(make([]byte, 32))
+		putUint16(b, 0x0018) // depth
+		putUint16(b, 0xFFFF)
+
+		writeFullBox(b, "vpcC", 1, 0, func(b *bytes.Buffer) {
+			b.WriteByte(0)  // profile
+			b.WriteByte(10) // level
+			// 8 bits, 4:2:0 colocated with luma, limited range
+			b.WriteByte(8<<4 | 1<<1)
+			// bt.709 primaries, transfer and matrix
+			b.Write([]byte{1, 1, 1})
+			putUint16(b, 0)
+		})
+	})
+}
+
+// the opus sample entry and its configuration (encapsulation of opus in iso
+// base media file format).
+func writeOpusSampleEntry(b *bytes.Buffer, track mp4Track) {
+	writeBox(b, "Opus", func(b *bytes.Buffer) {
+		b.Write(make([]byte, 6))
+		putUint16(b, 1) // data reference index
+		b.Write(make([]byte, 8))
+		putUint16(b, uint16(track.channels))
+		putUint16(b, 16) // sample size
+		putUint32(b, 0)
+		putUint32(b, 48000<<16)
+
+		writeBox(b, "dOps", func(b *bytes.Buffer) {
+			b.WriteByte(0)
+			b.WriteByte(byte(track.channels))
+			putUint16(b, opusPreSkip)
+			putUint32(b, uint32(track.sampleRate))
+			putUint16(b, 0) // output gain
+			b.WriteByte(0)  // channel mapping family
+		})
+	})
+}
+
+// a media segment (moof and mdat) with the samples of the tracks.
+func mp4Fragment(sequence uint32, fragments []mp4TrackFragment) []byte {
+	// the data offsets depend on the size of the moof box which doesn't
+	// depend on the offsets
+	offsets := make([]uint32, len(fragments))
+	size := len(mp4MovieFragment(sequence, fragments, offsets))
+
+	data := 0
+	for i, fragment := range fragments {
+		offsets[i] = uint32(size + 8 + data)
+		for _, sample := range fragment.samples {
+			data += len(sample.data)
+		}
+	}
+
+	b := bytes.NewBuffer(mp4MovieFragment(sequence, fragments, offsets))
+	putUint32(b, uint32(8+data))
+	b.WriteString("mdat")
+	for _, fragment := range fragments {
+		for _, sample := range fragment.samples {
+			b.Write(sample.data)
+		}
+	}
+	return b.Bytes()
+}
+
+func mp4MovieFragment(sequence uint32, fragments []mp4TrackFragment, offsets []uint32) []byte {
+	var b bytes.Buffer
+	writeBox(&b, "moof", func(b *bytes.Buffer) {
+		writeFullBox(b, "mfhd", 0, 0, func(b *bytes.Buffer) {
+			putUint32(b, sequence)
+		})
+
+		for i, fragment := range fragments {
+			writeBox(b, "traf", func(b *bytes.Buffer) {
+				writeFullBox(b, "tfhd", 0, tfhdDefaultBaseIsMoof, func(b *bytes.Buffer) {
+					putUint32(b, fragment.track)
+				})
+				writeFullBox(b, "tfdt", 1, 0, func(b *bytes.Buffer) {
+					putUint64(b, fragment.decodeTime)
+				})
+				writeFullBox(b, "trun", 0, trunFlags, func(b *bytes.Buffer) {
+					putUint32(b, uint32(len(fragment.samples)))
+					putUint32(b, offsets[i])
+					for _, sample := range fragment.samples {
+						putUint32(b, sample.duration)
+						putUint32(b, uint32(len(sample.data)))
+						if sample.keyframe {
+							putUint32(b, sampleFlagsSync)
+						} else {
+							putUint32(b, sampleFlagsNonSync)
+						}
+					}
+				})
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+func writeBox(b *bytes.Buffer, boxType string, children func(b *bytes.Buffer)) {
+	var content bytes.Buffer
+	children(&content)
+	putUint32(b, uint32(8+content.Len()))
+	b.WriteString(boxType)
+	b.Write(content.Bytes())
+}
+
+func writeFullBox(b *bytes.Buffer, boxType string, version byte, flags uint32, children func(b *bytes.Buffer)) {
+	writeBox(b, boxType, func(b *bytes.Buffer) {
+		putUint32(b, uint32(version)<<24|flags)
+		children(b)
+	})
+}
+
+// the identity transformation matrix of the movie and track headers.
+func writeMatrix(b *bytes.Buffer) {
+	for _, value := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		putUint32(b, value)
+	}
+}
+
+func putUint16(b *bytes.Buffer, value uint16) {
+	b.Write(binary.BigEndian.AppendUint16(nil, value))
+}
+
+func putUint32(b *bytes.Buffer, value uint32) {
+	b.Write(binary.BigEndian.AppendUint32(nil, value))
+}
+
+func putUint64(b *bytes.Buffer, value uint64) {
+	b.Write(binary.BigEndian.AppendUint64(nil, value))
+}
@@ -0,0 +1,245 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// a box of a parsed mp4 file. The offsets are in the file.
+type mp4Box struct {
+	boxType  string
+	offset   int64
+	size     int64
+	children []mp4Box
+}
+
+// the content of the box (after the header).
+func (b mp4Box) data(file []byte) []byte {
+	return file[b.offset+8 : b.offset+b.size]
+}
+
+func (b mp4Box) child(t *testing.T, boxType string) mp4Box {
+	t.Helper()
+	for _, child := range b.children {
+		if child.boxType == boxType {
+			return child
+		}
+	}
+	t.Fatalf("box %s has no child %s", b.boxType, boxType)
+	return mp4Box{}
+}
+
+func (b mp4Box) all(boxType string) []mp4Box {
+	boxes := []mp4Box{}
+	for _, child := range b.children {
+		if child.boxType == boxType {
+			boxes = append(boxes, child)
+		}
+	}
+	return boxes
+}
+
+func (b mp4Box) types() []string {
+	types := []string{}
+	for _, child := range b.children {
+		types = append(types, child.boxType)
+	}
+	return types
+}
+
+// the container boxes of the live streams.
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "dinf": true,
+	"stbl": true, "mvex": true, "moof": true, "traf": true,
+}
+
+// parse the boxes between `offset` and `end`. The children of every
+// container must fill it exactly.
+func parseMP4(t *testing.T, file []byte, offset int64, end int64) []mp4Box {
+	t.Helper()
+	boxes := []mp4Box{}
+	for offset < end {
+		if end-offset < 8 {
+			t.Fatalf("truncated box header at %d", offset)
+		}
+		box := mp4Box{
+			boxType: string(file[offset+4 : offset+8]),
+			offset:  offset,
+			size:    int64(binary.BigEndian.Uint32(file[offset:])),
+		}
+		if box.size < 8 || offset+box.size > end {
+			t.Fatalf("box %s at %d of size %d past its parent (%d)", box.boxType, offset, box.size, end)
+		}
+		if mp4Containers[box.boxType] {
+			box.children = parseMP4(t, file, offset+8, offset+box.size)
+		}
+		boxes = append(boxes, box)
+		offset += box.size
+	}
+	if offset != end {
+		t.Fatalf("the boxes end at %d instead of %d", offset, end)
+	}
+	return boxes
+}
+
+// a sample of a parsed track run.
+type mp4TestSample struct {
+	duration uint32
+	size     uint32
+	keyframe bool
+}
+
+// the track, decode time, data offset and samples of a track fragment.
+func parseTrackFragment(t *testing.T, file []byte, traf mp4Box) (uint32, uint64, int64, []mp4TestSample) {
+	t.Helper()
+	tfhd := traf.child(t, "tfhd").data(file)
+	if binary.BigEndian.Uint32(tfhd)&0xFFFFFF != tfhdDefaultBaseIsMoof {
+		t.Fatal("the track fragment offsets are not relative to the moof box")
+	}
+	track := binary.BigEndian.Uint32(tfhd[4:])
+
+	tfdt := traf.child(t, "tfdt").data(file)
+	if tfdt[0] != 1 {
+		t.Fatalf("tfdt version %d, expected 1", tfdt[0])
+	}
+	decodeTime := binary.BigEndian.Uint64(tfdt[4:])
+
+	trun := traf.child(t, "trun").data(file)
+	if binary.BigEndian.Uint32(trun)&0xFFFFFF != trunFlags {
+		t.Fatal("unexpected track run flags")
+	}
+	count := int(binary.BigEndian.Uint32(trun[4:]))
+	offset := int64(int32(binary.BigEndian.Uint32(trun[8:])))
+	if len(trun) != 12+count*12 {
+		t.Fatalf("track run of %d bytes for %d samples", len(trun), count)
+	}
+	samples := []mp4TestSample{}
+	for i := range count {
+		entry := trun[12+i*12:]
+		samples = append(samples, mp4TestSample{
+			duration: binary.BigEndian.Uint32(entry),
+			size:     binary.BigEndian.Uint32(entry[4:]),
+			keyframe: binary.BigEndian.Uint32(entry[8:]) == sampleFlagsSync,
+		})
+	}
+	return track, decodeTime, offset, samples
+}
+
+func TestMP4InitSegment(t *testing.T) {
+	init := mp4InitSegment([]mp4Track{
+		{id: 1, video: true, timescale: 90000, width: 320, height: 240},
+		{id: 2, timescale: 48000, channels: 2, sampleRate: 48000},
+	})
+
+	boxes := parseMP4(t, init, 0, int64(len(init)))
+	if len(boxes) != 2 || boxes[0].boxType != "ftyp" || boxes[1].boxType != "moov" {
+		t.Fatal("expected the ftyp and moov boxes")
+	}
+	moov := boxes[1]
+	if types := moov.types(); !slices.Equal(types, []string{"mvhd", "trak", "trak", "mvex"}) {
+		t.Fatalf("unexpected moov boxes %v", types)
+	}
+	if trex := moov.child(t, "mvex").all("trex"); len(trex) != 2 {
+		t.Fatalf("%d trex boxes, expected 2", len(trex))
+	}
+
+	for i, trak := range moov.all("trak") {
+		tkhd := trak.child(t, "tkhd").data(init)
+		if id := binary.BigEndian.Uint32(tkhd[12:]); id != uint32(i+1) {
+			t.Fatalf("track %d has the id %d", i, id)
+		}
+
+		mdia := trak.child(t, "mdia")
+		mdhd := mdia.child(t, "mdhd").data(init)
+		timescale := binary.BigEndian.Uint32(mdhd[12:])
+
+		stbl := mdia.child(t, "minf").child(t, "stbl")
+		if types := stbl.types(); !slices.Equal(types, []string{"stsd", "stts", "stsc", "stco", "stsz"}) {
+			t.Fatalf("unexpected stbl boxes %v", types)
+		}
+		// the sample entry fills the sample description
+		stsd := stbl.child(t, "stsd").data(init)
+		entries := parseMP4(t, stsd, 8, int64(len(stsd)))
+		if len(entries) != 1 {
+			t.Fatalf("%d sample entries, expected 1", len(entries))
+		}
+
+		switch i {
+		case 0:
+			if timescale != 90000 || entries[0].boxType != "vp08" {
+				t.Fatal("expected the vp8 track")
+			}
+			entry := entries[0].data(stsd)
+			if width, height := binary.BigEndian.Uint16(entry[24:]), binary.BigEndian.Uint16(entry[26:]); width != 320 || height != 240 {
+				t.Fatalf("video size %dx%d, expected 320x240", width, height)
+			}
+		case 1:
+			if timescale != 48000 || entries[0].boxType != "Opus" {
+				t.Fatal("expected the opus track")
+			}
+			entry := entries[0].data(stsd)
+			if channels := binary.BigEndian.Uint16(entry[16:]); channels != 2 {
+				t.Fatalf("%d audio channels, expected 2", channels)
+			}
+		}
+	}
+}
+
+func TestMP4Fragment(t *testing.T) {
+	fragments := []mp4TrackFragment{
+		{track: 1, decodeTime: 90000, samples: []mp4Sample{
+			{data: bytes.Repeat([]byte{1}, 100), duration: 3000, keyframe: true},
+			{data: bytes.Repeat([]byte{2}, 50), duration: 3003},
+		}},
+		{track: 2, decodeTime: 1 << 33, samples: []mp4Sample{
+			{data: bytes.Repeat([]byte{3}, 20), duration: 960, keyframe: true},
+			{data: bytes.Repeat([]byte{4}, 30), duration: 960, keyframe: true},
+			{data: bytes.Repeat([]byte{5}, 40), duration: 480, keyframe: true},
+		}},
+	}
+	segment := mp4Fragment(7, fragments)
+
+	boxes := parseMP4(t, segment, 0, int64(len(segment)))
+	if len(boxes) != 2 || boxes[0].boxType != "moof" || boxes[1].boxType != "mdat" {
+		t.Fatal("expected the moof and mdat boxes")
+	}
+	moof, mdat := boxes[0], boxes[1]
+	if types := moof.types(); !slices.Equal(types, []string{"mfhd", "traf", "traf"}) {
+		t.Fatalf("unexpected moof boxes %v", types)
+	}
+	if sequence := binary.BigEndian.Uint32(moof.child(t, "mfhd").data(segment)[4:]); sequence != 7 {
+		t.Fatalf("sequence number %d, expected 7", sequence)
+	}
+
+	// the samples of the track runs follow each other in the mdat box
+	next := mdat.offset + 8
+	for i, traf := range moof.all("traf") {
+		expected := fragments[i]
+		track, decodeTime, offset, samples := parseTrackFragment(t, segment, traf)
+		if track != expected.track || decodeTime != expected.decodeTime {
+			t.Fatalf("fragment %d: track %d at %d, expected track %d at %d", i, track, decodeTime, expected.track, expected.decodeTime)
+		}
+		if moof.offset+offset != next {
+			t.Fatalf("fragment %d: data at %d, expected %d", i, moof.offset+offset, next)
+		}
+		if len(samples) != len(expected.samples) {
+			t.Fatalf("fragment %d: %d samples, expected %d", i, len(samples), len(expected.samples))
+		}
+
+		for j, sample := range samples {
+			data := expected.samples[j]
+			if sample.duration != data.duration || sample.keyframe != data.keyframe || int(sample.size) != len(data.data) {
+				t.Fatalf("fragment %d sample %d: %+v", i, j, sample)
+			}
+			if !bytes.Equal(segment[next:next+int64(sample.size)], data.data) {
+				t.Fatalf("fragment %d sample %d: unexpected data", i, j)
+			}
+			next += int64(sample.size)
+		}
+	}
+	if next != mdat.offset+mdat.size {
+		t.Fatal("the mdat box holds more than the samples")
+	}
+}
@@ -0,0 +1,282 @@
+package record
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// samples skipped by the opus decoders at the start of the stream
+const opusPreSkip = 312
+
+// a 20ms opus (celt) frame of silence inserted in place of the lost audio
+// packets so that the decoders conceal the loss instead of shifting the
+// audio that follows
+var opusSilence = []byte{0xF8, 0xFF, 0xFE}
+
+const (
+	// samples of the silence frame (20ms at 48kHz)
+	opusSilenceSamples = 960
+	// longest gap (in frames) filled with silence
+	maxSilenceFrames = 50
+)
+
+// a complete frame of a recorded track.
+type frame struct {
+	data      []byte
+	timestamp uint32
+	keyframe  bool
+}
+
+// assembler rebuilds the frames of a track from its packets (in order, see
+// jitterBuffer). Video frames missing some of their packets are dropped; the
+// track then waits for the next keyframe as the following frames cannot be
+// decoded either. Lost opus packets are replaced with silence.
+type assembler struct {
+	mimeType string
+	video    bool
+
+	frame     []byte
+	timestamp uint32
+	keyframe  bool
+	// the current frame started and didn't lose any packet
+	started bool
+
+	lastSeq      uint16
+	hasSeq       bool
+	waitKeyframe bool
+	// timestamp of the latest audio frame
+	lastTimestamp uint32
+}
+
+func newAssembler(codec webrtc.RTPCodecCapability) *assembler {
+	mimeType := strings.ToLower(codec.MimeType)
+	video := strings.HasPrefix(mimeType, "video/")
+	return &assembler{mimeType: mimeType, video: video, waitKeyframe: video}
+}
+
+// add the next packet of the track. Returns the frames completed by the
+// packet (if any).
+func (a *assembler) push(header *rtp.Header, payload []byte) []frame {
+	lost := false
+	if a.hasSeq {
+		diff := int16(header.SequenceNumber - a.lastSeq)
+		if diff <= 0 {
+			// duplicated or late packet
+			return nil
+		}
+		lost = diff > 1
+	}
+	a.lastSeq = header.SequenceNumber
+
+	if !a.video {
+		frames := []frame{}
+		if lost && a.hasSeq && a.mimeType == strings.ToLower(webrtc.MimeTypeOpus) {
+			frames = a.silence(header.Timestamp)
+		}
+		a.hasSeq = true
+		a.lastTimestamp = header.Timestamp
+		return append(frames, frame{data: clone(payload), timestamp: header.Timestamp, keyframe: true})
+	}
+
+	a.hasSeq = true
+	if lost {
+		a.lost()
+	}
+	if completed, ok := a.pushVideo(header, payload); ok {
+		return []frame{completed}
+	}
+	return nil
+}
+
+// silence frames filling the gap between the latest frame and the timestamp.
+func (a *assembler) silence(timestamp uint32) []frame {
+	missing := int(int32(timestamp-a.lastTimestamp))/opusSilenceSamples - 1
+	frames := []frame{}
+	for i := 1; i <= min(missing, maxSilenceFrames); i++ {
+		frames = append(frames, frame{
+			data:      opusSilence,
+			timestamp: a.lastTimestamp + uint32(i*opusSilenceSamples),
+			keyframe:  true,
+		})
+	}
+	return frames
+}
+
+func (a *assembler) pushVideo(header *rtp.Header, payload []byte) (frame, bool) {
+	if a.started && header.Timestamp != a.timestamp {
+		// the previous frame never received its last packet
+		a.lost()
+	}
+
+	start, keyframe, data, ok := a.depacketize(payload)
+	if !ok {
+		a.lost()
+		return frame{}, false
+	}
+
+	if !a.started {
+		if !start {
+			// the first packets of the frame are missing
+			return frame{}, false
+		}
+		a.started = true
+		a.timestamp = header.Timestamp
+		a.keyframe = keyframe
+		a.frame = a.frame[:0]
+	}
+	a.frame = append(a.frame, data...)
+
+	if !header.Marker {
+		return frame{}, false
+	}
+
+	a.started = false
+	if a.waitKeyframe && !a.keyframe {
+		return frame{}, false
+	}
+	a.waitKeyframe = false
+	return frame{data: clone(a.frame), timestamp: a.timestamp, keyframe: a.keyframe}, true
+}
+
+// some packets are missing; the current frame is dropped and the track waits
+// for the next keyframe.
+func (a *assembler) lost() {
+	a.started = false
+	a.waitKeyframe = true
+}
+
+// returns whether the payload starts a frame and whether the frame is a
+// keyframe, and the payload without its descriptor.
+func (a *assembler) depacketize(payload []byte) (bool, bool, []byte, bool) {
+	switch a.mimeType {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var packet codecs.VP8Packet
+		data, err := packet.Unmarshal(payload)
+		if err != nil || len(data) == 0 {
+			return false, false, nil, false
+		}
+		start := packet.S == 1 && packet.PID == 0
+		// the inverse key frame flag of the vp8 frame tag
+		keyframe := start && data[0]&0x01 == 0
+		return start, keyframe, data, true
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var packet codecs.VP9Packet
+		data, err := packet.Unmarshal(payload)
+		if err != nil || len(data) == 0 {
+			return false, false, nil, false
+		}
+		keyframe := packet.B && !packet.P && packet.SID == 0
+		return packet.B, keyframe, data, true
+	}
+	return false, false, nil, false
+}
+
+func clone(data []byte) []byte {
+	return append([]byte(nil), data...)
+}
+
+// the width and height of a vp8 or vp9 keyframe.
+func frameSize(mimeType string, data []byte) (int, int, bool) {
+	switch mimeType {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		// frame tag (3 bytes), start code and the 14 bits dimensions
+		if len(data) < 10 || data[3] != 0x9D || data[4] != 0x01 || data[5] != 0x2A {
+			return 0, 0, false
+		}
+		width := binary.LittleEndian.Uint16(data[6:]) & 0x3FFF
+		height := binary.LittleEndian.Uint16(data[8:]) & 0x3FFF
+		return int(width), int(height), true
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return vp9FrameSize(data)
+	}
+	return 0, 0, false
+}
+
+// read the frame size of the uncompressed header of a vp9 keyframe.
+func vp9FrameSize(data []byte) (int, int, bool) {
+	r := bitReader{data: data}
+	if r.read(2) != 2 {
+		// frame marker
+		return 0, 0, false
+	}
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1)
+	}
+	if r.read(1) == 1 {
+		// show existing frame
+		return 0, 0, false
+	}
+	if r.read(1) != 0 {
+		// not a keyframe
+		return 0, 0, false
+	}
+	r.read(2) // show frame, error resilient mode
+	if r.read(24) != 0x498342 {
+		return 0, 0, false
+	}
+
+	// color config
+	if profile >= 2 {
+		r.read(1)
+	}
+	if r.read(3) != 7 {
+		// not rgb: color range and subsampling
+		r.read(1)
+		if profile == 1 || profile == 3 {
+			r.read(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1)
+	}
+
+	width := r.read(16) + 1
+	height := r.read(16) + 1
+	return int(width), int(height), !r.overflow
+}
+
+type bitReader struct {
+	data     []byte
+	offset   int
+	overflow bool
+}
+
+func (r *bitReader) read(bits int) uint32 {
+	value := uint32(0)
+	for range bits {
+		index := r.offset / 8
+		if index >= len(r.data) {
+			r.overflow = true
+			return 0
+		}
+		bit := r.data[index] >> (7 - r.offset%8) & 1
+		value = value<<1 | uint32(bit)
+		r.offset++
+	}
+	return value
+}
+
+// the channels of an opus track. The opus streams are always announced with 2
+// channels (RFC 7587) even though the codec might be registered without any;
+// a mono stream is decoded as stereo.
+func opusChannels(codec webrtc.RTPCodecCapability) int {
+	if codec.Channels == 0 {
+		return 2
+	}
+	return int(codec.Channels)
+}
+
+// the opus identification header used as the codec private data.
+func opusHead(channels int, sampleRate int) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, opusPreSkip)
+	head = binary.LittleEndian.AppendUint32(head, uint32(sampleRate))
+	// output gain and channel mapping family
+	head = append(head, 0, 0, 0)
+	return head
+}
@@ -0,0 +1,240 @@
+package record
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// a packet of a recorded track.
+type testPacket struct {
+	seq       uint16
+	timestamp uint32
+	marker    bool
+	// vp8 packets only
+	start    bool
+	keyframe bool
+}
+
+// the vp8 payload of the packet: the payload descriptor (start of partition
+// and partition 0) and the payload whose first byte is the inverse key frame
+// flag at the start of a frame.
+func (p testPacket) vp8Payload() []byte {
+	if !p.start {
+		return []byte{0x00, 0xAA, 0xBB}
+	}
+	if p.keyframe {
+		return []byte{0x10, 0x00, 0xBB}
+	}
+	return []byte{0x10, 0x01, 0xBB}
+}
+
+// the frames rebuilt by the assembler: their timestamp, whether they are
+// keyframes and their size.
+type testFrame struct {
+	timestamp uint32
+	keyframe  bool
+	size      int
+}
+
+func TestAssemblerVideo(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []testPacket
+		frames  []testFrame
+	}{
+		{
+			name: "single packet frames",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, keyframe: true, marker: true},
+				{seq: 2, timestamp: 3000, start: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 3000, size: 2}},
+		},
+		{
+			name: "frames of several packets",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, keyframe: true},
+				{seq: 2, timestamp: 0},
+				{seq: 3, timestamp: 0, marker: true},
+				{seq: 4, timestamp: 3000, start: true},
+				{seq: 5, timestamp: 3000, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 6}, {timestamp: 3000, size: 4}},
+		},
+		{
+			name: "wraparound within a frame",
+			packets: []testPacket{
+				{seq: 65534, timestamp: 0, start: true, keyframe: true},
+				{seq: 65535, timestamp: 0},
+				{seq: 0, timestamp: 0, marker: true},
+				{seq: 1, timestamp: 3000, start: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 6}, {timestamp: 3000, size: 2}},
+		},
+		{
+			name: "duplicated packets",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, keyframe: true},
+				{seq: 1, timestamp: 0, start: true, keyframe: true},
+				{seq: 2, timestamp: 0, marker: true},
+				{seq: 2, timestamp: 0, marker: true},
+				{seq: 3, timestamp: 3000, start: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 4}, {timestamp: 3000, size: 2}},
+		},
+		{
+			name: "waits for the first keyframe",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, marker: true},
+				{seq: 2, timestamp: 3000, start: true, keyframe: true, marker: true},
+				{seq: 3, timestamp: 6000, start: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 3000, keyframe: true, size: 2}, {timestamp: 6000, size: 2}},
+		},
+		{
+			name: "lost packet within a frame",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, keyframe: true, marker: true},
+				{seq: 2, timestamp: 3000, start: true},
+				{seq: 4, timestamp: 3000, marker: true},
+				{seq: 5, timestamp: 6000, start: true, marker: true},
+				{seq: 6, timestamp: 9000, start: true, keyframe: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 9000, keyframe: true, size: 2}},
+		},
+		{
+			name: "lost first packet of a frame",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, keyframe: true, marker: true},
+				{seq: 3, timestamp: 3000, marker: true},
+				{seq: 4, timestamp: 6000, start: true, marker: true},
+				{seq: 5, timestamp: 9000, start: true, keyframe: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 9000, keyframe: true, size: 2}},
+		},
+		{
+			name: "lost last packet of a frame",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, keyframe: true, marker: true},
+				{seq: 2, timestamp: 3000, start: true},
+				{seq: 4, timestamp: 6000, start: true, marker: true},
+				{seq: 5, timestamp: 9000, start: true, keyframe: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 9000, keyframe: true, size: 2}},
+		},
+		{
+			name: "lost packet across the wraparound",
+			packets: []testPacket{
+				{seq: 65534, timestamp: 0, start: true, keyframe: true, marker: true},
+				{seq: 0, timestamp: 3000, start: true, marker: true},
+				{seq: 1, timestamp: 6000, start: true, keyframe: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 6000, keyframe: true, size: 2}},
+		},
+		{
+			name: "frame without its last packet",
+			packets: []testPacket{
+				{seq: 1, timestamp: 0, start: true, keyframe: true, marker: true},
+				{seq: 2, timestamp: 3000, start: true},
+				{seq: 3, timestamp: 6000, start: true, marker: true},
+				{seq: 4, timestamp: 9000, start: true, keyframe: true, marker: true},
+			},
+			frames: []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 9000, keyframe: true, size: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assembler := newAssembler(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000})
+
+			frames := []testFrame{}
+			for _, packet := range test.packets {
+				header := &rtp.Header{SequenceNumber: packet.seq, Timestamp: packet.timestamp, Marker: packet.marker}
+				for _, frame := range assembler.push(header, packet.vp8Payload()) {
+					frames = append(frames, testFrame{timestamp: frame.timestamp, keyframe: frame.keyframe, size: len(frame.data)})
+				}
+			}
+
+			if !slices.Equal(frames, test.frames) {
+				t.Fatalf("frames %v, expected %v", frames, test.frames)
+			}
+		})
+	}
+}
+
+func TestAssemblerOpus(t *testing.T) {
+	silence := len(opusSilence)
+
+	tests := []struct {
+		name    string
+		packets []testPacket
+		frames  []testFrame
+	}{
+		{
+			name:    "in order",
+			packets: []testPacket{{seq: 1, timestamp: 0}, {seq: 2, timestamp: 960}},
+			frames:  []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 960, keyframe: true, size: 2}},
+		},
+		{
+			name:    "wraparound",
+			packets: []testPacket{{seq: 65535, timestamp: 4294966336}, {seq: 0, timestamp: 0}},
+			frames:  []testFrame{{timestamp: 4294966336, keyframe: true, size: 2}, {timestamp: 0, keyframe: true, size: 2}},
+		},
+		{
+			name:    "duplicated packet",
+			packets: []testPacket{{seq: 1, timestamp: 0}, {seq: 1, timestamp: 0}, {seq: 2, timestamp: 960}},
+			frames:  []testFrame{{timestamp: 0, keyframe: true, size: 2}, {timestamp: 960, keyframe: true, size: 2}},
+		},
+		{
+			name:    "lost packets",
+			packets: []testPacket{{seq: 1, timestamp: 0}, {seq: 4, timestamp: 2880}},
+			frames: []testFrame{
+				{timestamp: 0, keyframe: true, size: 2},
+				{timestamp: 960, keyframe: true, size: silence},
+				{timestamp: 1920, keyframe: true, size: silence},
+				{timestamp: 2880, keyframe: true, size: 2},
+			},
+		},
+		{
+			name:    "lost packet across the wraparound",
+			packets: []testPacket{{seq: 65535, timestamp: 4294966336}, {seq: 1, timestamp: 960}},
+			frames: []testFrame{
+				{timestamp: 4294966336, keyframe: true, size: 2},
+				{timestamp: 0, keyframe: true, size: silence},
+				{timestamp: 960, keyframe: true, size: 2},
+			},
+		},
+		{
+			name:    "long gap",
+			packets: []testPacket{{seq: 1, timestamp: 0}, {seq: 200, timestamp: 199 * 960}},
+			frames: func() []testFrame {
+				frames := []testFrame{{timestamp: 0, keyframe: true, size: 2}}
+				for i := 1; i <= maxSilenceFrames; i++ {
+					frames = append(frames, testFrame{timestamp: uint32(i * 960), keyframe: true, size: silence})
+				}
+				return append(frames, testFrame{timestamp: 199 * 960, keyframe: true, size: 2})
+			}(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assembler := newAssembler(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000})
+
+			frames := []testFrame{}
+			for _, packet := range test.packets {
+				header := &rtp.Header{SequenceNumber: packet.seq, Timestamp: packet.timestamp}
+				for _, frame := range assembler.push(header, []byte{0xFC, 0xAA}) {
+					frames = append(frames, testFrame{timestamp: frame.timestamp, keyframe: frame.keyframe, size: len(frame.data)})
+				}
+			}
+
+			if !slices.Equal(frames, test.frames) {
+				t.Fatalf("frames %v, expected %v", frames, test.frames)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package record
+
+import (
+	"echo/lib/forward"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// time a missing packet is waited for when the publisher can retransmit
+	// it (nack)
+	nackLatency = 400 * time.Millisecond
+	// time a missing packet is waited for otherwise (reordered packets)
+	reorderLatency = 60 * time.Millisecond
+	// maximum number of buffered packets per track
+	jitterBufferSize = 1024
+)
+
+// jitterBuffer puts the packets of a track back in order before they are
+// written. A missing packet is waited for until a later packet is older than
+// the buffer latency; it is then considered lost. The latency is long enough
+// for a retransmission when the publisher supports nack.
+type jitterBuffer struct {
+	latency time.Duration
+	packets [jitterBufferSize]bufferedPacket
+	// sequence number of the next packet to pop
+	next    uint16
+	started bool
+	// number of buffered packets
+	size int
+}
+
+type bufferedPacket struct {
+	header  rtp.Header
+	packet  *forward.Packet
+	arrival time.Time
+}
+
+func newJitterBuffer(codec webrtc.RTPCodecCapability) *jitterBuffer {
+	latency := reorderLatency
+	for _, feedback := range codec.RTCPFeedback {
+		if feedback.Type == webrtc.TypeRTCPFBNACK && feedback.Parameter == "" {
+			latency = nackLatency
+		}
+	}
+	return &jitterBuffer{latency: latency}
+}
+
+// add a packet to the buffer; the buffer takes over the packet reference.
+func (j *jitterBuffer) push(header *rtp.Header, packet *forward.Packet, arrival time.Time) {
+	if !j.started {
+		j.next = header.SequenceNumber
+		j.started = true
+	}
+
+	// duplicated or late (already considered lost) packet
+	diff := int16(header.SequenceNumber - j.next)
+	slot := &j.packets[header.SequenceNumber%jitterBufferSize]
+	if diff < 0 || (slot.packet != nil && slot.header.SequenceNumber == header.SequenceNumber) {
+		packet.Release()
+		return
+	}
+
+	// too far ahead; give up on the packets that didn't arrive yet
+	for int(header.SequenceNumber-j.next) >= jitterBufferSize {
+		j.skip()
+	}
+
+	*slot = bufferedPacket{header: *header, packet: packet, arrival: arrival}
+	j.size++
+}
+
+// take the next packet in order; the sequence numbers of the missing
+// packets are skipped. Returns false when the next packet should still be
+// waited for.
+func (j *jitterBuffer) pop(now time.Time) (bufferedPacket, bool) {
+	for j.size > 0 {
+		slot := &j.packets[j.next%jitterBufferSize]
+		if slot.packet != nil && slot.header.SequenceNumber == j.next {
+			packet := *slot
+			*slot = bufferedPacket{}
+			j.size--
+			j.next++
+			return packet, true
+		}
+
+		// wait for the missing packets unless the next buffered packet waited
+		// too long
+		next, arrival := j.oldest()
+		if now.Sub(arrival) < j.latency {
+			return bufferedPacket{}, false
+		}
+		j.next = next
+	}
+	return bufferedPacket{}, false
+}
+
+// the sequence number and arrival time of the next buffered packet.
+func (j *jitterBuffer) oldest() (uint16, time.Time) {
+	for i := uint16(0); i < jitterBufferSize; i++ {
+		slot := &j.packets[(j.next+i)%jitterBufferSize]
+		if slot.packet != nil && slot.header.SequenceNumber == j.next+i {
+			return j.next + i, slot.arrival
+		}
+	}
+	return j.next, time.Time{}
+}
+
+// drop the next packet (if buffered) and move on.
+func (j *jitterBuffer) skip() {
+	slot := &j.packets[j.next%jitterBufferSize]
+	if slot.packet != nil && slot.header.SequenceNumber == j.next {
+		slot.packet.Release()
+		*slot = bufferedPacket{}
+		j.size--
+	}
+	j.next++
+}
+
+// take all of the buffered packets in order regardless of the latency (e.g.
+// the track ended).
+func (j *jitterBuffer) drain(callback func(packet bufferedPacket)) {
+	for j.size > 0 {
+		slot := &j.packets[j.next%jitterBufferSize]
+		if slot.packet != nil && slot.header.SequenceNumber == j.next {
+			packet := *slot
+			*slot = bufferedPacket{}
+			j.size--
+			callback(packet)
+		}
+		j.next++
+	}
+}
@@ -0,0 +1,127 @@
+package record
+
+import (
+	"echo/lib/forward"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestJitterBuffer(t *testing.T) {
+	type push struct {
+		seq uint16
+		// arrival time since the first packet
+		at time.Duration
+	}
+
+	tests := []struct {
+		name   string
+		nack   bool
+		pushes []push
+		// the packets popped after every push (in order)
+		popped []uint16
+		// the packets left in the buffer
+		drained []uint16
+	}{
+		{
+			name:   "in order",
+			pushes: []push{{seq: 1}, {seq: 2}, {seq: 3}},
+			popped: []uint16{1, 2, 3},
+		},
+		{
+			name:   "reordered",
+			pushes: []push{{seq: 1}, {seq: 3, at: 5 * time.Millisecond}, {seq: 2, at: 10 * time.Millisecond}},
+			popped: []uint16{1, 2, 3},
+		},
+		{
+			name:   "wraparound",
+			pushes: []push{{seq: 65534}, {seq: 65535}, {seq: 0}, {seq: 1}},
+			popped: []uint16{65534, 65535, 0, 1},
+		},
+		{
+			name:   "reordered across the wraparound",
+			pushes: []push{{seq: 65534}, {seq: 0}, {seq: 65535}, {seq: 1}},
+			popped: []uint16{65534, 65535, 0, 1},
+		},
+		{
+			name:   "duplicated packets",
+			pushes: []push{{seq: 1}, {seq: 2}, {seq: 2}, {seq: 4}, {seq: 4}, {seq: 3}, {seq: 1}},
+			popped: []uint16{1, 2, 3, 4},
+		},
+		{
+			name:    "missing packet waited for",
+			pushes:  []push{{seq: 1}, {seq: 3}, {seq: 4, at: reorderLatency / 2}},
+			popped:  []uint16{1},
+			drained: []uint16{3, 4},
+		},
+		{
+			name:   "lost packet",
+			pushes: []push{{seq: 1}, {seq: 3}, {seq: 4, at: reorderLatency}},
+			popped: []uint16{1, 3, 4},
+		},
+		{
+			name:   "late packet after it was considered lost",
+			pushes: []push{{seq: 1}, {seq: 3}, {seq: 4, at: reorderLatency}, {seq: 2, at: reorderLatency}, {seq: 5, at: reorderLatency}},
+			popped: []uint16{1, 3, 4, 5},
+		},
+		{
+			name:    "lost packet waited for longer with nack",
+			nack:    true,
+			pushes:  []push{{seq: 1}, {seq: 3}, {seq: 4, at: reorderLatency}},
+			popped:  []uint16{1},
+			drained: []uint16{3, 4},
+		},
+		{
+			name:   "lost packet across the wraparound",
+			pushes: []push{{seq: 65535}, {seq: 1}, {seq: 2, at: reorderLatency}},
+			popped: []uint16{65535, 1, 2},
+		},
+		{
+			name:    "too far ahead",
+			pushes:  []push{{seq: 1}, {seq: 3}, {seq: 3 + jitterBufferSize}},
+			popped:  []uint16{1},
+			drained: []uint16{3 + jitterBufferSize},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+			if test.nack {
+				codec.RTCPFeedback = []webrtc.RTCPFeedback{{Type: webrtc.TypeRTCPFBNACK}}
+			}
+			buffer := newJitterBuffer(codec)
+
+			start := time.Now()
+			popped := []uint16{}
+			for _, push := range test.pushes {
+				now := start.Add(push.at)
+				buffer.push(&rtp.Header{SequenceNumber: push.seq}, forward.NewPacket(), now)
+				for {
+					packet, ok := buffer.pop(now)
+					if !ok {
+						break
+					}
+					popped = append(popped, packet.header.SequenceNumber)
+					packet.packet.Release()
+				}
+			}
+
+			drained := []uint16{}
+			buffer.drain(func(packet bufferedPacket) {
+				drained = append(drained, packet.header.SequenceNumber)
+				packet.packet.Release()
+			})
+
+			if !slices.Equal(popped, test.popped) {
+				t.Errorf("popped %v, expected %v", popped, test.popped)
+			}
+			if !slices.Equal(drained, test.drained) {
+				t.Errorf("drained %v, expected %v", drained, test.drained)
+			}
+		})
+	}
+}
@@ -0,0 +1,658 @@
+package record
+
+import (
+	"echo/lib/forward"
+	"echo/lib/utils"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// duration of the live segments unless configured
+	defaultLiveSegment = 2 * time.Second
+	// number of segments listed in the live playlist
+	liveWindow = 6
+	// segments kept after leaving the playlist for the viewers still
+	// downloading them
+	liveExtraSegments = 3
+	// name of the live playlist
+	LivePlaylistName = "index.m3u8"
+)
+
+// whether the codec can be packaged in the live segments.
+func canStream(codec webrtc.RTPCodecCapability) bool {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus), strings.ToLower(webrtc.MimeTypeVP8):
+		return true
+	}
+	return false
+}
+
+// LiveStream packages the tracks of a member (e.g. its camera and
+// microphone) into an HLS stream for the viewers who don't join the session
+// (e.g. the parents of a student). Like a recording, the tracks are read as
+// sinks of the forwarded tracks; the members of the session are not
+// affected.
+//
+// The packets go through the same jitter buffer and assembler as the
+// recordings and the frames are packaged in fragmented mp4 segments (vp8
+// and opus) of about the configured duration starting with a keyframe. The
+// latest segments are kept in memory and listed in the playlist. The stream
+// starts over with a new init segment (a discontinuity) every time its
+// tracks change (e.g. the camera is turned on or another member is
+// followed).
+type LiveStream struct {
+	segment time.Duration
+	// time origin of the stream
+	start time.Time
+
+	mu     sync.RWMutex
+	closed bool
+	sinks  map[*forward.Track]*liveTrack
+	events chan liveEvent
+	done   chan struct{}
+
+	// owned by the run loop
+	tracks []*liveTrack
+	// the tracks changed at this time; the next period waits for the size
+	// of the video until the header timeout
+	changedAt time.Time
+	// current period (zero until the next period starts)
+	period  int
+	periods int
+	// the current period has a video track; the segments start with its
+	// keyframes
+	hasVideo bool
+	// the first frame of the period has been packaged
+	started bool
+	// start of the current segment and the latest frame on the stream
+	// timeline
+	segmentStart time.Duration
+	latest       time.Duration
+	// the next segment is the first one of a period (but the first period)
+	discontinuity bool
+	fragments     uint32
+	// publisher clock offset (see muxer)
+	clockOffset time.Duration
+	synced      bool
+
+	// read by the viewers
+	filesMu  sync.RWMutex
+	segments []liveSegment
+	// init segments by period
+	inits map[int][]byte
+	// number of segments written so far
+	written int
+	// discontinuities removed from the segments
+	discontinuities int
+	ended           bool
+}
+
+type liveSegment struct {
+	number        int
+	period        int
+	discontinuity bool
+	duration      time.Duration
+	data          []byte
+}
+
+type liveEvent struct {
+	kind    muxEventKind
+	track   *liveTrack
+	header  rtp.Header
+	packet  *forward.Packet
+	time    time.Time
+	rtpTime uint32
+}
+
+// a frame waiting for the next one to know its duration.
+type liveSample struct {
+	mp4Sample
+	decodeTime uint64
+	timestamp  uint32
+}
+
+// create a live stream with segments of the given duration (the default
+// duration unless positive).
+func NewLiveStream(segment time.Duration) *LiveStream {
+	if segment <= 0 {
+		segment = defaultLiveSegment
+	}
+
+	now := time.Now()
+	l := &LiveStream{
+		segment:   segment,
+		start:     now,
+		sinks:     map[*forward.Track]*liveTrack{},
+		events:    make(chan liveEvent, queueSize),
+		done:      make(chan struct{}),
+		changedAt: now,
+		inits:     map[int][]byte{},
+	}
+
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		l.run()
+	}()
+
+	return l
+}
+
+// start packaging a track; only vp8 and opus tracks can be packaged.
+func (l *LiveStream) AddTrack(track *forward.Track) error {
+	if !canStream(track.Codec()) {
+		return ErrUnsupportedCodec
+	}
+
+	l.mu.Lock()
+	if l.closed || l.sinks[track] != nil {
+		l.mu.Unlock()
+		return nil
+	}
+	liveTrack := &liveTrack{
+		stream:    l,
+		track:     track,
+		video:     track.Kind() == webrtc.RTPCodecTypeVideo,
+		timescale: track.Codec().ClockRate,
+		jitter:    newJitterBuffer(track.Codec()),
+		assembler: newAssembler(track.Codec()),
+		clock:     clock{rate: track.Codec().ClockRate},
+	}
+	l.sinks[track] = liveTrack
+	l.mu.Unlock()
+
+	if !l.send(liveEvent{kind: muxEventAdd, track: liveTrack, time: time.Now()}, true) {
+		return nil
+	}
+	track.AddSink(liveTrack, false)
+
+	// the stream might have been closed in the meantime
+	l.mu.RLock()
+	closed := l.closed
+	l.mu.RUnlock()
+	if closed {
+		track.RemoveSink(liveTrack)
+	}
+	return nil
+}
+
+// stop packaging a track.
+func (l *LiveStream) RemoveTrack(track *forward.Track) {
+	l.mu.Lock()
+	liveTrack := l.sinks[track]
+	delete(l.sinks, track)
+	l.mu.Unlock()
+
+	if liveTrack != nil {
+		track.RemoveSink(liveTrack)
+		liveTrack.Close()
+	}
+}
+
+// send an event to the run loop. Returns false in case the event has been
+// dropped (the stream is closed or, unless `block`, it cannot keep up).
+func (l *LiveStream) send(event liveEvent, block bool) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return false
+	}
+	if block {
+		l.events <- event
+		return true
+	}
+
+	select {
+	case l.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop packaging the tracks; the playlist ends with the latest segment.
+func (l *LiveStream) Close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	sinks := l.sinks
+	l.sinks = map[*forward.Track]*liveTrack{}
+	close(l.events)
+	l.mu.Unlock()
+
+	for track, sink := range sinks {
+		track.RemoveSink(sink)
+	}
+	<-l.done
+}
+
+func (l *LiveStream) run() {
+	defer close(l.done)
+	for event := range l.events {
+		switch event.kind {
+		case muxEventPacket:
+			l.onPacket(event)
+		case muxEventSenderReport:
+			event.track.clock.setSenderReport(event.time, event.rtpTime)
+		case muxEventAdd:
+			l.closePeriod()
+			l.tracks = append(l.tracks, event.track)
+			l.changedAt = event.time
+		case muxEventRemove:
+			l.onRemove(event.track, event.time)
+		}
+	}
+
+	for _, track := range l.tracks {
+		l.drain(track)
+	}
+	l.closePeriod()
+
+	l.filesMu.Lock()
+	l.ended = true
+	l.filesMu.Unlock()
+}
+
+func (l *LiveStream) onPacket(event liveEvent) {
+	track := event.track
+	if !slices.Contains(l.tracks, track) {
+		event.packet.Release()
+		return
+	}
+
+	track.jitter.push(&event.header, event.packet, event.time)
+	for {
+		buffered, ok := track.jitter.pop(event.time)
+		if !ok {
+			break
+		}
+		l.assemble(track, buffered)
+	}
+
+	// the next segment starts with a keyframe
+	waiting := track.assembler.waitKeyframe ||
+		(track.video && l.started && l.latest-l.segmentStart >= l.segment)
+	if waiting && event.time.Sub(track.keyframeRequestedAt) > keyframeInterval {
+		track.keyframeRequestedAt = event.time
+		track.track.RequestKeyframe()
+	}
+}
+
+// rebuild the frames of the track from the next packet in order.
+func (l *LiveStream) assemble(track *liveTrack, buffered bufferedPacket) {
+	defer buffered.packet.Release()
+
+	for _, frame := range track.assembler.push(&buffered.header, buffered.packet.Payload) {
+		if track.video && frame.keyframe && track.width == 0 {
+			if width, height, ok := frameSize(track.assembler.mimeType, frame.data); ok {
+				track.width, track.height = width, height
+			}
+		}
+
+		at, reported := track.clock.time(frame.timestamp, buffered.arrival)
+		if reported {
+			if !l.synced {
+				l.clockOffset = buffered.arrival.Sub(at)
+				l.synced = true
+			}
+			at = at.Add(l.clockOffset)
+		}
+		l.addFrame(track, frame, at, buffered.arrival)
+	}
+}
+
+// write the packets left in the jitter buffer of the track.
+func (l *LiveStream) drain(track *liveTrack) {
+	track.jitter.drain(func(buffered bufferedPacket) {
+		l.assemble(track, buffered)
+	})
+}
+
+func (l *LiveStream) onRemove(track *liveTrack, now time.Time) {
+	if !slices.Contains(l.tracks, track) {
+		return
+	}
+
+	l.drain(track)
+	l.closePeriod()
+	l.tracks = slices.DeleteFunc(l.tracks, func(t *liveTrack) bool {
+		return t == track
+	})
+	l.changedAt = now
+}
+
+// add a frame to the current segment; the frames wait for the next period
+// to start.
+func (l *LiveStream) addFrame(track *liveTrack, frame frame, at time.Time, now time.Time) {
+	if l.period == 0 && !l.openPeriod(now) {
+		return
+	}
+	if track.id == 0 {
+		return
+	}
+	if track.video && !track.keyframed {
+		// the video of every period starts with a keyframe
+		if !frame.keyframe {
+			track.assembler.waitKeyframe = true
+			return
+		}
+		track.keyframed = true
+	}
+
+	// the frames follow the RTP timestamps from the first frame of the
+	// track in the period so that the decode times never go backwards
+	var decodeTime uint64
+	if track.pending == nil {
+		decodeTime = uint64(max(at.Sub(l.start), 0).Seconds() * float64(track.timescale))
+	} else {
+		elapsed := max(int32(frame.timestamp-track.pending.timestamp), 1)
+		decodeTime = track.pending.decodeTime + uint64(elapsed)
+		track.finishSample(uint32(elapsed))
+	}
+
+	position := track.position(decodeTime)
+	if !l.started {
+		l.started = true
+		l.segmentStart = position
+		l.latest = position
+	}
+	l.latest = max(l.latest, position)
+
+	if l.segmentEnded(track, frame, position) {
+		l.writeSegment(position - l.segmentStart)
+		l.segmentStart = position
+	}
+
+	track.pending = &liveSample{
+		mp4Sample:  mp4Sample{data: frame.data, keyframe: frame.keyframe},
+		decodeTime: decodeTime,
+		timestamp:  frame.timestamp,
+	}
+}
+
+// whether the current segment ends before the frame. The segments start
+// with a keyframe of the video (or any frame of the audio only streams);
+// a segment ends regardless once it is twice as long as the configured
+// duration.
+func (l *LiveStream) segmentEnded(track *liveTrack, frame frame, position time.Duration) bool {
+	elapsed := position - l.segmentStart
+	keyframe := frame.keyframe && (track.video || !l.hasVideo)
+	return (keyframe && elapsed >= l.segment) || elapsed >= 2*l.segment
+}
+
+// start a period with the current tracks once the size of the video is
+// known (or the header timeout elapsed). Returns false in case the period
+// didn't start.
+func (l *LiveStream) openPeriod(now time.Time) bool {
+	if len(l.tracks) == 0 {
+		return false
+	}
+
+	tracks := []mp4Track{}
+	hasVideo := false
+	for i, track := range l.tracks {
+		mp4Track := mp4Track{id: uint32(i + 1), video: track.video, timescale: track.timescale}
+		if track.video {
+			if track.width == 0 && now.Sub(l.changedAt) < headerTimeout {
+				return false
+			}
+			mp4Track.width, mp4Track.height = track.width, track.height
+			if track.width == 0 {
+				mp4Track.width, mp4Track.height = defaultWidth, defaultHeight
+			}
+			hasVideo = true
+		} else {
+			codec := track.track.Codec()
+			mp4Track.channels = opusChannels(codec)
+			mp4Track.sampleRate = int(codec.ClockRate)
+		}
+		tracks = append(tracks, mp4Track)
+	}
+
+	for i, track := range l.tracks {
+		track.id = uint32(i + 1)
+	}
+	l.periods++
+	l.period = l.periods
+	l.hasVideo = hasVideo
+	l.started = false
+	l.discontinuity = l.period > 1
+
+	l.filesMu.Lock()
+	l.inits[l.period] = mp4InitSegment(tracks)
+	l.filesMu.Unlock()
+	return true
+}
+
+// write the remaining frames of the current period.
+func (l *LiveStream) closePeriod() {
+	if l.period == 0 {
+		return
+	}
+
+	end := l.segmentStart
+	for _, track := range l.tracks {
+		if track.pending == nil {
+			continue
+		}
+		duration := track.lastDuration
+		if duration == 0 {
+			// a frame of video (30fps) or audio (20ms)
+			duration = track.timescale / 30
+			if !track.video {
+				duration = track.timescale / 50
+			}
+		}
+		end = max(end, track.position(track.pending.decodeTime+uint64(duration)))
+		track.finishSample(duration)
+	}
+	l.writeSegment(end - l.segmentStart)
+
+	l.period = 0
+	for _, track := range l.tracks {
+		track.id = 0
+		track.keyframed = false
+		track.pending = nil
+		track.samples = nil
+		track.lastDuration = 0
+		track.assembler.waitKeyframe = track.video
+	}
+}
+
+// package the samples of the tracks into the next segment.
+func (l *LiveStream) writeSegment(duration time.Duration) {
+	fragments := []mp4TrackFragment{}
+	for _, track := range l.tracks {
+		if track.id == 0 || len(track.samples) == 0 {
+			continue
+		}
+		fragments = append(fragments, mp4TrackFragment{
+			track:      track.id,
+			decodeTime: track.fragmentStart,
+			samples:    track.samples,
+		})
+		track.samples = nil
+	}
+	if len(fragments) == 0 {
+		return
+	}
+
+	l.fragments++
+	data := mp4Fragment(l.fragments, fragments)
+
+	l.filesMu.Lock()
+	defer l.filesMu.Unlock()
+
+	l.written++
+	l.segments = append(l.segments, liveSegment{
+		number:        l.written,
+		period:        l.period,
+		discontinuity: l.discontinuity,
+		duration:      duration,
+		data:          data,
+	})
+	l.discontinuity = false
+
+	for len(l.segments) > liveWindow+liveExtraSegments {
+		if l.segments[0].discontinuity {
+			l.discontinuities++
+		}
+		l.segments = slices.Delete(l.segments, 0, 1)
+	}
+	// the init segments of the periods no longer listed
+	for period := range l.inits {
+		if period < l.segments[0].period {
+			delete(l.inits, period)
+		}
+	}
+}
+
+// the media playlist of the latest segments.
+func (l *LiveStream) Playlist() string {
+	l.filesMu.RLock()
+	defer l.filesMu.RUnlock()
+
+	removed := max(len(l.segments)-liveWindow, 0)
+	window := l.segments[removed:]
+	discontinuities := l.discontinuities
+	for _, segment := range l.segments[:removed] {
+		if segment.discontinuity {
+			discontinuities++
+		}
+	}
+
+	// the target duration should not change; the segments are at most
+	// twice as long as the configured duration unless a track stalled
+	target := int(math.Ceil((2 * l.segment).Seconds()))
+	for _, segment := range window {
+		target = max(target, int(math.Round(segment.duration.Seconds())))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", l.written-len(window)+1)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuities)
+	for i, segment := range window {
+		if segment.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i == 0 || segment.period != window[i-1].period {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", segment.period)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nsegment-%d.m4s\n", segment.duration.Seconds(), segment.number)
+	}
+	if l.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+// an init segment (`init-<period>.mp4`) or a media segment
+// (`segment-<number>.m4s`) of the stream. Returns false in case the file is
+// not (or no longer) available.
+func (l *LiveStream) File(name string) ([]byte, bool) {
+	l.filesMu.RLock()
+	defer l.filesMu.RUnlock()
+
+	if value, found := strings.CutPrefix(name, "init-"); found {
+		period, err := strconv.Atoi(strings.TrimSuffix(value, ".mp4"))
+		data, ok := l.inits[period]
+		return data, ok && err == nil && strings.HasSuffix(value, ".mp4")
+	}
+
+	value, found := strings.CutPrefix(name, "segment-")
+	number, err := strconv.Atoi(strings.TrimSuffix(value, ".m4s"))
+	if !found || err != nil || !strings.HasSuffix(value, ".m4s") {
+		return nil, false
+	}
+	for _, segment := range l.segments {
+		if segment.number == number {
+			return segment.data, true
+		}
+	}
+	return nil, false
+}
+
+// liveTrack is the sink of a track packaged by a live stream.
+type liveTrack struct {
+	stream    *LiveStream
+	track     *forward.Track
+	video     bool
+	timescale uint32
+	jitter    *jitterBuffer
+	assembler *assembler
+	clock     clock
+	// size of the video (zero until the first keyframe)
+	width  int
+	height int
+	// id of the track in the current period (zero when not in the period)
+	id uint32
+	// a keyframe has been packaged in the current period
+	keyframed bool
+	pending   *liveSample
+	// samples of the current segment and the decode time of the first one
+	samples       []mp4Sample
+	fragmentStart uint64
+	lastDuration  uint32
+	// latest time a keyframe has been requested
+	keyframeRequestedAt time.Time
+	// the stream queue overflowed since the latest packet
+	dropping bool
+}
+
+// add the pending frame to the current segment.
+func (t *liveTrack) finishSample(duration uint32) {
+	if len(t.samples) == 0 {
+		t.fragmentStart = t.pending.decodeTime
+	}
+	t.pending.duration = duration
+	t.samples = append(t.samples, t.pending.mp4Sample)
+	t.lastDuration = duration
+	t.pending = nil
+}
+
+// the position of the decode time on the stream timeline.
+func (t *liveTrack) position(decodeTime uint64) time.Duration {
+	return time.Duration(float64(decodeTime) / float64(t.timescale) * float64(time.Second))
+}
+
+func (t *liveTrack) WritePacket(header *rtp.Header, packet *forward.Packet) {
+	packet.Retain()
+	event := liveEvent{kind: muxEventPacket, track: t, header: *header, packet: packet, time: time.Now()}
+	if t.stream.send(event, false) {
+		t.dropping = false
+		return
+	}
+
+	packet.Release()
+	if !t.dropping {
+		log.Printf("[live] dropping packets of %s track %s", t.track.Kind().String(), t.track.ID())
+		t.dropping = true
+	}
+}
+
+func (t *liveTrack) WriteSenderReport(ntpTime time.Time, rtpTime uint32) {
+	t.stream.send(liveEvent{kind: muxEventSenderReport, track: t, time: ntpTime, rtpTime: rtpTime}, false)
+}
+
+// the track is closed (or removed); the stream continues with the rest of
+// the tracks.
+func (t *liveTrack) Close() error {
+	t.stream.send(liveEvent{kind: muxEventRemove, track: t, time: time.Now()}, true)
+	return nil
+}
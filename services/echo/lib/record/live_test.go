@@ -0,0 +1,145 @@
+package record
+
+import (
+	"echo/lib/forward"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// send a packet of a live track received `at` after the start of the stream.
+func sendLivePacket(t *testing.T, l *LiveStream, track *forward.Track, start time.Time, at time.Duration, header rtp.Header, payload []byte) {
+	t.Helper()
+	raw, err := (&rtp.Packet{Header: header, Payload: payload}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := forward.NewPacket()
+	n := copy(packet.Buffer(), raw)
+	if err := packet.Unmarshal(n); err != nil {
+		t.Fatal(err)
+	}
+
+	l.mu.RLock()
+	sink := l.sinks[track]
+	l.mu.RUnlock()
+	l.send(liveEvent{kind: muxEventPacket, track: sink, header: packet.Header, packet: packet, time: start.Add(at)}, true)
+}
+
+// stream 20 seconds of a vp8 track (10 frames per second, a keyframe every
+// second) and an opus track (20ms frames) in segments of 2 seconds.
+func TestLiveStream(t *testing.T) {
+	const (
+		duration      = 20 * time.Second
+		videoInterval = 100 * time.Millisecond
+		audioInterval = 20 * time.Millisecond
+		keyframeEvery = time.Second
+	)
+
+	l := NewLiveStream(2 * time.Second)
+	vp8 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}
+	video := forward.NewTrack(vp8, "video", "stream", forward.SourceCamera)
+	audio := forward.NewTrack(opus, "audio", "stream", forward.SourceMicrophone)
+	for _, track := range []*forward.Track{video, audio} {
+		if err := l.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	videoSeq, audioSeq := uint16(0), uint16(0)
+	for at := time.Duration(0); at < duration; at += audioInterval {
+		if at%videoInterval == 0 {
+			payload := []byte{0x10, 0x01, 0x00, 0x00}
+			if at%keyframeEvery == 0 {
+				payload = []byte{0x10, 0x00, 0x00, 0x00, 0x9D, 0x01, 0x2A, 0x40, 0x01, 0xF0, 0x00}
+			}
+			header := rtp.Header{
+				Version:        2,
+				SequenceNumber: videoSeq,
+				Timestamp:      uint32(at * 90 / time.Millisecond),
+				Marker:         true,
+				SSRC:           1,
+			}
+			sendLivePacket(t, l, video, start, at, header, payload)
+			videoSeq++
+		}
+
+		header := rtp.Header{
+			Version:        2,
+			SequenceNumber: audioSeq,
+			Timestamp:      uint32(at * 48 / time.Millisecond),
+			SSRC:           2,
+		}
+		sendLivePacket(t, l, audio, start, at, header, []byte{0xFC, 0xAA, 0xBB})
+		audioSeq++
+	}
+	l.Close()
+
+	// 10 segments of 2 seconds starting with a keyframe; the playlist lists
+	// the latest 6 and the target duration fits the longest segments
+	// allowed (twice the configured duration)
+	var expected strings.Builder
+	expected.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n")
+	expected.WriteString("#EXT-X-MEDIA-SEQUENCE:5\n#EXT-X-DISCONTINUITY-SEQUENCE:0\n")
+	expected.WriteString("#EXT-X-MAP:URI=\"init-1.mp4\"\n")
+	for number := 5; number <= 10; number++ {
+		fmt.Fprintf(&expected, "#EXTINF:2.000,\nsegment-%d.m4s\n", number)
+	}
+	expected.WriteString("#EXT-X-ENDLIST\n")
+	if playlist := l.Playlist(); playlist != expected.String() {
+		t.Fatalf("unexpected playlist:\n%s", playlist)
+	}
+
+	// the segments that left the playlist are kept for a while
+	if _, ok := l.File("segment-1.m4s"); ok {
+		t.Fatal("the first segment is still available")
+	}
+	if _, ok := l.File("init-1.mp4"); !ok {
+		t.Fatal("the init segment is not available")
+	}
+
+	// the decode times of every track follow the sample durations of the
+	// previous segments
+	next := map[uint32]uint64{}
+	for number := 2; number <= 10; number++ {
+		segment, ok := l.File(fmt.Sprintf("segment-%d.m4s", number))
+		if !ok {
+			t.Fatalf("segment %d is not available", number)
+		}
+
+		boxes := parseMP4(t, segment, 0, int64(len(segment)))
+		if len(boxes) != 2 || boxes[0].boxType != "moof" || boxes[1].boxType != "mdat" {
+			t.Fatalf("segment %d: expected the moof and mdat boxes", number)
+		}
+		for _, traf := range boxes[0].all("traf") {
+			track, decodeTime, _, samples := parseTrackFragment(t, segment, traf)
+			if end, ok := next[track]; ok && decodeTime != end {
+				t.Fatalf("segment %d track %d: decode time %d, expected %d", number, track, decodeTime, end)
+			}
+
+			sampleDuration := uint32(960)
+			if track == 1 {
+				sampleDuration = 9000
+				if !samples[0].keyframe {
+					t.Fatalf("segment %d doesn't start with a keyframe", number)
+				}
+				if len(samples) != 20 {
+					t.Fatalf("segment %d: %d video samples, expected 20", number, len(samples))
+				}
+			}
+			for _, sample := range samples {
+				if sample.duration != sampleDuration {
+					t.Fatalf("segment %d track %d: sample duration %d, expected %d", number, track, sample.duration, sampleDuration)
+				}
+				decodeTime += uint64(sample.duration)
+			}
+			next[track] = decodeTime
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package record
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// name of the manifest written next to the media files of a recording
+const ManifestName = "manifest.json"
+
+// Manifest describes a recording: its media files and the timeline of the
+// session events. The manifest is written next to the media files and kept
+// up to date while recording; the files are listed once they are finalized.
+type Manifest struct {
+	Session string `json:"session"`
+	// time the recording started and stopped (nil while recording)
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+	// the media files are encrypted with the data key of the key file (see
+	// Sidecar)
+	Encrypted bool `json:"encrypted,omitempty"`
+	// the upload of the recording (if the files are uploaded to a storage);
+	// uploaded once the manifest itself has been uploaded
+	Upload   UploadState    `json:"upload,omitempty"`
+	Files    []ManifestFile `json:"files"`
+	Timeline []Event        `json:"timeline"`
+}
+
+type ManifestFile struct {
+	// path of the file relative to the manifest
+	Path   string          `json:"path"`
+	Member int             `json:"member"`
+	Tracks []ManifestTrack `json:"tracks"`
+	Size   int64           `json:"size"`
+	// set once the file is uploaded to the storage (if any)
+	Sha256 string      `json:"sha256,omitempty"`
+	Upload UploadState `json:"upload,omitempty"`
+}
+
+// a track written to a media file along with the wall clock time and the RTP
+// timestamp (of the recorded stream) of its first and last frames.
+type ManifestTrack struct {
+	Id       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Source   string    `json:"source"`
+	Codec    string    `json:"codec"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	StartRtp uint32    `json:"startRtp"`
+	EndRtp   uint32    `json:"endRtp"`
+}
+
+type EventType string
+
+const (
+	EventJoined EventType = "joined"
+	EventLeft   EventType = "left"
+	// the member turned its microphone, camera or screen share on or off
+	EventAudio       EventType = "audio"
+	EventVideo       EventType = "video"
+	EventScreenShare EventType = "screen-share"
+	// the recording has been paused or resumed
+	EventPaused  EventType = "paused"
+	EventResumed EventType = "resumed"
+)
+
+// an event of the session timeline.
+type Event struct {
+	Type    EventType `json:"type"`
+	Member  *int      `json:"member,omitempty"`
+	Enabled *bool     `json:"enabled,omitempty"`
+	Time    time.Time `json:"time"`
+	// time since the start of the recording excluding the paused time (ms)
+	Offset int64 `json:"offset"`
+}
+
+// an event of a member (e.g. joined or left the session).
+func MemberEvent(eventType EventType, member int) Event {
+	return Event{Type: eventType, Member: &member, Time: time.Now()}
+}
+
+// a member turned something (e.g. its microphone) on or off.
+func ToggleEvent(eventType EventType, member int, enabled bool) Event {
+	return Event{Type: eventType, Member: &member, Enabled: &enabled, Time: time.Now()}
+}
+
+// keeps the manifest of a recording and writes it (atomically) every time it
+// changes.
+type manifestWriter struct {
+	mu        sync.Mutex
+	dir       string
+	manifest  Manifest
+	pausedAt  time.Time
+	pausedFor time.Duration
+	// called with the path of every finalized file (e.g. to upload it)
+	onFile func(path string)
+}
+
+func newManifestWriter(dir string, session string, start time.Time, encrypted bool) *manifestWriter {
+	return &manifestWriter{
+		dir: dir,
+		manifest: Manifest{
+			Session:   session,
+			Start:     start,
+			Encrypted: encrypted,
+			Files:     []ManifestFile{},
+			Timeline:  []Event{},
+		},
+	}
+}
+
+func (w *manifestWriter) addEvent(event Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch event.Type {
+	case EventPaused:
+		w.pausedAt = event.Time
+	case EventResumed:
+		if !w.pausedAt.IsZero() {
+			w.pausedFor += event.Time.Sub(w.pausedAt)
+			w.pausedAt = time.Time{}
+		}
+	}
+
+	paused := w.pausedFor
+	if !w.pausedAt.IsZero() {
+		paused += event.Time.Sub(w.pausedAt)
+	}
+	event.Offset = max(event.Time.Sub(w.manifest.Start)-paused, 0).Milliseconds()
+
+	w.manifest.Timeline = append(w.manifest.Timeline, event)
+	w.save()
+}
+
+// add a finalized media file.
+func (w *manifestWriter) setFile(file ManifestFile) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	path := file.Path
+	if info, err := os.Stat(path); err == nil {
+		file.Size = info.Size()
+	}
+	file.Path = w.relative(path)
+	if w.onFile != nil {
+		file.Upload = UploadPending
+	}
+
+	index := slices.IndexFunc(w.manifest.Files, func(f ManifestFile) bool {
+		return f.Path == file.Path
+	})
+	if index < 0 {
+		w.manifest.Files = append(w.manifest.Files, file)
+	} else {
+		w.manifest.Files[index] = file
+	}
+	w.save()
+
+	if w.onFile != nil {
+		w.onFile(path)
+	}
+}
+
+// change a media file of the manifest.
+func (w *manifestWriter) updateFile(path string, update func(file *ManifestFile)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	path = w.relative(path)
+	index := slices.IndexFunc(w.manifest.Files, func(f ManifestFile) bool {
+		return f.Path == path
+	})
+	if index >= 0 {
+		update(&w.manifest.Files[index])
+		w.save()
+	}
+}
+
+// whether the upload of some media files failed.
+func (w *manifestWriter) hasFailedFiles() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return slices.ContainsFunc(w.manifest.Files, func(f ManifestFile) bool {
+		return f.Upload == UploadFailed
+	})
+}
+
+// the path relative to the manifest.
+func (w *manifestWriter) relative(path string) string {
+	relative, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(relative)
+}
+
+// set the upload state of the recording.
+func (w *manifestWriter) setUpload(state UploadState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.manifest.Upload = state
+	w.save()
+}
+
+func (w *manifestWriter) close(end time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.manifest.End = &end
+	w.save()
+}
+
+// replace the manifest file; a crash never leaves a partially written
+// manifest.
+func (w *manifestWriter) save() {
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		log.Println("[record]", err)
+		return
+	}
+
+	if err := os.MkdirAll(w.dir, 0o755); err != nil {
+		log.Println("[record]", err)
+		return
+	}
+
+	path := filepath.Join(w.dir, ManifestName)
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o644); err != nil {
+		log.Println("[record]", err)
+		return
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		log.Println("[record]", err)
+	}
+}
+
+// the first and last frames of a track written to a file.
+type trackSpan struct {
+	started  bool
+	start    time.Time
+	end      time.Time
+	startRtp uint32
+	endRtp   uint32
+}
+
+func (s *trackSpan) add(wallclock time.Time, timestamp uint32) {
+	if !s.started {
+		s.started = true
+		s.start = wallclock
+		s.startRtp = timestamp
+	}
+	s.end = wallclock
+	s.endRtp = timestamp
+}
+
+func (s *trackSpan) apply(track *ManifestTrack) {
+	track.Start = s.start
+	track.End = s.end
+	track.StartRtp = s.startRtp
+	track.EndRtp = s.endRtp
+}
@@ -0,0 +1,586 @@
+package record
+
+import (
+	"echo/lib/forward"
+	"echo/lib/utils"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// the frames are written once they are older than the newest frame by
+	// this delay so that the frames of the tracks can be interleaved in order
+	interleaveDelay = 500 * time.Millisecond
+	// the file header needs the size of the video; the frames wait for the
+	// first video keyframe at most this long
+	headerTimeout = 5 * time.Second
+	// size used when the video size cannot be found
+	defaultWidth  = 640
+	defaultHeight = 480
+	// minimum time between the keyframe requests of a track waiting for a
+	// keyframe
+	keyframeInterval = time.Second
+)
+
+// whether the codec can be written to a webm file.
+func canMux(codec webrtc.RTPCodecCapability) bool {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus), strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9):
+		return true
+	}
+	return false
+}
+
+func webmCodecID(codec webrtc.RTPCodecCapability) string {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return "A_OPUS"
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return "V_VP8"
+	}
+	return "V_VP9"
+}
+
+// muxer writes the audio and video tracks of a member (e.g. its microphone
+// and camera) to a single webm file. The tracks clocks are aligned using the
+// sender reports of the publisher; until the first report of a track is
+// received, the arrival time of its packets is used instead.
+//
+// The packets of every track go through a jitter buffer; the lost packets
+// are concealed (see assembler) and the video waits for the next keyframe
+// which is requested from the publisher.
+//
+// The tracks are written in segments (`<path>-00001.webm` and so on) of
+// the configured duration; every segment starts with a keyframe of each
+// video track so that it can be played on its own. A new segment is started
+// as well when a track is added to the member as the tracks of a webm file
+// are fixed.
+type muxer struct {
+	path     string
+	member   int
+	segment  time.Duration
+	manifest *manifestWriter
+	// nil unless the segments are encrypted
+	encryption *encryption
+
+	mu     sync.RWMutex
+	closed bool
+	events chan muxEvent
+	done   chan struct{}
+
+	// owned by the run loop
+	tracks []*muxTrack
+	file   *webmWriter
+	// path and tracks of the current file
+	filePath   string
+	fileTracks []*muxTrack
+	segments   int
+	start      time.Time
+	pending    []pendingFrame
+	// time of the newest assembled frame
+	latest    time.Time
+	pausedAt  time.Time
+	pausedFor time.Duration
+	// difference between the server clock and the publisher clock (of the
+	// sender reports)
+	clockOffset time.Duration
+	synced      bool
+}
+
+type muxEventKind int
+
+const (
+	muxEventPacket muxEventKind = iota
+	muxEventSenderReport
+	muxEventAdd
+	muxEventRemove
+	muxEventPause
+	muxEventResume
+)
+
+type muxEvent struct {
+	kind   muxEventKind
+	track  *muxTrack
+	header rtp.Header
+	packet *forward.Packet
+	// arrival time of the packet, pause and resume time or the wall clock
+	// time of the sender report
+	time    time.Time
+	rtpTime uint32
+}
+
+type pendingFrame struct {
+	track *muxTrack
+	frame frame
+	// wall clock time of the frame
+	wallclock time.Time
+	// wall clock time of the frame excluding the paused time
+	at time.Time
+}
+
+func newMuxer(path string, member int, segment time.Duration, manifest *manifestWriter, encryption *encryption) *muxer {
+	m := &muxer{
+		path:       path,
+		member:     member,
+		segment:    segment,
+		manifest:   manifest,
+		encryption: encryption,
+		events:     make(chan muxEvent, queueSize),
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		m.run()
+	}()
+
+	return m
+}
+
+// add a track of the member; the returned sink should be added to the track.
+func (m *muxer) addTrack(track *forward.Track) *muxTrack {
+	muxTrack := &muxTrack{
+		muxer:     m,
+		track:     track,
+		jitter:    newJitterBuffer(track.Codec()),
+		assembler: newAssembler(track.Codec()),
+		clock:     clock{rate: track.Codec().ClockRate},
+	}
+	m.send(muxEvent{kind: muxEventAdd, track: muxTrack}, true)
+	return muxTrack
+}
+
+func (m *muxer) pause() {
+	m.send(muxEvent{kind: muxEventPause, time: time.Now()}, true)
+}
+
+func (m *muxer) resume() {
+	m.send(muxEvent{kind: muxEventResume, time: time.Now()}, true)
+}
+
+// send an event to the run loop. Returns false in case the event has been
+// dropped (the muxer is closed or, unless `block`, it cannot keep up).
+func (m *muxer) send(event muxEvent, block bool) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return false
+	}
+	if block {
+		m.events <- event
+		return true
+	}
+
+	select {
+	case m.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// write the pending frames and finalize the file.
+func (m *muxer) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.events)
+	m.mu.Unlock()
+
+	<-m.done
+}
+
+func (m *muxer) run() {
+	defer close(m.done)
+	for event := range m.events {
+		switch event.kind {
+		case muxEventPacket:
+			m.onPacket(event)
+		case muxEventSenderReport:
+			event.track.clock.setSenderReport(event.time, event.rtpTime)
+		case muxEventAdd:
+			m.onAdd(event.track)
+		case muxEventRemove:
+			m.onRemove(event.track)
+		case muxEventPause:
+			m.pausedAt = event.time
+		case muxEventResume:
+			if !m.pausedAt.IsZero() {
+				m.pausedFor += event.time.Sub(m.pausedAt)
+				m.pausedAt = time.Time{}
+			}
+			// the paused sinks continue their timestamps right after the
+			// pause; the clocks are mapped again from the next packets
+			for _, track := range m.tracks {
+				track.clock.reset()
+			}
+		}
+	}
+
+	for _, track := range m.tracks {
+		m.drain(track)
+	}
+	m.closeFile()
+}
+
+func (m *muxer) onPacket(event muxEvent) {
+	track := event.track
+	if !slices.Contains(m.tracks, track) {
+		event.packet.Release()
+		return
+	}
+
+	track.jitter.push(&event.header, event.packet, event.time)
+	for {
+		buffered, ok := track.jitter.pop(event.time)
+		if !ok {
+			break
+		}
+		m.assemble(track, buffered)
+	}
+
+	// the next segment starts with a keyframe
+	waiting := track.assembler.waitKeyframe || (track.assembler.video && m.segmentDue())
+	if waiting && event.time.Sub(track.keyframeRequestedAt) > keyframeInterval {
+		track.keyframeRequestedAt = event.time
+		track.track.RequestKeyframe()
+	}
+	m.flush(false)
+}
+
+// rebuild the frames of the track from the next packet in order.
+func (m *muxer) assemble(track *muxTrack, buffered bufferedPacket) {
+	defer buffered.packet.Release()
+
+	for _, frame := range track.assembler.push(&buffered.header, buffered.packet.Payload) {
+		if track.assembler.video && frame.keyframe && track.width == 0 {
+			if width, height, ok := frameSize(track.assembler.mimeType, frame.data); ok {
+				track.width, track.height = width, height
+			}
+		}
+
+		at, reported := track.clock.time(frame.timestamp, buffered.arrival)
+		if reported {
+			// the publisher clock is translated to the server clock once
+			if !m.synced {
+				m.clockOffset = buffered.arrival.Sub(at)
+				m.synced = true
+			}
+			at = at.Add(m.clockOffset)
+		}
+		m.pending = append(m.pending, pendingFrame{
+			track:     track,
+			frame:     frame,
+			wallclock: at,
+			at:        at.Add(-m.pausedFor),
+		})
+	}
+}
+
+// write the packets left in the jitter buffer of the track.
+func (m *muxer) drain(track *muxTrack) {
+	track.jitter.drain(func(buffered bufferedPacket) {
+		m.assemble(track, buffered)
+	})
+}
+
+func (m *muxer) onAdd(track *muxTrack) {
+	// the tracks of a webm file cannot change; the video of the new file
+	// starts with a keyframe
+	if m.file != nil {
+		m.closeFile()
+		for _, track := range m.tracks {
+			track.assembler.waitKeyframe = track.assembler.video
+		}
+	}
+	m.tracks = append(m.tracks, track)
+}
+
+func (m *muxer) onRemove(track *muxTrack) {
+	if !slices.Contains(m.tracks, track) {
+		return
+	}
+
+	// the remaining frames of the track are still written
+	m.drain(track)
+	if len(m.tracks) == 1 {
+		m.closeFile()
+	}
+	m.tracks = slices.DeleteFunc(m.tracks, func(t *muxTrack) bool {
+		return t == track
+	})
+}
+
+// write the pending frames older than the interleave delay (or all of them).
+func (m *muxer) flush(all bool) {
+	slices.SortStableFunc(m.pending, func(a, b pendingFrame) int {
+		return a.at.Compare(b.at)
+	})
+	if len(m.pending) == 0 {
+		return
+	}
+
+	newest := m.pending[len(m.pending)-1].at
+	m.latest = newest
+	if m.file == nil && !m.openFile(all || newest.Sub(m.pending[0].at) > headerTimeout, m.pending[0]) {
+		return
+	}
+
+	written := 0
+	for _, pending := range m.pending {
+		if !all && newest.Sub(pending.at) < interleaveDelay {
+			break
+		}
+		if m.segmentEnded(pending) {
+			m.finishFile()
+			if !m.openFile(true, pending) {
+				// the pending frames have been dropped
+				return
+			}
+		}
+		m.writeFrame(pending)
+		written++
+	}
+	clear(m.pending[:written])
+	m.pending = slices.Delete(m.pending, 0, written)
+}
+
+// whether the current segment is long enough; the next segment waits for a
+// keyframe.
+func (m *muxer) segmentDue() bool {
+	return m.segment > 0 && m.file != nil && m.latest.Sub(m.start) >= m.segment
+}
+
+// whether the current segment ends before the frame. The segments start
+// with a keyframe of the first video track (or any frame of the audio only
+// files).
+func (m *muxer) segmentEnded(pending pendingFrame) bool {
+	if len(m.fileTracks) == 0 {
+		return false
+	}
+	first := m.fileTracks[0]
+	for _, track := range m.fileTracks {
+		if track.assembler.video {
+			first = track
+			break
+		}
+	}
+	keyframe := pending.track == first && pending.frame.keyframe
+	return segmentEnded(m.segment, pending.at.Sub(m.start), keyframe)
+}
+
+// open a new segment with the current tracks starting with the frame once
+// the size of the video tracks is known (unless `force`). Returns false in
+// case the file is not opened yet.
+func (m *muxer) openFile(force bool, first pendingFrame) bool {
+	if len(m.tracks) == 0 {
+		m.pending = m.pending[:0]
+		return false
+	}
+
+	tracks := []webmTrack{}
+	for i, track := range m.tracks {
+		codec := track.track.Codec()
+		webmTrack := webmTrack{
+			number:  uint64(i + 1),
+			video:   track.assembler.video,
+			codecID: webmCodecID(codec),
+		}
+
+		if webmTrack.video {
+			if track.width == 0 && !force {
+				return false
+			}
+			webmTrack.width, webmTrack.height = track.width, track.height
+			if track.width == 0 {
+				webmTrack.width, webmTrack.height = defaultWidth, defaultHeight
+			}
+		} else {
+			webmTrack.channels = opusChannels(codec)
+			webmTrack.sampleRate = int(codec.ClockRate)
+			webmTrack.codecPrivate = opusHead(webmTrack.channels, webmTrack.sampleRate)
+		}
+
+		track.number = webmTrack.number
+		tracks = append(tracks, webmTrack)
+	}
+
+	path := segmentPath(m.path, m.segments+1, ".webm")
+	file, err := newWebmWriter(path+partialSuffix, tracks, first.wallclock)
+	if err != nil {
+		log.Println("[record]", err)
+		clear(m.pending)
+		m.pending = m.pending[:0]
+		return false
+	}
+
+	m.file = file
+	m.filePath = path
+	m.fileTracks = slices.Clone(m.tracks)
+	m.segments++
+	m.start = first.at
+	log.Printf("recording %d tracks to %s", len(tracks), path)
+	return true
+}
+
+func (m *muxer) writeFrame(pending pendingFrame) {
+	track := pending.track
+	if track.number == 0 {
+		// the track has been added after the file started
+		return
+	}
+	if track.assembler.video && !track.keyframed {
+		// the video of every segment starts with a keyframe
+		if !pending.frame.keyframe {
+			track.assembler.waitKeyframe = true
+			return
+		}
+		track.keyframed = true
+	}
+
+	// the tracks clocks might be corrected by a sender report; a track never
+	// goes backwards
+	timecode := max(pending.at.Sub(m.start).Milliseconds(), track.lastTimecode, 0)
+	track.lastTimecode = timecode
+
+	if err := m.file.writeFrame(track.number, timecode, pending.frame.keyframe, pending.frame.data); err != nil {
+		log.Println("[record]", err)
+		return
+	}
+	track.span.add(pending.wallclock, pending.frame.timestamp)
+}
+
+// the manifest entry of the current file.
+func (m *muxer) manifestFile() ManifestFile {
+	tracks := []ManifestTrack{}
+	for _, track := range m.fileTracks {
+		entry := manifestTrack(track.track)
+		track.span.apply(&entry)
+		tracks = append(tracks, entry)
+	}
+	return ManifestFile{Path: m.filePath, Member: m.member, Tracks: tracks}
+}
+
+// write the pending frames and finalize the current segment.
+func (m *muxer) closeFile() {
+	m.flush(true)
+	m.finishFile()
+}
+
+// finalize the current segment and add it to the manifest.
+func (m *muxer) finishFile() {
+	if m.file == nil {
+		return
+	}
+
+	err := m.file.Close()
+	if err == nil {
+		m.filePath, err = commit(m.filePath, m.encryption)
+	}
+	if err != nil {
+		log.Println("[record]", err)
+	} else {
+		m.manifest.setFile(m.manifestFile())
+	}
+
+	m.file = nil
+	for _, track := range m.fileTracks {
+		track.number = 0
+		track.lastTimecode = 0
+		track.keyframed = false
+		track.span = trackSpan{}
+	}
+	m.fileTracks = nil
+}
+
+// muxTrack is the sink of a track written by a muxer.
+type muxTrack struct {
+	muxer     *muxer
+	track     *forward.Track
+	jitter    *jitterBuffer
+	assembler *assembler
+	clock     clock
+	// size of the video (zero until the first keyframe)
+	width  int
+	height int
+	// number of the track in the current file (zero when not in the file)
+	number       uint64
+	lastTimecode int64
+	// a keyframe has been written to the current file
+	keyframed bool
+	// first and last frames written to the current file
+	span trackSpan
+	// latest time a keyframe has been requested
+	keyframeRequestedAt time.Time
+	// the muxer queue overflowed since the latest packet
+	dropping bool
+}
+
+func (t *muxTrack) WritePacket(header *rtp.Header, packet *forward.Packet) {
+	packet.Retain()
+	event := muxEvent{kind: muxEventPacket, track: t, header: *header, packet: packet, time: time.Now()}
+	if t.muxer.send(event, false) {
+		t.dropping = false
+		return
+	}
+
+	packet.Release()
+	if !t.dropping {
+		log.Printf("[record] dropping packets of %s", t.muxer.path)
+		t.dropping = true
+	}
+}
+
+func (t *muxTrack) WriteSenderReport(ntpTime time.Time, rtpTime uint32) {
+	t.muxer.send(muxEvent{kind: muxEventSenderReport, track: t, time: ntpTime, rtpTime: rtpTime}, false)
+}
+
+// the track is closed; the muxer continues with the rest of the tracks.
+func (t *muxTrack) Close() error {
+	t.muxer.send(muxEvent{kind: muxEventRemove, track: t}, true)
+	return nil
+}
+
+// clock maps the RTP timestamps of a track to the wall clock.
+type clock struct {
+	rate uint32
+	// a reference RTP timestamp and its wall clock time
+	rtpTime   uint32
+	reference time.Time
+	// the reference comes from a sender report (publisher clock)
+	reported bool
+}
+
+func (c *clock) setSenderReport(ntpTime time.Time, rtpTime uint32) {
+	c.rtpTime = rtpTime
+	c.reference = ntpTime
+	c.reported = true
+}
+
+func (c *clock) reset() {
+	*c = clock{rate: c.rate}
+}
+
+// the wall clock time of the timestamp and whether it is in the publisher
+// clock. `arrival` is the arrival time of the packet which is used as the
+// reference until the first sender report.
+func (c *clock) time(timestamp uint32, arrival time.Time) (time.Time, bool) {
+	if c.reference.IsZero() {
+		c.rtpTime = timestamp
+		c.reference = arrival
+	}
+
+	elapsed := time.Duration(int32(timestamp-c.rtpTime)) * time.Second / time.Duration(c.rate)
+	return c.reference.Add(elapsed), c.reported
+}
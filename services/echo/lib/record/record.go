@@ -1,78 +1,529 @@
 package record
 
 import (
+	"echo/lib/forward"
 	"echo/lib/utils"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
 	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
 	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
 )
 
-func GetWriter(codec webrtc.RTPCodecParameters) media.Writer {
-	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
-		log.Println("got Opus track, saving to disk as output.opus (48 kHz, 2 channels)")
-		ogg, err := NewOggWritter()
-		if err != nil {
-			log.Println("ogg record error:", err)
+var ErrUnsupportedCodec = errors.New("codec cannot be recorded")
+
+// maximum number of packets waiting to be written to the disk per track; the
+// packets are dropped when the disk can't keep up.
+const queueSize = 512
+
+// Status of the recording of a session.
+type Status string
+
+const (
+	StatusStopped   Status = "stopped"
+	StatusRecording Status = "recording"
+	StatusPaused    Status = "paused"
+)
+
+func (s Status) IsValid() bool {
+	return s == StatusStopped || s == StatusRecording || s == StatusPaused
+}
+
+// Recording writes the tracks published in a session to a directory named by
+// the session and the recording start time. The audio and video of every
+// member are written to webm files per group of sources (e.g.
+// `<dir>/<session>/<start>/<member>/media-00001.webm` for the microphone and
+// the camera). The tracks that cannot be written to webm files (e.g. h264)
+// are recorded to their own files named by the source and track id (e.g.
+// `<dir>/<session>/<start>/<member>/camera-<track>-00001.h264`).
+//
+// The files are written in segments of the given duration. A segment is
+// written to a `.part` file which is renamed once it is finalized and listed
+// in the manifest (see Manifest) along with the session events; a crash
+// loses the current segments only.
+//
+// The finalized files are encrypted when a master key is given: every
+// recording has its own data key, stored wrapped with the master key in the
+// key file next to the manifest (see Sidecar), and the segments are
+// encrypted (`media-00001.webm.enc`) once finalized. The segment being
+// written is in plaintext (the writers go back to complete the headers of
+// the files) so the segment duration bounds the media exposed on the disk;
+// the segments left unfinished by a crash are removed at startup (see
+// RemovePartialFiles). The manifest stays in plaintext on purpose: it holds
+// no media and is read to list, upload and expire the recordings without
+// the master key.
+//
+// The finalized files are uploaded to the storage (if any) and deleted from
+// the directory once uploaded (see uploader).
+type Recording struct {
+	mu      sync.Mutex
+	dir     string
+	segment time.Duration
+	// sinks of the recorded tracks
+	tracks   map[*forward.Track]forward.Sink
+	muxers   map[muxerKey]*muxer
+	manifest *manifestWriter
+	// nil unless the files are encrypted
+	encryption *encryption
+	// nil unless the files are uploaded to a storage
+	uploader *uploader
+	paused   bool
+	closed   bool
+}
+
+// Options of a recording.
+type Options struct {
+	// directory of the recordings
+	Directory string
+	// duration of the recorded files (zero writes a single file per track)
+	SegmentDuration time.Duration
+	// storage the finalized files are uploaded to; nil keeps them in the
+	// directory
+	Storage Storage
+	// key (32 bytes) the data keys of the recordings are wrapped with; nil
+	// keeps the files unencrypted
+	MasterKey []byte
+}
+
+type muxerKey struct {
+	member int
+	group  string
+}
+
+func NewRecording(session string, options Options) (*Recording, error) {
+	start := time.Now().UTC()
+	dir := filepath.Join(options.Directory, fileName(session), start.Format(idFormat))
+
+	var encryption *encryption
+	if options.MasterKey != nil {
+		var err error
+		if encryption, err = newEncryption(options.MasterKey, dir); err != nil {
+			return nil, err
 		}
-		return ogg
 	}
 
-	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
-		log.Println("got VP8 track, saving to disk as output.ivf")
-		ivf, err := NewIvfWritter()
-		if err != nil {
-			log.Println("ivf record error:", err)
+	manifest := newManifestWriter(dir, session, start, encryption != nil)
+
+	var uploader *uploader
+	if options.Storage != nil {
+		uploader = newUploader(options.Storage, options.Directory, manifest)
+		manifest.onFile = uploader.add
+	}
+	manifest.save()
+	setOpen(dir, true)
+
+	return &Recording{
+		dir:        dir,
+		segment:    options.SegmentDuration,
+		tracks:     map[*forward.Track]forward.Sink{},
+		muxers:     map[muxerKey]*muxer{},
+		manifest:   manifest,
+		encryption: encryption,
+		uploader:   uploader,
+	}, nil
+}
+
+// the screen is recorded apart from the camera and the microphone.
+func group(source forward.Source) string {
+	if source == forward.SourceScreen || source == forward.SourceScreenAudio {
+		return "screen"
+	}
+	return "media"
+}
+
+// start recording a track published by the member. The file is finalized
+// once the track is closed. Tracks added to a paused recording are recorded
+// once the recording is resumed.
+func (r *Recording) AddTrack(member int, track *forward.Track) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.tracks[track] != nil {
+		return nil
+	}
+
+	dir := filepath.Join(r.dir, fmt.Sprint(member))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	if canMux(track.Codec()) {
+		key := muxerKey{member: member, group: group(track.Source())}
+		muxer := r.muxers[key]
+		if muxer == nil {
+			muxer = newMuxer(filepath.Join(dir, key.group), member, r.segment, r.manifest, r.encryption)
+			r.muxers[key] = muxer
 		}
-		return ivf
+
+		sink := muxer.addTrack(track)
+		r.tracks[track] = sink
+		track.AddSink(sink, r.paused)
+		log.Printf("recording %s track %s of %d to %s", track.Kind().String(), track.ID(), member, muxer.path)
+		return nil
+	}
+
+	// a member can publish a new track with the same id (e.g. after
+	// reconnecting with another codec); never overwrite a recording
+	base := filepath.Join(dir, fileName(string(track.Source())+"-"+track.ID()))
+	path := base
+	for i := 1; exists(path); i++ {
+		path = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	recorder, err := newTrackRecorder(path, track, member, r.segment, r.manifest, r.encryption)
+	if err != nil {
+		return err
 	}
 
+	r.tracks[track] = recorder
+	track.AddSink(recorder, r.paused)
+	log.Printf("recording %s track %s of %d to %s", track.Kind().String(), track.ID(), member, path)
 	return nil
 }
 
-func SavePacketToDisk(writer media.Writer, packet *rtp.Packet) {
-	if writer == nil {
-		log.Println("record: writer is nil!")
+// stop writing the tracks until the recording is resumed. The paused part of
+// the session is left out of the recording.
+func (r *Recording) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
 		return
 	}
-	if err := writer.WriteRTP(packet); err != nil {
-		log.Println(err)
+	r.paused = true
+	r.manifest.addEvent(Event{Type: EventPaused, Time: time.Now()})
+	for track, sink := range r.tracks {
+		track.SetSinkPaused(sink, true)
+	}
+	for _, muxer := range r.muxers {
+		muxer.pause()
+	}
+}
+
+func (r *Recording) Resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
 		return
 	}
+	r.paused = false
+	r.manifest.addEvent(Event{Type: EventResumed, Time: time.Now()})
+	for _, muxer := range r.muxers {
+		muxer.resume()
+	}
+	for track, sink := range r.tracks {
+		track.SetSinkPaused(sink, false)
+	}
 }
 
-func SaveToDisk(writer media.Writer, track *webrtc.TrackRemote) {
-	defer func() {
-		if err := writer.Close(); err != nil {
-			log.Println("remote error:", err)
+func (r *Recording) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return StatusStopped
+	}
+	if r.paused {
+		return StatusPaused
+	}
+	return StatusRecording
+}
+
+// the uploads of the recording; false in case the files are not uploaded.
+func (r *Recording) Upload() (UploadStatus, bool) {
+	if r.uploader == nil {
+		return UploadStatus{}, false
+	}
+	return r.uploader.progress(), true
+}
+
+// stop recording all of the tracks. The files are still being uploaded
+// once the recording is closed (see Upload).
+func (r *Recording) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+
+	for track, sink := range r.tracks {
+		track.RemoveSink(sink)
+		if recorder, ok := sink.(*trackRecorder); ok {
+			if err := recorder.Close(); err != nil {
+				log.Printf("unable to close recording %s: %s", recorder.base, err)
+			}
 		}
+	}
+	for _, muxer := range r.muxers {
+		muxer.Close()
+	}
+	clear(r.tracks)
+	clear(r.muxers)
+	r.manifest.close(time.Now())
+	if r.uploader != nil {
+		r.uploader.close()
+	} else {
+		setOpen(r.dir, false)
+	}
+}
+
+// add an event (e.g. a member joined) to the timeline of the recording.
+func (r *Recording) AddEvent(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.closed {
+		r.manifest.addEvent(event)
+	}
+}
+
+// the manifest entry of a recorded track.
+func manifestTrack(track *forward.Track) ManifestTrack {
+	return ManifestTrack{
+		Id:     track.ID(),
+		Kind:   track.Kind().String(),
+		Source: string(track.Source()),
+		Codec:  track.Codec().MimeType,
+	}
+}
+
+// the extension of the files of the tracks recorded to their own file.
+func extension(codec webrtc.RTPCodecCapability) (string, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return ".ogg", nil
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeAV1):
+		return ".ivf", nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return ".h264", nil
+	}
+	return "", ErrUnsupportedCodec
+}
+
+// create a writer of the codec at the given path for the tracks recorded to
+// their own file.
+func GetWriter(codec webrtc.RTPCodecCapability, path string) (media.Writer, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return oggwriter.New(path, codec.ClockRate, uint16(opusChannels(codec)))
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeAV1):
+		return ivfwriter.New(path, ivfwriter.WithCodec(codec.MimeType))
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264writer.New(path)
+	}
+	return nil, ErrUnsupportedCodec
+}
+
+// a track sink that writes the packets to the disk in its own goroutine so
+// that a slow disk never slows down the forwarding. The packets go through a
+// jitter buffer to be written in order.
+//
+// The track is written in segments (`<base>-00001.h264` and so on) of the
+// configured duration starting with a keyframe.
+type trackRecorder struct {
+	base      string
+	extension string
+	segment   time.Duration
+	track     *forward.Track
+	member    int
+	manifest  *manifestWriter
+	// nil unless the segments are encrypted
+	encryption *encryption
+	jitter     *jitterBuffer
+	packets    chan bufferedPacket
+	done       chan struct{}
+	once       sync.Once
+
+	// owned by the run loop
+	writer   media.Writer
+	path     string
+	segments int
+	// first and last packets written to the current segment
+	span trackSpan
+	// latest time a keyframe has been requested
+	keyframeRequestedAt time.Time
+	// the queue overflowed since the latest write
+	dropping bool
+}
+
+func newTrackRecorder(base string, track *forward.Track, member int, segment time.Duration, manifest *manifestWriter, encryption *encryption) (*trackRecorder, error) {
+	extension, err := extension(track.Codec())
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &trackRecorder{
+		base:       base,
+		extension:  extension,
+		segment:    segment,
+		track:      track,
+		member:     member,
+		manifest:   manifest,
+		encryption: encryption,
+		jitter:     newJitterBuffer(track.Codec()),
+		packets:    make(chan bufferedPacket, queueSize),
+		done:       make(chan struct{}),
+	}
+	if err := recorder.openSegment(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		recorder.run()
 	}()
 
-	utils.IncreaseThread()
-	defer utils.DecreaseThread()
-	for {
-		rtpPacket, _, err := track.ReadRTP()
-		if err != nil {
-			log.Println(err)
-			return
+	return recorder, nil
+}
+
+func (r *trackRecorder) WritePacket(header *rtp.Header, packet *forward.Packet) {
+	packet.Retain()
+	select {
+	case r.packets <- bufferedPacket{header: *header, packet: packet, arrival: time.Now()}:
+		r.dropping = false
+	default:
+		packet.Release()
+		if !r.dropping {
+			log.Printf("[record] dropping packets of %s", r.base)
+			r.dropping = true
+		}
+	}
+}
+
+func (r *trackRecorder) run() {
+	defer close(r.done)
+	for received := range r.packets {
+		r.jitter.push(&received.header, received.packet, received.arrival)
+		for {
+			buffered, ok := r.jitter.pop(received.arrival)
+			if !ok {
+				break
+			}
+			r.write(buffered)
+		}
+	}
+	r.jitter.drain(r.write)
+}
+
+func (r *trackRecorder) write(buffered bufferedPacket) {
+	defer buffered.packet.Release()
+
+	if r.segmentEnded(buffered) {
+		if err := r.finishSegment(); err != nil {
+			log.Println("[record]", err)
 		}
-		if err := writer.WriteRTP(rtpPacket); err != nil {
-			log.Println(err)
-			return
+		if err := r.openSegment(); err != nil {
+			log.Println("[record]", err)
 		}
 	}
+	if r.writer == nil {
+		return
+	}
+
+	packet := rtp.Packet{Header: buffered.header, Payload: buffered.packet.Payload}
+	if err := r.writer.WriteRTP(&packet); err != nil {
+		log.Println("[record]", err)
+		return
+	}
+	r.span.add(buffered.arrival, buffered.header.Timestamp)
 }
 
-func NewOggWritter() (*oggwriter.OggWriter, error) {
-	oggFile, err := oggwriter.New("output.ogg", 48000, 2)
-	return oggFile, err
+// whether the current segment ends before the packet. The segments of the
+// video tracks start with a keyframe which is requested once the segment is
+// long enough.
+func (r *trackRecorder) segmentEnded(buffered bufferedPacket) bool {
+	// the packets of a frame share the same timestamp
+	if !r.span.started || buffered.header.Timestamp == r.span.endRtp {
+		return false
+	}
+
+	codec := r.track.Codec()
+	elapsed := time.Duration(buffered.header.Timestamp-r.span.startRtp) * time.Second / time.Duration(codec.ClockRate)
+	keyframe := true
+	if r.track.Kind() == webrtc.RTPCodecTypeVideo {
+		keyframe = forward.IsKeyframe(codec, buffered.packet.Payload)
+		if r.segment > 0 && elapsed >= r.segment && !keyframe &&
+			buffered.arrival.Sub(r.keyframeRequestedAt) > keyframeInterval {
+			r.keyframeRequestedAt = buffered.arrival
+			r.track.RequestKeyframe()
+		}
+	}
+	return segmentEnded(r.segment, elapsed, keyframe)
+}
+
+// start writing the next segment.
+func (r *trackRecorder) openSegment() error {
+	path := segmentPath(r.base, r.segments+1, r.extension)
+	writer, err := GetWriter(r.track.Codec(), path+partialSuffix)
+	if err != nil {
+		return err
+	}
+
+	r.writer = writer
+	r.path = path
+	r.segments++
+	return nil
+}
+
+// finalize the current segment and add it to the manifest.
+func (r *trackRecorder) finishSegment() error {
+	if r.writer == nil {
+		return nil
+	}
+
+	err := r.writer.Close()
+	if err == nil {
+		r.path, err = commit(r.path, r.encryption)
+	}
+	if err == nil {
+		track := manifestTrack(r.track)
+		r.span.apply(&track)
+		r.manifest.setFile(ManifestFile{Path: r.path, Member: r.member, Tracks: []ManifestTrack{track}})
+	}
+
+	r.writer = nil
+	r.span = trackSpan{}
+	return err
+}
+
+// write the remaining packets and finalize the current segment.
+func (r *trackRecorder) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.packets)
+		<-r.done
+		err = r.finishSegment()
+	})
+	return err
+}
+
+var unsafeFileName = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// make the name safe to be used as a single path element.
+func fileName(name string) string {
+	name = unsafeFileName.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
 }
 
-func NewIvfWritter() (*ivfwriter.IVFWriter, error) {
-	ivfFile, err := ivfwriter.New("output.ivf", ivfwriter.WithCodec("video/VP8"))
-	return ivfFile, err
+func exists(path string) bool {
+	matches, _ := filepath.Glob(path + "-*")
+	return len(matches) > 0
 }
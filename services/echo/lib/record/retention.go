@@ -0,0 +1,178 @@
+package record
+
+import (
+	"cmp"
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// time between two runs of the retention policy
+const retentionInterval = time.Hour
+
+// Retention deletes the recordings (from the directory and the storage)
+// older than MaxAge, then the oldest recordings until the media files kept
+// in the directory fit in the quota. The recordings being written or
+// uploaded are never deleted (their files count towards the quota).
+type Retention struct {
+	Directory string
+	Storage   Storage
+	// zero keeps the recordings regardless of their age
+	MaxAge time.Duration
+	// size (bytes) of the media files kept in the directory; zero disables
+	// the quota
+	Quota int64
+}
+
+// a recording found in the directory.
+type storedRecording struct {
+	dir      string
+	session  string
+	id       string
+	manifest Manifest
+	// the recording ended (or the manifest was written for the last time
+	// in case the process stopped while recording)
+	ended time.Time
+	// size of the files in the directory (but the manifest)
+	size int64
+	// being written (or uploaded) by this process
+	open bool
+}
+
+// apply the policy periodically; never returns.
+func (r Retention) Run() {
+	for {
+		r.Apply(time.Now())
+		time.Sleep(retentionInterval)
+	}
+}
+
+func (r Retention) Apply(now time.Time) {
+	if r.MaxAge <= 0 && r.Quota <= 0 {
+		return
+	}
+
+	kept := []storedRecording{}
+	total := int64(0)
+	for _, recording := range r.scan() {
+		if !recording.open && r.MaxAge > 0 && now.Sub(recording.ended) > r.MaxAge {
+			r.delete(recording)
+			continue
+		}
+		kept = append(kept, recording)
+		total += recording.size
+	}
+
+	for _, recording := range kept {
+		if r.Quota <= 0 || total <= r.Quota {
+			break
+		}
+		if !recording.open && recording.size > 0 && r.delete(recording) {
+			total -= recording.size
+		}
+	}
+}
+
+// the recordings of the directory, oldest first.
+func (r Retention) scan() []storedRecording {
+	recordings := []storedRecording{}
+	sessions, err := os.ReadDir(r.Directory)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("[record]", err)
+		}
+		return recordings
+	}
+
+	for _, session := range sessions {
+		if !session.IsDir() {
+			continue
+		}
+		ids, err := os.ReadDir(filepath.Join(r.Directory, session.Name()))
+		if err != nil {
+			log.Println("[record]", err)
+			continue
+		}
+
+		for _, id := range ids {
+			dir := filepath.Join(r.Directory, session.Name(), id.Name())
+			if !id.IsDir() || !validId(id.Name()) {
+				continue
+			}
+
+			manifest, err := readManifest(dir)
+			if err != nil {
+				continue
+			}
+			recording := storedRecording{dir: dir, session: session.Name(), id: id.Name(), manifest: manifest, open: isOpen(dir)}
+			if manifest.End != nil {
+				recording.ended = *manifest.End
+			} else if info, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil {
+				recording.ended = info.ModTime()
+			}
+			recording.size = directorySize(dir)
+			recordings = append(recordings, recording)
+		}
+	}
+
+	// by start time regardless of the session
+	slices.SortFunc(recordings, func(a, b storedRecording) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return recordings
+}
+
+// delete a recording; the local files are kept (and the deletion retried
+// later) unless the stored files are deleted. Returns true once deleted.
+func (r Retention) delete(recording storedRecording) bool {
+	if r.Storage != nil {
+		keys := []string{ManifestName}
+		if recording.manifest.Encrypted {
+			keys = append(keys, KeyName)
+		}
+		for _, file := range recording.manifest.Files {
+			if file.Upload == UploadUploaded {
+				keys = append(keys, file.Path)
+			}
+		}
+
+		for _, key := range keys {
+			ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+			err := r.Storage.Delete(ctx, path.Join(recording.session, recording.id, key))
+			cancel()
+			if err != nil {
+				log.Printf("[record] unable to delete recording %s/%s: %s", recording.session, recording.id, err)
+				return false
+			}
+		}
+	}
+
+	if err := os.RemoveAll(recording.dir); err != nil {
+		log.Printf("[record] unable to delete recording %s/%s: %s", recording.session, recording.id, err)
+		return false
+	}
+	// the session directory is removed once empty
+	os.Remove(filepath.Dir(recording.dir))
+	log.Printf("deleted recording %s/%s", recording.session, recording.id)
+	return true
+}
+
+// size of the files of the directory but the manifest.
+func directorySize(dir string) int64 {
+	size := int64(0)
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Dir(path) == dir && entry.Name() == ManifestName {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
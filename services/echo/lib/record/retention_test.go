@@ -0,0 +1,91 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// a recording written to the directory for the retention tests.
+type testRecording struct {
+	session string
+	id      string
+	// size of its media file
+	size int
+	// time since the recording ended
+	age time.Duration
+	// being written by the process
+	open bool
+}
+
+func writeTestRecording(t *testing.T, dir string, now time.Time, recording testRecording) string {
+	t.Helper()
+
+	path := filepath.Join(dir, recording.session, recording.id)
+	end := now.Add(-recording.age)
+	writer := newManifestWriter(path, recording.session, end, false)
+	writer.manifest.End = &end
+	writer.save()
+	if recording.size > 0 {
+		if err := os.WriteFile(filepath.Join(path, "media-00001.webm"), make([]byte, recording.size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if recording.open {
+		setOpen(path, true)
+		t.Cleanup(func() { setOpen(path, false) })
+	}
+	return recording.session + "/" + recording.id
+}
+
+func TestRetentionApply(t *testing.T) {
+	// sorted by start time across the sessions
+	recordings := []testRecording{
+		{session: "b", id: "20240101T000000Z", size: 100, age: 72 * time.Hour},
+		{session: "a", id: "20240102T000000Z", size: 200, age: 48 * time.Hour},
+		{session: "b", id: "20240103T000000Z", size: 0, age: 36 * time.Hour},
+		{session: "a", id: "20240104T000000Z", size: 300, age: 24 * time.Hour},
+	}
+
+	tests := []struct {
+		name    string
+		quota   int64
+		maxAge  time.Duration
+		open    []int
+		deleted []int
+	}{
+		{name: "within the quota", quota: 600, deleted: []int{}},
+		{name: "oldest recording first", quota: 500, deleted: []int{0}},
+		{name: "oldest recordings until the quota fits", quota: 300, deleted: []int{0, 1}},
+		{name: "recordings without media are kept", quota: 250, deleted: []int{0, 1, 3}},
+		{name: "open recordings count towards the quota", quota: 300, open: []int{0}, deleted: []int{1, 3}},
+		{name: "open recordings are not expired", maxAge: 40 * time.Hour, open: []int{1}, deleted: []int{0}},
+		{name: "expired recordings", maxAge: 40 * time.Hour, deleted: []int{0, 1}},
+		{name: "expired recordings before the quota", maxAge: 60 * time.Hour, quota: 300, deleted: []int{0, 1}},
+		{name: "expired recordings without media", maxAge: 30 * time.Hour, deleted: []int{0, 1, 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			now := time.Now()
+			keys := []string{}
+			for i, recording := range recordings {
+				recording.open = slices.Contains(test.open, i)
+				keys = append(keys, writeTestRecording(t, dir, now, recording))
+			}
+
+			Retention{Directory: dir, MaxAge: test.maxAge, Quota: test.quota}.Apply(now)
+
+			for i, key := range keys {
+				_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key)))
+				deleted := os.IsNotExist(err)
+				if deleted != slices.Contains(test.deleted, i) {
+					t.Errorf("recording %s deleted: %t", key, deleted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package record
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Storage uploads the recordings to an S3 compatible object storage (e.g.
+// AWS S3 or MinIO). The requests are signed with AWS signature version 4.
+type S3Storage struct {
+	// e.g. `https://s3.eu-central-1.amazonaws.com` or `http://localhost:9000`
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// prefix of the object keys (e.g. `recordings/`)
+	Prefix string
+	// address the bucket in the path (`<endpoint>/<bucket>/<key>`) rather
+	// than the host (`<bucket>.<endpoint host>/<key>`); required by MinIO
+	// unless its domain is configured
+	PathStyle bool
+	Client    *http.Client
+}
+
+// the sha256 of an empty payload
+var emptyPayloadHash = hexSha256(nil)
+
+func (s *S3Storage) Put(ctx context.Context, key string, path string, checksum []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), file)
+	if err != nil {
+		return err
+	}
+	// the storage rejects the object unless its sha256 matches the signed
+	// payload hash
+	request.ContentLength = info.Size()
+	if info.Size() == 0 {
+		request.Body = http.NoBody
+	}
+	s.sign(request, hex.EncodeToString(checksum), time.Now())
+
+	response, err := s.client().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return responseError("upload", key, response)
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string, byteRange string) (Object, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return Object{}, err
+	}
+	if byteRange != "" {
+		request.Header.Set("Range", byteRange)
+	}
+	s.sign(request, emptyPayloadHash, time.Now())
+
+	response, err := s.client().Do(request)
+	if err != nil {
+		return Object{}, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return Object{Body: response.Body, Length: response.ContentLength}, nil
+	case http.StatusPartialContent:
+		return Object{
+			Body:   response.Body,
+			Length: response.ContentLength,
+			Range:  response.Header.Get("Content-Range"),
+		}, nil
+	}
+
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusNotFound:
+		return Object{}, ErrFileNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		return Object{}, ErrInvalidRange
+	}
+	return Object{}, responseError("download", key, response)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(request, emptyPayloadHash, time.Now())
+
+	response, err := s.client().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// deleting a missing object succeeds as well
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		return responseError("delete", key, response)
+	}
+	return nil
+}
+
+// the error of a failed request including the start of the error document.
+func responseError(action string, key string, response *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("unable to %s %s: %s %s", action, key, response.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *S3Storage) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *S3Storage) objectURL(key string) string {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", s.Region)}
+	}
+
+	path := uriEncode(s.Prefix+key, false)
+	if s.PathStyle {
+		return fmt.Sprintf("%s://%s/%s/%s", endpoint.Scheme, endpoint.Host, uriEncode(s.Bucket, true), path)
+	}
+	return fmt.Sprintf("%s://%s.%s/%s", endpoint.Scheme, s.Bucket, endpoint.Host, path)
+}
+
+// add the authorization headers of the request (signature version 4).
+// See: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Storage) sign(request *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	request.Header.Set("x-amz-date", timestamp)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 request.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           timestamp,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		timestamp,
+		scope,
+		hexSha256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSha256(key, s.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(values url.Values) string {
+	pairs := []string{}
+	for name, list := range values {
+		for _, value := range list {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// encode every byte but the unreserved characters as required by the
+// signature; the slashes are kept unless `encodeSlash`.
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hexSha256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,108 @@
+package record
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// suffix of the segment being written. A segment is renamed once it is
+// finalized; a crash only leaves the current segment unfinished.
+const partialSuffix = ".part"
+
+// a segment ends at the next keyframe once it is long enough; it ends
+// regardless when no keyframe comes within this delay
+const segmentKeyframeTimeout = 5 * time.Second
+
+// the path of a segment of a file (e.g. `media-00001.webm`).
+func segmentPath(base string, number int, extension string) string {
+	return fmt.Sprintf("%s-%05d%s", base, number, extension)
+}
+
+// flush a finalized segment to the disk and give it its final name. The
+// segment is encrypted unless `encryption` is nil. Returns the path of the
+// finalized file.
+func commit(path string, encryption *encryption) (string, error) {
+	if encryption == nil {
+		return path, commitFile(path+partialSuffix, path)
+	}
+
+	// the plaintext segment is only removed once its encrypted copy is
+	// finalized; it is never kept when the encryption fails
+	encrypted := path + EncryptedSuffix
+	if err := encryption.encryptFile(path+partialSuffix, encrypted+partialSuffix); err != nil {
+		os.Remove(encrypted + partialSuffix)
+		os.Remove(path + partialSuffix)
+		return "", err
+	}
+	if err := commitFile(encrypted+partialSuffix, encrypted); err != nil {
+		os.Remove(encrypted + partialSuffix)
+		os.Remove(path + partialSuffix)
+		return "", err
+	}
+	return encrypted, os.Remove(path + partialSuffix)
+}
+
+// sync a file and rename it.
+func commitFile(temporary string, path string) error {
+	file, err := os.Open(temporary)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(temporary, path); err != nil {
+		return err
+	}
+
+	// the rename itself survives a crash once the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// remove the segments left unfinished (e.g. by a crash) in the encrypted
+// recordings of the directory. The segments are only encrypted once
+// finalized, so an unfinished segment is in plaintext; the ones of the
+// unencrypted recordings are kept. The recordings being written are skipped.
+func RemovePartialFiles(dir string) {
+	for _, recording := range (Retention{Directory: dir}).scan() {
+		if recording.open || !recording.manifest.Encrypted {
+			continue
+		}
+
+		filepath.WalkDir(recording.dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() || !strings.HasSuffix(path, partialSuffix) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				log.Println("[record]", err)
+			} else {
+				log.Printf("removed the unfinished segment %s", path)
+			}
+			return nil
+		})
+	}
+}
+
+// whether a segment should end before the frame: the segment is long
+// enough and the frame can start the next one (e.g. a keyframe).
+func segmentEnded(duration time.Duration, elapsed time.Duration, keyframe bool) bool {
+	if duration <= 0 || elapsed < duration {
+		return false
+	}
+	return keyframe || elapsed >= duration+segmentKeyframeTimeout
+}
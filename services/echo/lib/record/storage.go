@@ -0,0 +1,216 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrInvalidRange     = errors.New("invalid range")
+)
+
+// Storage keeps the finalized files of the recordings once they are
+// uploaded (see uploader).
+type Storage interface {
+	// store the file under the key, a slash separated path relative to the
+	// recordings directory (e.g. `<session>/<start>/<member>/media-00001.webm`).
+	// `checksum` is the sha256 of the file; the upload fails unless the
+	// stored file matches it.
+	Put(ctx context.Context, key string, path string, checksum []byte) error
+	// open the stored file. The content is limited to the byte range (the
+	// value of a Range header) unless empty.
+	Get(ctx context.Context, key string, byteRange string) (Object, error)
+	// delete the stored file; deleting a missing file succeeds.
+	Delete(ctx context.Context, key string) error
+}
+
+// a stored file or the requested range of the file.
+type Object struct {
+	Body io.ReadCloser
+	// length of the body
+	Length int64
+	// the Content-Range of a partial body (empty unless partial)
+	Range string
+}
+
+// LocalStorage moves the recordings to another directory (e.g. a mounted
+// volume).
+type LocalStorage struct {
+	Directory string
+}
+
+func (s LocalStorage) Put(ctx context.Context, key string, path string, checksum []byte) error {
+	destination := filepath.Join(s.Directory, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return err
+	}
+
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	temporary := destination + partialSuffix
+	file, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary)
+
+	_, err = io.Copy(file, contextReader{ctx: ctx, reader: source})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// read the copy back in case the disk corrupted it
+	stored, _, err := fileChecksum(temporary)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored, checksum) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, key)
+	}
+	return os.Rename(temporary, destination)
+}
+
+func (s LocalStorage) Get(ctx context.Context, key string, byteRange string) (Object, error) {
+	file, err := os.Open(filepath.Join(s.Directory, filepath.FromSlash(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Object{}, ErrFileNotFound
+	}
+	if err != nil {
+		return Object{}, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return Object{}, err
+	}
+
+	start, length, partial, err := parseRange(byteRange, info.Size())
+	if err == nil && start > 0 {
+		_, err = file.Seek(start, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return Object{}, err
+	}
+
+	object := Object{
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(file, length), file},
+		Length: length,
+	}
+	if partial {
+		object.Range = fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, info.Size())
+	}
+	return object, nil
+}
+
+// the first byte and the length of a single byte range (e.g. `bytes=0-99`,
+// `bytes=100-` or `bytes=-100`) and whether the range is partial. The whole
+// file is returned for the other ranges (e.g. multiple ranges).
+func parseRange(byteRange string, size int64) (int64, int64, bool, error) {
+	spec, found := strings.CutPrefix(byteRange, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, ErrInvalidRange
+	}
+
+	if first == "" {
+		// the last bytes of the file
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, false, ErrInvalidRange
+		}
+		start := max(size-suffix, 0)
+		return start, size - start, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, ErrInvalidRange
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, ErrInvalidRange
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, nil
+}
+
+func (s LocalStorage) Delete(ctx context.Context, key string) error {
+	path := filepath.Join(s.Directory, filepath.FromSlash(key))
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// remove the directories left empty (removing a directory fails unless
+	// it is empty)
+	root := filepath.Clean(s.Directory)
+	for dir := filepath.Dir(path); dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// a reader that stops once the context is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// the sha256 and the size of a file.
+func fileChecksum(path string) ([]byte, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash.Sum(nil), size, nil
+}
@@ -0,0 +1,55 @@
+package record
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		byteRange string
+		size      int64
+		start     int64
+		length    int64
+		partial   bool
+		err       error
+	}{
+		{name: "no range", byteRange: "", size: 1000, start: 0, length: 1000},
+		{name: "closed range", byteRange: "bytes=0-99", size: 1000, start: 0, length: 100, partial: true},
+		{name: "single byte", byteRange: "bytes=0-0", size: 1000, start: 0, length: 1, partial: true},
+		{name: "open-ended range", byteRange: "bytes=100-", size: 1000, start: 100, length: 900, partial: true},
+		{name: "last byte open-ended", byteRange: "bytes=999-", size: 1000, start: 999, length: 1, partial: true},
+		{name: "suffix range", byteRange: "bytes=-100", size: 1000, start: 900, length: 100, partial: true},
+		{name: "suffix longer than the file", byteRange: "bytes=-2000", size: 1000, start: 0, length: 1000, partial: true},
+		{name: "end past the file", byteRange: "bytes=500-2000", size: 1000, start: 500, length: 500, partial: true},
+		{name: "spaces around the range", byteRange: "bytes= 10-19 ", size: 1000, start: 10, length: 10, partial: true},
+		{name: "multiple ranges", byteRange: "bytes=0-1,5-9", size: 1000, start: 0, length: 1000},
+		{name: "other unit", byteRange: "items=0-5", size: 1000, start: 0, length: 1000},
+		{name: "start past the file", byteRange: "bytes=1000-", size: 1000, err: ErrInvalidRange},
+		{name: "start past the end", byteRange: "bytes=200-100", size: 1000, err: ErrInvalidRange},
+		{name: "empty suffix", byteRange: "bytes=-0", size: 1000, err: ErrInvalidRange},
+		{name: "suffix of an empty file", byteRange: "bytes=-5", size: 0, err: ErrInvalidRange},
+		{name: "range of an empty file", byteRange: "bytes=0-", size: 0, err: ErrInvalidRange},
+		{name: "negative start", byteRange: "bytes=-5-10", size: 1000, err: ErrInvalidRange},
+		{name: "missing separator", byteRange: "bytes=100", size: 1000, err: ErrInvalidRange},
+		{name: "invalid start", byteRange: "bytes=x-5", size: 1000, err: ErrInvalidRange},
+		{name: "invalid end", byteRange: "bytes=0-x", size: 1000, err: ErrInvalidRange},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, length, partial, err := parseRange(test.byteRange, test.size)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("unexpected error %v, expected %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if start != test.start || length != test.length || partial != test.partial {
+				t.Fatalf("got start=%d length=%d partial=%t, expected start=%d length=%d partial=%t",
+					start, length, partial, test.start, test.length, test.partial)
+			}
+		})
+	}
+}
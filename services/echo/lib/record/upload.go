@@ -0,0 +1,310 @@
+package record
+
+import (
+	"context"
+	"echo/lib/utils"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// attempts to upload a file before it is kept in the recordings
+	// directory
+	uploadAttempts = 6
+	// delay before the second attempt; doubled after every attempt
+	uploadBackoff = time.Second
+	// longest time an upload attempt may take
+	uploadTimeout = 10 * time.Minute
+	// time before the failed uploads are attempted again
+	uploadRetryInterval = 15 * time.Minute
+)
+
+// UploadState is the state of the upload of a recorded file.
+type UploadState string
+
+const (
+	UploadPending  UploadState = "pending"
+	UploadUploaded UploadState = "uploaded"
+	// the file is kept in the recordings directory until the upload is
+	// attempted again
+	UploadFailed UploadState = "failed"
+)
+
+// UploadStatus sums up the uploads of a recording.
+type UploadStatus struct {
+	// files waiting to be uploaded (or being uploaded)
+	Pending  int `json:"pending"`
+	Uploaded int `json:"uploaded"`
+	// files waiting for their upload to be attempted again or missing from
+	// the directory
+	Failed int `json:"failed"`
+	// size of the uploaded files
+	Bytes int64 `json:"bytes"`
+	// the recording is stopped and all of its files (and the manifest) have
+	// been uploaded but the missing ones (see Failed)
+	Done bool `json:"done"`
+}
+
+// uploader uploads the finalized files of a recording to the storage one at
+// a time and deletes them once the storage confirmed the upload. The files
+// whose upload keeps failing are kept in the recordings directory and
+// attempted again every uploadRetryInterval. The manifest is uploaded once
+// the recording is stopped and all of its files have been uploaded; it stays
+// in the recordings directory as well. The uploads left behind by a previous
+// process are resumed from the manifests (see ResumeUploads).
+type uploader struct {
+	storage Storage
+	// the keys of the files are their paths relative to this directory
+	root     string
+	manifest *manifestWriter
+
+	mu    sync.Mutex
+	queue []string
+	// files to upload again after uploadRetryInterval
+	failed []string
+	closed bool
+	status UploadStatus
+	wake   chan struct{}
+}
+
+func newUploader(storage Storage, root string, manifest *manifestWriter) *uploader {
+	u := &uploader{
+		storage:  storage,
+		root:     root,
+		manifest: manifest,
+		wake:     make(chan struct{}, 1),
+	}
+	manifest.setUpload(UploadPending)
+
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		u.run()
+	}()
+
+	return u
+}
+
+// queue a finalized file.
+func (u *uploader) add(path string) {
+	u.mu.Lock()
+	u.queue = append(u.queue, path)
+	u.status.Pending++
+	u.mu.Unlock()
+	u.signal()
+}
+
+// upload the manifest once the queued files are uploaded.
+func (u *uploader) close() {
+	u.mu.Lock()
+	u.closed = true
+	u.mu.Unlock()
+	u.signal()
+}
+
+func (u *uploader) signal() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (u *uploader) progress() UploadStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status
+}
+
+func (u *uploader) run() {
+	for {
+		u.mu.Lock()
+		if len(u.queue) > 0 {
+			path := u.queue[0]
+			u.queue = u.queue[1:]
+			u.mu.Unlock()
+			u.upload(path)
+			continue
+		}
+		closed := u.closed
+		failed := len(u.failed) > 0
+		u.mu.Unlock()
+
+		if closed && !failed {
+			if u.finish() {
+				break
+			}
+			failed = true
+		}
+
+		if !failed {
+			<-u.wake
+			continue
+		}
+
+		// new files are uploaded right away (while recording); the failed
+		// uploads are attempted again later
+		retry := time.NewTimer(uploadRetryInterval)
+		if closed {
+			<-retry.C
+		} else {
+			select {
+			case <-u.wake:
+				retry.Stop()
+				continue
+			case <-retry.C:
+			}
+		}
+		u.retry()
+	}
+
+	u.mu.Lock()
+	u.status.Done = true
+	u.mu.Unlock()
+	setOpen(u.manifest.dir, false)
+}
+
+// queue the failed files again.
+func (u *uploader) retry() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.queue = append(u.queue, u.failed...)
+	u.status.Pending += len(u.failed)
+	u.status.Failed -= len(u.failed)
+	u.failed = nil
+}
+
+// upload the key file (of the encrypted recordings) and the manifest.
+// Returns false in case they should be uploaded again later.
+func (u *uploader) finish() bool {
+	// the manifest and the key file are kept in the directory as well
+	path := filepath.Join(u.manifest.dir, KeyName)
+	if _, err := os.Stat(path); err == nil {
+		if _, _, err := u.put(path); err != nil {
+			log.Printf("[record] unable to upload %s: %s", path, err)
+			return false
+		}
+	}
+
+	// the stored manifest reads uploaded unless some files can never be
+	// uploaded (they went missing from the directory)
+	state := UploadUploaded
+	if u.manifest.hasFailedFiles() {
+		state = UploadFailed
+	}
+	u.manifest.setUpload(state)
+	path = filepath.Join(u.manifest.dir, ManifestName)
+	if _, _, err := u.put(path); err != nil {
+		log.Printf("[record] unable to upload %s: %s", path, err)
+		u.manifest.setUpload(UploadFailed)
+		return false
+	}
+	return true
+}
+
+// a queued file is missing from the directory; it is marked as failed for
+// good and the recording is never marked as uploaded.
+func (u *uploader) missing(path string) {
+	u.manifest.updateFile(path, func(file *ManifestFile) {
+		file.Upload = UploadFailed
+	})
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status.Failed++
+}
+
+// upload a media file and delete it.
+func (u *uploader) upload(path string) {
+	checksum, size, err := u.put(path)
+	state := UploadUploaded
+	if err != nil {
+		log.Printf("[record] unable to upload %s: %s", path, err)
+		state = UploadFailed
+	}
+	u.manifest.updateFile(path, func(file *ManifestFile) {
+		if checksum != nil {
+			file.Sha256 = hex.EncodeToString(checksum)
+		}
+		file.Upload = state
+	})
+	if err == nil {
+		if err := os.Remove(path); err != nil {
+			log.Println("[record]", err)
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status.Pending--
+	if err != nil {
+		u.status.Failed++
+		u.failed = append(u.failed, path)
+		return
+	}
+	u.status.Uploaded++
+	u.status.Bytes += size
+}
+
+// upload a file, retrying with a growing delay. Returns the checksum and
+// the size of the file.
+func (u *uploader) put(path string) ([]byte, int64, error) {
+	key, err := filepath.Rel(u.root, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	key = filepath.ToSlash(key)
+
+	checksum, size, err := fileChecksum(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+		err = u.storage.Put(ctx, key, path, checksum)
+		cancel()
+		if err == nil || attempt == uploadAttempts {
+			return checksum, size, err
+		}
+
+		log.Printf("[record] upload of %s failed (attempt %d): %s", key, attempt, err)
+		time.Sleep(uploadBackoff << (attempt - 1))
+	}
+}
+
+// upload the files of the recordings left behind by a previous process (e.g.
+// their upload failed or the process stopped while uploading) using the
+// states of their manifests. The files missing from the directory are marked
+// as failed and so is the recording.
+func ResumeUploads(dir string, storage Storage) {
+	for _, recording := range (Retention{Directory: dir}).scan() {
+		manifest := recording.manifest
+		if recording.open || manifest.Upload != UploadPending && manifest.Upload != UploadFailed {
+			continue
+		}
+
+		setOpen(recording.dir, true)
+		writer := &manifestWriter{dir: recording.dir, manifest: manifest}
+		u := newUploader(storage, dir, writer)
+		for _, file := range manifest.Files {
+			if file.Upload != UploadPending && file.Upload != UploadFailed {
+				continue
+			}
+
+			path := filepath.Join(recording.dir, filepath.FromSlash(file.Path))
+			if _, err := os.Stat(path); err != nil {
+				log.Printf("[record] unable to resume the upload of %s: %s", path, err)
+				u.missing(path)
+				continue
+			}
+			u.add(path)
+		}
+		u.close()
+		log.Printf("resumed the upload of recording %s/%s", recording.session, recording.id)
+	}
+}
@@ -0,0 +1,91 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResumeUploads(t *testing.T) {
+	tests := []struct {
+		name string
+		// the upload states of the files of the manifest; the files named
+		// missing are not in the directory
+		files   map[string]UploadState
+		missing []string
+		// the upload states once resumed
+		expected  map[string]UploadState
+		recording UploadState
+	}{
+		{
+			name:      "pending and failed files",
+			files:     map[string]UploadState{"a.webm": UploadPending, "b.webm": UploadFailed, "c.webm": UploadUploaded},
+			expected:  map[string]UploadState{"a.webm": UploadUploaded, "b.webm": UploadUploaded, "c.webm": UploadUploaded},
+			recording: UploadUploaded,
+		},
+		{
+			name:      "missing pending file",
+			files:     map[string]UploadState{"a.webm": UploadPending, "b.webm": UploadPending},
+			missing:   []string{"b.webm"},
+			expected:  map[string]UploadState{"a.webm": UploadUploaded, "b.webm": UploadFailed},
+			recording: UploadFailed,
+		},
+		{
+			name:      "missing failed file",
+			files:     map[string]UploadState{"a.webm": UploadFailed},
+			missing:   []string{"a.webm"},
+			expected:  map[string]UploadState{"a.webm": UploadFailed},
+			recording: UploadFailed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "session", "20240101T000000Z")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writer := newManifestWriter(dir, "session", time.Now(), false)
+			writer.manifest.Upload = UploadPending
+			for name, state := range test.files {
+				writer.manifest.Files = append(writer.manifest.Files, ManifestFile{Path: name, Upload: state})
+				if slices.Contains(test.missing, name) || state == UploadUploaded {
+					continue
+				}
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			writer.save()
+
+			storage := LocalStorage{Directory: t.TempDir()}
+			ResumeUploads(root, storage)
+			deadline := time.Now().Add(5 * time.Second)
+			for isOpen(dir) {
+				if time.Now().After(deadline) {
+					t.Fatal("the upload did not end")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			manifest, err := readManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Upload != test.recording {
+				t.Errorf("recording upload %q, expected %q", manifest.Upload, test.recording)
+			}
+			for _, file := range manifest.Files {
+				if file.Upload != test.expected[file.Path] {
+					t.Errorf("file %s upload %q, expected %q", file.Path, file.Upload, test.expected[file.Path])
+				}
+			}
+			if _, err := os.Stat(filepath.Join(storage.Directory, "session", "20240101T000000Z", ManifestName)); err != nil {
+				t.Errorf("the manifest was not uploaded: %s", err)
+			}
+		})
+	}
+}
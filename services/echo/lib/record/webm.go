@@ -0,0 +1,412 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"time"
+)
+
+// ids of the matroska (webm) elements
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+	idSegment            = 0x18538067
+	idSeekHead           = 0x114D9B74
+	idSeek               = 0x4DBB
+	idSeekID             = 0x53AB
+	idSeekPosition       = 0x53AC
+	idVoid               = 0xEC
+	idInfo               = 0x1549A966
+	idTimecodeScale      = 0x2AD7B1
+	idMuxingApp          = 0x4D80
+	idWritingApp         = 0x5741
+	idDateUTC            = 0x4461
+	idDuration           = 0x4489
+	idTracks             = 0x1654AE6B
+	idTrackEntry         = 0xAE
+	idTrackNumber        = 0xD7
+	idTrackUID           = 0x73C5
+	idTrackType          = 0x83
+	idFlagLacing         = 0x9C
+	idCodecID            = 0x86
+	idCodecPrivate       = 0x63A2
+	idCodecDelay         = 0x56AA
+	idSeekPreRoll        = 0x56BB
+	idVideo              = 0xE0
+	idPixelWidth         = 0xB0
+	idPixelHeight        = 0xBA
+	idAudio              = 0xE1
+	idSamplingFrequency  = 0xB5
+	idChannels           = 0x9F
+	idCluster            = 0x1F43B675
+	idTimecode           = 0xE7
+	idSimpleBlock        = 0xA3
+	idCues               = 0x1C53BB6B
+	idCuePoint           = 0xBB
+	idCueTime            = 0xB3
+	idCueTrackPositions  = 0xB7
+	idCueTrack           = 0xF7
+	idCueClusterPosition = 0xF1
+)
+
+const (
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+)
+
+const (
+	// space reserved at the start of the segment for the seek head which is
+	// only known once the file is finalized
+	seekHeadSize = 100
+	// longest cluster (ms); the block timecodes are relative to the cluster
+	// and must fit in 16 bits
+	maxClusterDuration = 5000
+)
+
+// matroska timestamps are in milliseconds (timecode scale) and the dates
+// are relative to 2001
+var matroskaEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// a track of a webm file.
+type webmTrack struct {
+	number  uint64
+	video   bool
+	codecID string
+	// video only
+	width  int
+	height int
+	// audio only
+	channels     int
+	sampleRate   int
+	codecPrivate []byte
+}
+
+// webmWriter writes the frames of audio and video tracks to a single webm
+// file. The frames are written in clusters as they come; the seek head,
+// duration and cues are written when the file is closed.
+type webmWriter struct {
+	file   *os.File
+	tracks []webmTrack
+	// position of the segment data in the file
+	segmentStart int64
+	// positions of the top level elements relative to the segment data
+	infoPosition   int64
+	tracksPosition int64
+	// position of the duration value in the file
+	durationOffset int64
+	// size of the file
+	offset int64
+
+	cluster         bytes.Buffer
+	clusterTimecode int64
+	clusterOpen     bool
+	cues            bytes.Buffer
+	lastTimecode    int64
+}
+
+func newWebmWriter(path string, tracks []webmTrack, date time.Time) (*webmWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &webmWriter{file: file, tracks: tracks}
+	if err := w.writeHeader(date); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *webmWriter) writeHeader(date time.Time) error {
+	var header bytes.Buffer
+	writeMaster(&header, idEBML, func(b *bytes.Buffer) {
+		writeUint(b, idEBMLVersion, 1)
+		writeUint(b, idEBMLReadVersion, 1)
+		writeUint(b, idEBMLMaxIDLength, 4)
+		writeUint(b, idEBMLMaxSizeLength, 8)
+		writeString(b, idDocType, "webm")
+		writeUint(b, idDocTypeVersion, 4)
+		writeUint(b, idDocTypeReadVersion, 2)
+	})
+
+	// the segment size is written once the file is finalized
+	writeID(&header, idSegment)
+	header.Write(unknownSize[:])
+	w.segmentStart = int64(header.Len())
+
+	writeVoid(&header, seekHeadSize)
+
+	w.infoPosition = int64(header.Len()) - w.segmentStart
+	writeMaster(&header, idInfo, func(b *bytes.Buffer) {
+		writeUint(b, idTimecodeScale, uint64(time.Millisecond))
+		writeString(b, idMuxingApp, "echo")
+		writeString(b, idWritingApp, "echo")
+		writeInt(b, idDateUTC, int64(date.Sub(matroskaEpoch)))
+		writeFloat(b, idDuration, 0)
+	})
+	// the duration is the last element of the info
+	w.durationOffset = int64(header.Len()) - 8
+
+	w.tracksPosition = int64(header.Len()) - w.segmentStart
+	writeMaster(&header, idTracks, func(b *bytes.Buffer) {
+		for _, track := range w.tracks {
+			writeTrackEntry(b, track)
+		}
+	})
+
+	return w.write(header.Bytes())
+}
+
+func writeTrackEntry(b *bytes.Buffer, track webmTrack) {
+	writeMaster(b, idTrackEntry, func(b *bytes.Buffer) {
+		writeUint(b, idTrackNumber, track.number)
+		writeUint(b, idTrackUID, track.number)
+		writeUint(b, idFlagLacing, 0)
+		writeString(b, idCodecID, track.codecID)
+		if len(track.codecPrivate) > 0 {
+			writeBytes(b, idCodecPrivate, track.codecPrivate)
+		}
+
+		if track.video {
+			writeUint(b, idTrackType, trackTypeVideo)
+			writeMaster(b, idVideo, func(b *bytes.Buffer) {
+				writeUint(b, idPixelWidth, uint64(track.width))
+				writeUint(b, idPixelHeight, uint64(track.height))
+			})
+			return
+		}
+
+		writeUint(b, idTrackType, trackTypeAudio)
+		if track.codecID == "A_OPUS" {
+			// opus pre-skip and the recommended seek pre-roll (ns)
+			writeUint(b, idCodecDelay, uint64(opusPreSkip)*uint64(time.Second)/48000)
+			writeUint(b, idSeekPreRoll, uint64(80*time.Millisecond))
+		}
+		writeMaster(b, idAudio, func(b *bytes.Buffer) {
+			writeFloat(b, idSamplingFrequency, float64(track.sampleRate))
+			writeUint(b, idChannels, uint64(track.channels))
+		})
+	})
+}
+
+// write a frame of a track at the given time (ms) since the start of the
+// file. The frames should be written in order.
+func (w *webmWriter) writeFrame(number uint64, timecode int64, keyframe bool, data []byte) error {
+	timecode = max(timecode, w.lastTimecode)
+	w.lastTimecode = timecode
+
+	video := false
+	for _, track := range w.tracks {
+		if track.number == number {
+			video = track.video
+		}
+	}
+
+	// clusters start with the video keyframes (when possible) so that the
+	// players can seek to them
+	if !w.clusterOpen ||
+		(video && keyframe) ||
+		timecode-w.clusterTimecode >= maxClusterDuration {
+		if err := w.flushCluster(); err != nil {
+			return err
+		}
+		w.openCluster(timecode, video && keyframe, number)
+	}
+
+	flags := byte(0)
+	if keyframe {
+		flags |= 0x80
+	}
+
+	writeID(&w.cluster, idSimpleBlock)
+	writeSize(&w.cluster, uint64(len(data)+4))
+	writeSize(&w.cluster, number)
+	relative := int16(timecode - w.clusterTimecode)
+	w.cluster.Write([]byte{byte(relative >> 8), byte(relative), flags})
+	w.cluster.Write(data)
+	return nil
+}
+
+func (w *webmWriter) openCluster(timecode int64, keyframe bool, number uint64) {
+	w.cluster.Reset()
+	w.clusterTimecode = timecode
+	w.clusterOpen = true
+	writeUint(&w.cluster, idTimecode, uint64(timecode))
+
+	// the cue points reference the clusters starting with a video keyframe
+	// or every cluster of the audio only files
+	hasVideo := false
+	for _, track := range w.tracks {
+		hasVideo = hasVideo || track.video
+	}
+	if keyframe || !hasVideo {
+		position := uint64(w.offset - w.segmentStart)
+		writeMaster(&w.cues, idCuePoint, func(b *bytes.Buffer) {
+			writeUint(b, idCueTime, uint64(timecode))
+			writeMaster(b, idCueTrackPositions, func(b *bytes.Buffer) {
+				writeUint(b, idCueTrack, number)
+				writeUint(b, idCueClusterPosition, position)
+			})
+		})
+	}
+}
+
+func (w *webmWriter) flushCluster() error {
+	if !w.clusterOpen {
+		return nil
+	}
+	w.clusterOpen = false
+
+	var cluster bytes.Buffer
+	writeID(&cluster, idCluster)
+	writeSize(&cluster, uint64(w.cluster.Len()))
+	cluster.Write(w.cluster.Bytes())
+	return w.write(cluster.Bytes())
+}
+
+func (w *webmWriter) write(data []byte) error {
+	n, err := w.file.Write(data)
+	w.offset += int64(n)
+	return err
+}
+
+// the duration (ms) of the written frames.
+func (w *webmWriter) duration() int64 {
+	return w.lastTimecode
+}
+
+// write the remaining frames, the cues and the seek head and close the file.
+func (w *webmWriter) Close() error {
+	err := w.finalize()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *webmWriter) finalize() error {
+	if err := w.flushCluster(); err != nil {
+		return err
+	}
+
+	cuesPosition := w.offset - w.segmentStart
+	var cues bytes.Buffer
+	writeID(&cues, idCues)
+	writeSize(&cues, uint64(w.cues.Len()))
+	cues.Write(w.cues.Bytes())
+	if err := w.write(cues.Bytes()); err != nil {
+		return err
+	}
+
+	var seekHead bytes.Buffer
+	writeMaster(&seekHead, idSeekHead, func(b *bytes.Buffer) {
+		for _, entry := range []struct {
+			id       uint32
+			position int64
+		}{{idInfo, w.infoPosition}, {idTracks, w.tracksPosition}, {idCues, cuesPosition}} {
+			writeMaster(b, idSeek, func(b *bytes.Buffer) {
+				id := binary.BigEndian.AppendUint32(nil, entry.id)
+				writeBytes(b, idSeekID, id)
+				writeUint(b, idSeekPosition, uint64(entry.position))
+			})
+		}
+	})
+	writeVoid(&seekHead, seekHeadSize-seekHead.Len())
+	if _, err := w.file.WriteAt(seekHead.Bytes(), w.segmentStart); err != nil {
+		return err
+	}
+
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(w.duration())))
+	if _, err := w.file.WriteAt(duration, w.durationOffset); err != nil {
+		return err
+	}
+
+	size := uint64(w.offset-w.segmentStart) | 1<<56
+	_, err := w.file.WriteAt(binary.BigEndian.AppendUint64(nil, size), w.segmentStart-8)
+	return err
+}
+
+// an 8 bytes size of an element whose size is not known yet
+var unknownSize = [8]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// the element ids already include their length marker.
+func writeID(b *bytes.Buffer, id uint32) {
+	switch {
+	case id >= 1<<24:
+		b.Write([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)})
+	case id >= 1<<16:
+		b.Write([]byte{byte(id >> 16), byte(id >> 8), byte(id)})
+	case id >= 1<<8:
+		b.Write([]byte{byte(id >> 8), byte(id)})
+	default:
+		b.WriteByte(byte(id))
+	}
+}
+
+// write a variable length size using the fewest bytes.
+func writeSize(b *bytes.Buffer, size uint64) {
+	length := 1
+	// all ones is reserved for the unknown size
+	for size >= 1<<(7*length)-1 {
+		length++
+	}
+
+	marked := size | 1<<(7*length)
+	for i := length - 1; i >= 0; i-- {
+		b.WriteByte(byte(marked >> (8 * i)))
+	}
+}
+
+func writeMaster(b *bytes.Buffer, id uint32, children func(b *bytes.Buffer)) {
+	var body bytes.Buffer
+	children(&body)
+	writeBytes(b, id, body.Bytes())
+}
+
+func writeBytes(b *bytes.Buffer, id uint32, value []byte) {
+	writeID(b, id)
+	writeSize(b, uint64(len(value)))
+	b.Write(value)
+}
+
+func writeUint(b *bytes.Buffer, id uint32, value uint64) {
+	length := 1
+	for length < 8 && value >= 1<<(8*length) {
+		length++
+	}
+
+	writeID(b, id)
+	writeSize(b, uint64(length))
+	for i := length - 1; i >= 0; i-- {
+		b.WriteByte(byte(value >> (8 * i)))
+	}
+}
+
+func writeInt(b *bytes.Buffer, id uint32, value int64) {
+	writeBytes(b, id, binary.BigEndian.AppendUint64(nil, uint64(value)))
+}
+
+func writeFloat(b *bytes.Buffer, id uint32, value float64) {
+	writeBytes(b, id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func writeString(b *bytes.Buffer, id uint32, value string) {
+	writeBytes(b, id, []byte(value))
+}
+
+// fill `size` bytes with a void element.
+func writeVoid(b *bytes.Buffer, size int) {
+	writeID(b, idVoid)
+	// a single byte size is enough for the reserved space
+	writeSize(b, uint64(size-2))
+	b.Write(make([]byte, size-2))
+}
@@ -0,0 +1,284 @@
+package record
+
+import (
+	"echo/lib/forward"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// an element of a parsed webm file. The offsets are in the file.
+type ebmlElement struct {
+	id uint32
+	// offset of the element and of its data
+	offset     int64
+	dataOffset int64
+	size       int64
+	children   []ebmlElement
+}
+
+func (e ebmlElement) end() int64 {
+	return e.dataOffset + e.size
+}
+
+func (e ebmlElement) data(file []byte) []byte {
+	return file[e.dataOffset:e.end()]
+}
+
+func (e ebmlElement) child(t *testing.T, id uint32) ebmlElement {
+	t.Helper()
+	for _, child := range e.children {
+		if child.id == id {
+			return child
+		}
+	}
+	t.Fatalf("element %x has no child %x", e.id, id)
+	return ebmlElement{}
+}
+
+func (e ebmlElement) all(id uint32) []ebmlElement {
+	elements := []ebmlElement{}
+	for _, child := range e.children {
+		if child.id == id {
+			elements = append(elements, child)
+		}
+	}
+	return elements
+}
+
+func (e ebmlElement) uint(file []byte) uint64 {
+	value := uint64(0)
+	for _, b := range e.data(file) {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func (e ebmlElement) float(file []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(e.data(file)))
+}
+
+// the master elements of the recordings.
+var ebmlMasters = map[uint32]bool{
+	idEBML: true, idSegment: true, idSeekHead: true, idSeek: true, idInfo: true,
+	idTracks: true, idTrackEntry: true, idVideo: true, idAudio: true,
+	idCluster: true, idCues: true, idCuePoint: true, idCueTrackPositions: true,
+}
+
+// read a variable length integer; the length marker is kept for the ids.
+func readVint(t *testing.T, file []byte, offset int64, marker bool) (uint64, int64) {
+	t.Helper()
+	if offset >= int64(len(file)) || file[offset] == 0 {
+		t.Fatalf("invalid variable length integer at %d", offset)
+	}
+
+	length := int64(1)
+	for file[offset]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	if offset+length > int64(len(file)) {
+		t.Fatalf("truncated variable length integer at %d", offset)
+	}
+
+	value := uint64(file[offset])
+	if !marker {
+		value &= 0xFF >> length
+	}
+	for _, b := range file[offset+1 : offset+length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// parse the elements between `offset` and `end`. The children of every
+// master element must fill it exactly.
+func parseEBML(t *testing.T, file []byte, offset int64, end int64) []ebmlElement {
+	t.Helper()
+	elements := []ebmlElement{}
+	for offset < end {
+		id, idLength := readVint(t, file, offset, true)
+		size, sizeLength := readVint(t, file, offset+idLength, false)
+		element := ebmlElement{
+			id:         uint32(id),
+			offset:     offset,
+			dataOffset: offset + idLength + sizeLength,
+			size:       int64(size),
+		}
+		if element.end() > end {
+			t.Fatalf("element %x at %d ends at %d past its parent (%d)", id, offset, element.end(), end)
+		}
+		if ebmlMasters[element.id] {
+			element.children = parseEBML(t, file, element.dataOffset, element.end())
+		}
+		elements = append(elements, element)
+		offset = element.end()
+	}
+	if offset != end {
+		t.Fatalf("the elements end at %d instead of %d", offset, end)
+	}
+	return elements
+}
+
+// send a packet of a recorded track received `at` after the start of the
+// recording.
+func sendTestPacket(t *testing.T, m *muxer, track *muxTrack, start time.Time, at time.Duration, header rtp.Header, payload []byte) {
+	t.Helper()
+	raw, err := (&rtp.Packet{Header: header, Payload: payload}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := forward.NewPacket()
+	n := copy(packet.Buffer(), raw)
+	if err := packet.Unmarshal(n); err != nil {
+		t.Fatal(err)
+	}
+	m.send(muxEvent{kind: muxEventPacket, track: track, header: packet.Header, packet: packet, time: start.Add(at)}, true)
+}
+
+// record 12 seconds of a vp8 track (10 frames per second, keyframes every 6
+// seconds) and an opus track (20ms frames) and parse the webm file back.
+func TestWebmStructure(t *testing.T) {
+	const (
+		duration      = 12 * time.Second
+		videoInterval = 100 * time.Millisecond
+		audioInterval = 20 * time.Millisecond
+		keyframeEvery = 6 * time.Second
+	)
+
+	dir := t.TempDir()
+	manifest := newManifestWriter(dir, "session", time.Now(), false)
+	m := newMuxer(filepath.Join(dir, "member"), 1, 0, manifest, nil)
+
+	vp8 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	// the channels are not negotiated: opus is stereo
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}
+	video := m.addTrack(forward.NewTrack(vp8, "video", "stream", forward.SourceCamera))
+	audio := m.addTrack(forward.NewTrack(opus, "audio", "stream", forward.SourceMicrophone))
+
+	start := time.Now()
+	videoSeq, audioSeq := uint16(0), uint16(0)
+	for at := time.Duration(0); at < duration; at += audioInterval {
+		if at%videoInterval == 0 {
+			// vp8 payload descriptor (start of partition) and the frame tag
+			// (followed by the start code and the size of the keyframes)
+			payload := []byte{0x10, 0x01, 0x00, 0x00}
+			if at%keyframeEvery == 0 {
+				payload = []byte{0x10, 0x00, 0x00, 0x00, 0x9D, 0x01, 0x2A, 0x40, 0x01, 0xF0, 0x00}
+			}
+			header := rtp.Header{
+				Version:        2,
+				SequenceNumber: videoSeq,
+				Timestamp:      uint32(at * 90 / time.Millisecond),
+				Marker:         true,
+				SSRC:           1,
+			}
+			sendTestPacket(t, m, video, start, at, header, payload)
+			videoSeq++
+		}
+
+		header := rtp.Header{
+			Version:        2,
+			SequenceNumber: audioSeq,
+			Timestamp:      uint32(at * 48 / time.Millisecond),
+			SSRC:           2,
+		}
+		sendTestPacket(t, m, audio, start, at, header, []byte{0xFC, 0xAA, 0xBB})
+		audioSeq++
+	}
+	m.Close()
+
+	file, err := os.ReadFile(segmentPath(filepath.Join(dir, "member"), 1, ".webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elements := parseEBML(t, file, 0, int64(len(file)))
+	if len(elements) != 2 || elements[0].id != idEBML || elements[1].id != idSegment {
+		t.Fatal("expected the ebml header followed by the segment")
+	}
+	segment := elements[1]
+
+	// the seek head and the void padding fill the reserved space and
+	// reference the top level elements
+	seekHead, void := segment.children[0], segment.children[1]
+	if seekHead.id != idSeekHead || void.id != idVoid || void.end()-seekHead.offset != seekHeadSize {
+		t.Fatal("the seek head does not fill the reserved space")
+	}
+	for _, seek := range seekHead.all(idSeek) {
+		id := uint32(seek.child(t, idSeekID).uint(file))
+		position := segment.dataOffset + int64(seek.child(t, idSeekPosition).uint(file))
+		target, _ := readVint(t, file, position, true)
+		if uint32(target) != id {
+			t.Fatalf("the seek entry of %x points to %x", id, target)
+		}
+	}
+	if len(seekHead.all(idSeek)) != 3 {
+		t.Fatalf("%d seek entries, expected 3", len(seekHead.all(idSeek)))
+	}
+
+	tracks := segment.child(t, idTracks).all(idTrackEntry)
+	if len(tracks) != 2 {
+		t.Fatalf("%d tracks, expected 2", len(tracks))
+	}
+	videoSize := tracks[0].child(t, idVideo)
+	if videoSize.child(t, idPixelWidth).uint(file) != 320 || videoSize.child(t, idPixelHeight).uint(file) != 240 {
+		t.Fatal("the video size is not the size of the keyframe")
+	}
+	if channels := tracks[1].child(t, idAudio).child(t, idChannels).uint(file); channels != 2 {
+		t.Fatalf("%d audio channels, expected 2", channels)
+	}
+
+	// the clusters start with the keyframes and are split every 5 seconds;
+	// the block timecodes are relative to their cluster
+	clusters := segment.all(idCluster)
+	expected := []uint64{0, 5000, 6000, 11000}
+	if len(clusters) != len(expected) {
+		t.Fatalf("%d clusters, expected %d", len(clusters), len(expected))
+	}
+	last := int64(0)
+	clusterPositions := map[uint64]int64{}
+	for i, cluster := range clusters {
+		timecode := cluster.child(t, idTimecode).uint(file)
+		if timecode != expected[i] {
+			t.Fatalf("cluster %d starts at %d, expected %d", i, timecode, expected[i])
+		}
+		clusterPositions[timecode] = cluster.offset - segment.dataOffset
+
+		for _, block := range cluster.all(idSimpleBlock) {
+			_, length := readVint(t, file, block.dataOffset, false)
+			relative := int64(int16(binary.BigEndian.Uint16(file[block.dataOffset+length:])))
+			if relative < 0 || relative >= maxClusterDuration {
+				t.Fatalf("block timecode %d out of its cluster", relative)
+			}
+			if absolute := int64(timecode) + relative; absolute < last {
+				t.Fatalf("block at %d after a block at %d", absolute, last)
+			} else {
+				last = absolute
+			}
+		}
+	}
+
+	// a cue point for every keyframe cluster
+	cuePoints := segment.child(t, idCues).all(idCuePoint)
+	if len(cuePoints) != 2 {
+		t.Fatalf("%d cue points, expected 2", len(cuePoints))
+	}
+	for _, cuePoint := range cuePoints {
+		cueTime := cuePoint.child(t, idCueTime).uint(file)
+		position := cuePoint.child(t, idCueTrackPositions).child(t, idCueClusterPosition).uint(file)
+		if cluster, ok := clusterPositions[cueTime]; !ok || int64(position) != cluster {
+			t.Fatalf("the cue point at %d points to %d", cueTime, position)
+		}
+	}
+
+	// the duration is patched once the last frame is written
+	if duration := segment.child(t, idInfo).child(t, idDuration).float(file); duration != float64(last) || last < 11900 {
+		t.Fatalf("duration %f, expected %d", duration, last)
+	}
+}
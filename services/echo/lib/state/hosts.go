@@ -0,0 +1,42 @@
+package state
+
+import "crypto/subtle"
+
+// issue a new token authenticating a host of the session over the signaling
+// connection (the member id of the connection is chosen by the client and
+// can't be trusted on its own). The previous token of the host is revoked.
+// The token is revoked as well when the member is no longer a host (see
+// Options.Hosts).
+func (s *State) IssueHostToken(sid SessionId, mid MemberId) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	options, ok := s.options[sid]
+	if !ok {
+		options = DefaultOptions()
+	}
+	if !options.IsHost(mid) {
+		return "", ErrNotHost
+	}
+
+	if s.hostTokens[sid] == nil {
+		s.hostTokens[sid] = make(map[MemberId]string)
+	}
+	s.hostTokens[sid][mid] = token
+	return token, nil
+}
+
+// check that the member is a host of the session authenticated by its token
+// (see IssueHostToken).
+func (s *State) IsSessionHost(sid SessionId, mid MemberId, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expected, ok := s.hostTokens[sid][mid]
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
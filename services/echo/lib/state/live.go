@@ -0,0 +1,72 @@
+package state
+
+import (
+	"crypto/rand"
+	"echo/constants"
+	"echo/lib/record"
+	"encoding/hex"
+	"errors"
+	"log"
+)
+
+var ErrLiveDisabled = errors.New("live streaming is disabled")
+
+// a random token authorizing the viewers of a live stream (or a host of a
+// session).
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// stream the camera and the microphone of a member of the session live (or
+// follow another member). Like a recording, the session is only streamed in
+// case its members consented (see Options.RecordingConsent). Returns the
+// token of the stream.
+func (s *State) SetSessionLive(sid SessionId, member MemberId) (string, error) {
+	if !constants.Features.EnableLive {
+		return "", ErrLiveDisabled
+	}
+	if !s.GetSessionOptions(sid).RecordingConsent {
+		return "", ErrNoRecordingConsent
+	}
+
+	token, err := s.GetSessionPublications(sid).SetLiveMember(member)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("session %s is streamed live following %d", sid, member)
+	return token, nil
+}
+
+func (s *State) StopSessionLive(sid SessionId) {
+	if s.GetSessionPublications(sid).StopLive() {
+		log.Printf("session %s is no longer streamed live", sid)
+	}
+}
+
+// the member followed by the live stream of the session and the token of the
+// stream; false unless the session is streamed.
+func (s *State) GetSessionLive(sid SessionId) (MemberId, string, bool) {
+	return s.GetSessionPublications(sid).LiveStatus()
+}
+
+// the live stream authorized by the token; nil unless a session is streamed
+// with this token.
+func (s *State) GetLiveStream(token string) *record.LiveStream {
+	s.mu.Lock()
+	publications := make([]*Publications, 0, len(s.publications))
+	for _, p := range s.publications {
+		publications = append(publications, p)
+	}
+	s.mu.Unlock()
+
+	for _, p := range publications {
+		if stream := p.LiveStream(token); stream != nil {
+			return stream
+		}
+	}
+	return nil
+}
@@ -2,55 +2,101 @@ package state
 
 import (
 	"echo/constants"
+	"echo/lib/codecs"
+	"echo/lib/forward"
+	"echo/lib/netsim"
+	"echo/lib/record"
 	"echo/lib/utils"
 	"echo/lib/wss"
 	"errors"
 	"io"
 	"log"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pion/interceptor"
 	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 )
 
 type MemberId = int
 
+var ErrUnsupportedCodec = errors.New("codec is not supported by the member")
+
 type Member struct {
 	mu                  sync.Mutex
 	Id                  MemberId
 	Conn                *webrtc.PeerConnection
-	Tracks              []*webrtc.TrackLocalStaticRTP
+	Tracks              []*forward.Track
 	Socket              *wss.Socket
-	TracksChannel       chan *webrtc.TrackLocalStaticRTP
+	TracksChannel       chan *forward.Track
+	UnpublishedChannel  chan *forward.Track
+	TrackStateChannel   chan TrackState
 	PeerConnectionState chan webrtc.PeerConnectionState
 	Audio               bool
 	Video               bool
 	rtpSenders          []*webrtc.RTPSender
+	// the member doesn't receive any video (e.g. on a slow mobile connection)
+	AudioOnly bool
+	// mid of the transceiver each published track is received on
+	trackMids map[*forward.Track]string
+	// tracks declared by the member mapped by the transceiver mid
+	declared map[string]wss.TrackMetadata
+	// tracks received from the other members mapped by the track id
+	subscriptions map[string]subscription
+	// ids of the tracks paused by the member
+	paused map[string]bool
+	// queue of the packets sent to the member (by all of its subscriptions)
+	outbound *forward.Queue
+	// tracks published in the member session
+	publications *Publications
+	// closed once the member left the session; nobody receives from the
+	// channels of the member anymore
+	left      chan struct{}
+	leaveOnce sync.Once
+}
+
+// a published track stopped (or started again) receiving packets.
+type TrackState struct {
+	Track   *forward.Track
+	Stalled bool
 }
 
-func initPeerConnection() (*webrtc.PeerConnection, error) {
+// a track received from another member.
+type subscription struct {
+	downTrack *forward.DownTrack
+	sender    *webrtc.RTPSender
+}
+
+func initPeerConnection(mid MemberId, options Options) (*webrtc.PeerConnection, error) {
 	mediaEngine := &webrtc.MediaEngine{}
 
-	// register video (vp8) codec
-	if err := mediaEngine.RegisterCodec(
-		webrtc.RTPCodecParameters{
-			RTPCodecCapability: webrtc.RTPCodecCapability{
-				MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil,
-			},
-			PayloadType: 96,
-		}, webrtc.RTPCodecTypeVideo,
-	); err != nil {
-		panic(err)
+	// register the video codecs in the configured order of preference (the
+	// first codec supported by the client is the one that will be used), the
+	// audio codec (opus, tuned by the session audio profile) and the
+	// protection codecs enabled for the session
+	if err := codecs.Register(mediaEngine, codecs.Options{
+		Video:        constants.Codecs.Video,
+		Fmtp:         constants.Codecs.Fmtp,
+		RTX:          options.RTX,
+		FEC:          options.FEC,
+		RED:          options.RED,
+		AudioProfile: options.AudioProfile,
+	}); err != nil {
+		return nil, err
 	}
 
-	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil,
-		},
-		PayloadType: 111,
-	}, webrtc.RTPCodecTypeAudio); err != nil {
-		panic(err)
+	// the dependency descriptor is needed to find the layers of the AV1 SVC streams
+	if err := mediaEngine.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: forward.DependencyDescriptorURI},
+		webrtc.RTPCodecTypeVideo,
+	); err != nil {
+		return nil, err
 	}
 
 	// create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
@@ -59,6 +105,18 @@ func initPeerConnection() (*webrtc.PeerConnection, error) {
 	// for each PeerConnection.
 	interceptorRegistry := &interceptor.Registry{}
 
+	// the network simulation must be the first interceptor to be the closest
+	// to the network (e.g. the nack interceptors should see the losses)
+	if simulation, ok := options.SimulationFor(mid); ok {
+		log.Printf("simulating network conditions for %d", mid)
+		interceptorRegistry.Add(netsim.NewFactory(simulation))
+	}
+
+	// the ulpfec packets protect the packets as they are sent on the network
+	if options.FEC == "ulpfec" {
+		interceptorRegistry.Add(&forward.ULPFECFactory{})
+	}
+
 	// use the default set of Interceptors
 	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
 		return nil, err
@@ -85,8 +143,8 @@ func initPeerConnection() (*webrtc.PeerConnection, error) {
 }
 
 // Initialize a peer connection and create a new member struct associated to the connection
-func NewMember(mid MemberId, socket *wss.Socket) (*Member, error) {
-	conn, err := initPeerConnection()
+func NewMember(mid MemberId, socket *wss.Socket, options Options, publications *Publications) (*Member, error) {
+	conn, err := initPeerConnection(mid, options)
 	if err != nil {
 		return nil, err
 	}
@@ -94,14 +152,29 @@ func NewMember(mid MemberId, socket *wss.Socket) (*Member, error) {
 	member := Member{
 		Id:                  mid,
 		Conn:                conn,
-		Tracks:              []*webrtc.TrackLocalStaticRTP{},
+		Tracks:              []*forward.Track{},
 		Socket:              socket,
-		TracksChannel:       make(chan *webrtc.TrackLocalStaticRTP),
+		TracksChannel:       make(chan *forward.Track),
+		UnpublishedChannel:  make(chan *forward.Track),
+		TrackStateChannel:   make(chan TrackState),
 		PeerConnectionState: make(chan webrtc.PeerConnectionState),
 		Audio:               false,
 		Video:               false,
+		trackMids:           map[*forward.Track]string{},
+		declared:            map[string]wss.TrackMetadata{},
+		subscriptions:       map[string]subscription{},
+		paused:              map[string]bool{},
+		outbound:            forward.NewQueue(constants.Outbound.QueueSize, constants.Outbound.Bitrate),
+		publications:        publications,
+		left:                make(chan struct{}),
 	}
 
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		member.outbound.Run()
+	}()
+
 	conn.OnTrack(member.onTrack)
 	conn.OnICECandidate(member.onICECandidate)
 	conn.OnConnectionStateChange(member.onConnectionStateChange)
@@ -112,50 +185,264 @@ func NewMember(mid MemberId, socket *wss.Socket) (*Member, error) {
 	return &member, nil
 }
 
-func (m *Member) onTrack(remoteTrack *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+func (m *Member) onTrack(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 
 	log.Printf("received a remote %s track", remoteTrack.Kind().String())
 
-	// create a local track with the remote track capabilities
-	localTrack, err := webrtc.NewTrackLocalStaticRTP(
-		remoteTrack.Codec().RTPCodecCapability,
-		remoteTrack.ID(),
-		remoteTrack.ID(),
-	)
+	mid := ""
+	for _, transceiver := range m.Conn.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			mid = transceiver.Mid()
+		}
+	}
 
+	m.mu.Lock()
+	source := forward.Source(m.declared[mid].Source)
+	m.mu.Unlock()
+	if source == "" {
+		source = forward.DefaultSource(remoteTrack.Kind())
+	}
+
+	// the member keeps a single forwarded track per source. When the member
+	// renegotiates (e.g. switches camera) or reconnects, the existing track
+	// is restarted with the new remote track and the subscribers don't need
+	// to add a new one.
+	codec := remoteTrack.Codec().RTPCodecCapability
+	localTrack, reused, err := m.publications.Acquire(m, source, codec, func() *forward.Track {
+		return forward.NewTrack(codec, remoteTrack.ID(), remoteTrack.ID(), source)
+	})
 	if err != nil {
-		log.Println("error creating a local track:", err)
+		log.Printf("[onTrack] unable to publish %s track of %d: %s", source, m.Id, err)
+		m.Socket.SendPublishRejectedMessage(remoteTrack.ID(), string(source), "screen-share-active")
 		return
 	}
 
-	m.Tracks = append(m.Tracks, localTrack)
+	generation := localTrack.Generation()
+	if reused {
+		generation = localTrack.Restart()
+	}
 
-	m.TracksChannel <- localTrack
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == forward.DependencyDescriptorURI {
+			localTrack.SetDependencyDescriptorId(uint8(extension.ID))
+		}
+	}
 
-	// write the buffer from the remote track in the local track simultaneously
-	// codec := remoteTrack.Codec()
-	// writer := record.GetWriter(codec)
+	// subscribers ask for keyframes when they resume a paused track or when
+	// they lose the picture; forward these requests to the publisher.
+	localTrack.OnKeyframeRequest(func() {
+		err := m.Conn.WriteRTCP([]rtcp.Packet{
+			&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())},
+		})
+		if err != nil {
+			log.Println("[onTrack] unable to send pli:", err)
+		}
+	})
+
+	m.mu.Lock()
+	published := slices.Contains(m.Tracks, localTrack)
+	if !published {
+		m.Tracks = append(m.Tracks, localTrack)
+	}
+	m.trackMids[localTrack] = mid
+	m.mu.Unlock()
+
+	// the subscribers of a restarted track keep receiving it as is
+	if !published {
+		if source == forward.SourceScreen {
+			m.publications.RecordEvent(record.ToggleEvent(record.EventScreenShare, m.Id, true))
+		}
+		select {
+		case m.TracksChannel <- localTrack:
+		case <-m.left:
+		}
+	}
 
+	done := make(chan struct{})
 	go func() {
 		utils.IncreaseThread()
 		defer utils.DecreaseThread()
+		m.watchTrack(localTrack, generation, mid, done)
+	}()
+
+	// the sender reports map the timestamps of the track to the publisher
+	// clock (e.g. to align the audio and video of the recordings)
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		m.readSenderReports(localTrack, generation, remoteTrack, receiver)
+	}()
+
+	if source == forward.SourceScreen && constants.ScreenMaxBitrate > 0 {
+		go func() {
+			utils.IncreaseThread()
+			defer utils.DecreaseThread()
+			m.capBitrate(localTrack, generation, remoteTrack, constants.ScreenMaxBitrate, done)
+		}()
+	}
+
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		defer close(done)
 		for {
-			packet, _, err := remoteTrack.ReadRTP()
+			// read the raw packet into a pooled buffer and only parse its
+			// header; the packet is shared by all of the subscribers
+			packet := forward.NewPacket()
+			n, _, err := remoteTrack.Read(packet.Buffer())
 			if err != nil {
+				packet.Release()
 				log.Println("[onTrack]", err)
+
+				// the receiver is stopped when the member removes the track
+				// (unless the whole connection is closing or the track has
+				// been restarted with another remote track)
+				if errors.Is(err, io.EOF) &&
+					localTrack.Generation() == generation &&
+					m.Conn.SignalingState() != webrtc.SignalingStateClosed {
+					m.unpublish(localTrack)
+				}
 				break
 			}
 
-			// record.SavePacketToDisk(writer, packet)
-			// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
-			if err := localTrack.WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
-				log.Println("[onTrack]", err)
+			if err := packet.Unmarshal(n); err != nil || len(packet.Payload) == 0 {
+				// drop malformed and padding only packets
+				packet.Release()
+				continue
+			}
+
+			// the track has been restarted with another remote track
+			if localTrack.Generation() != generation {
+				packet.Release()
 				break
 			}
+
+			// a failing subscriber shouldn't stop the track from reaching the
+			// rest of the subscribers
+			if err := localTrack.Write(packet); err != nil {
+				log.Println("[onTrack]", err)
+			}
+			packet.Release()
 		}
 	}()
 }
 
+// interval of the bitrate caps sent to the publishers; the browsers forget a
+// cap after a few seconds without a new one.
+const bitrateCapInterval = time.Second
+
+// ask the publisher to keep the bitrate of the remote track under `bitrate`
+// (bits per second) until the track is restarted or the receiver is stopped.
+// The cap is sent as a receiver estimated maximum bitrate.
+func (m *Member) capBitrate(track *forward.Track, generation uint64, remoteTrack *webrtc.TrackRemote, bitrate int, done chan struct{}) {
+	ticker := time.NewTicker(bitrateCapInterval)
+	defer ticker.Stop()
+
+	for {
+		err := m.Conn.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(bitrate),
+			SSRCs:   []uint32{uint32(remoteTrack.SSRC())},
+		}})
+		if err != nil {
+			log.Println("[capBitrate] unable to send remb:", err)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if track.Generation() != generation {
+			return
+		}
+	}
+}
+
+// forward the sender reports of the remote track to the track until the
+// track is restarted or the receiver is stopped.
+func (m *Member) readSenderReports(track *forward.Track, generation uint64, remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := receiver.Read(buffer)
+		if err != nil || track.Generation() != generation {
+			return
+		}
+
+		packets, err := rtcp.Unmarshal(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, packet := range packets {
+			report, ok := packet.(*rtcp.SenderReport)
+			if ok && report.SSRC == uint32(remoteTrack.SSRC()) {
+				track.WriteSenderReport(report.NTPTime, report.RTPTime)
+			}
+		}
+	}
+}
+
+// detect the track freezes: a track is stalled when it doesn't receive any
+// packet (or, for video, any keyframe) for a while. The publisher is asked
+// for a keyframe and the other members are notified (see TrackStateChannel)
+// when the track stalls and when it resumes. Tracks muted by the member are
+// expected to stall.
+func (m *Member) watchTrack(track *forward.Track, generation uint64, mid string, done <-chan struct{}) {
+	ticker := time.NewTicker(constants.Stall.Timeout / 4)
+	defer ticker.Stop()
+
+	started := time.Now()
+	stalled := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if track.Generation() != generation {
+			return
+		}
+
+		activity := track.Activity()
+		lastPacket := activity.LastPacket
+		if lastPacket.IsZero() {
+			lastPacket = started
+		}
+		lastKeyframe := activity.LastKeyframe
+		if lastKeyframe.Before(started) {
+			lastKeyframe = started
+		}
+
+		frozen := time.Since(lastPacket) > constants.Stall.Timeout ||
+			(track.Kind() == webrtc.RTPCodecTypeVideo && time.Since(lastKeyframe) > constants.Stall.KeyframeTimeout)
+		if frozen == stalled || (frozen && m.isMuted(mid)) {
+			continue
+		}
+
+		stalled = frozen
+		if stalled {
+			log.Printf("%s track %s of %d stalled", track.Kind().String(), track.ID(), m.Id)
+			track.RequestKeyframe()
+		}
+
+		select {
+		case m.TrackStateChannel <- TrackState{Track: track, Stalled: stalled}:
+		case <-done:
+			return
+		case <-m.left:
+			return
+		}
+	}
+}
+
+// check if the member declared the track of the transceiver as muted.
+func (m *Member) isMuted(mid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.declared[mid].Muted
+}
+
 func (m *Member) onICECandidate(candidate *webrtc.ICECandidate) {
 	if candidate == nil {
 		log.Printf("Got a null candiate; Ice gathering done.")
@@ -171,13 +458,35 @@ func (m *Member) onConnectionStateChange(cs webrtc.PeerConnectionState) {
 	if cs == webrtc.PeerConnectionStateClosed {
 		m.cleanup()
 	}
-	m.PeerConnectionState <- cs
+	select {
+	case m.PeerConnectionState <- cs:
+	case <-m.left:
+	}
+}
+
+// stop the notifications of the member (see the channels of the member)
+// once it left the session.
+func (m *Member) Leave() {
+	m.leaveOnce.Do(func() {
+		close(m.left)
+	})
 }
 
 func (m *Member) cleanup() {
 	for _, sender := range m.rtpSenders {
 		sender.Stop()
 	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, subscription := range m.subscriptions {
+		subscription.downTrack.Track().RemoveDownTrack(subscription.downTrack)
+	}
+	m.subscriptions = map[string]subscription{}
+	m.outbound.Close()
+
+	// keep the published tracks in case the member reconnects
+	m.publications.Release(m)
 }
 
 func (m *Member) onICEConnectionStateChange(is webrtc.ICEConnectionState) {
@@ -202,7 +511,15 @@ func (m *Member) onNegotiationNeeded() {
 		m.Conn.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionRecvonly,
 		})
+		// add receive only screen share transceiver (must be the third, will have mid=2)
+		screen := utils.Must(m.Conn.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}))
+		defer func() {
+			m.SetTrackSource(screen.Mid(), forward.SourceScreen)
+		}()
 	}
+	m.RestrictReceivedCodecs()
 
 	localSdp := utils.Must(m.Conn.CreateOffer(nil))
 	utils.Unwrap(m.Conn.SetLocalDescription(localSdp))
@@ -210,9 +527,80 @@ func (m *Member) onNegotiationNeeded() {
 	m.Socket.SendOfferMessage(&localSdp)
 }
 
-func (m *Member) SendTrack(track *webrtc.TrackLocalStaticRTP) error {
-	rtpSender, err := m.Conn.AddTrack(track)
+// exclude the codecs the server only sends (see codecs.Receivable) from the
+// transceivers receiving the tracks of the member. It should be called
+// before answering an offer of the member.
+func (m *Member) RestrictReceivedCodecs() {
+	for _, transceiver := range m.Conn.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo ||
+			transceiver.Direction() != webrtc.RTPTransceiverDirectionRecvonly {
+			continue
+		}
+
+		// the parameters of the receiver list the negotiable codecs along
+		// with their feedback
+		all := transceiver.Receiver().GetParameters().Codecs
+		receivable := codecs.Receivable(all)
+		if len(receivable) == len(all) {
+			continue
+		}
+		if err := transceiver.SetCodecPreferences(receivable); err != nil {
+			log.Printf("unable to set the codecs received from %d: %s", m.Id, err)
+		}
+	}
+}
+
+// check if the member is able to decode a track encoded with the given codec
+// based on the codecs the member offered.
+func (m *Member) SupportsCodec(codec webrtc.RTPCodecCapability) bool {
+	desc := m.Conn.RemoteDescription()
+	if desc == nil {
+		return false
+	}
+
+	kind := webrtc.RTPCodecTypeVideo
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+		kind = webrtc.RTPCodecTypeAudio
+	}
+
+	offered, err := codecs.FromSessionDescription(desc, kind)
+	if err != nil {
+		log.Printf("unable to parse the session description of %d: %s", m.Id, err)
+		return false
+	}
+
+	return codecs.Supported(codec, offered)
+}
+
+// send a track, published by another member (`from`), to this member. The
+// subscription is rejected in case the member cannot decode the track codec.
+func (m *Member) SendTrack(from MemberId, track *forward.Track) error {
+	// the member is already receiving the track (e.g. the publisher reconnected)
+	if downTrack := m.getSubscription(track.ID()); downTrack != nil && downTrack.Track() == track {
+		return nil
+	}
+
+	// video tracks are added once the member leaves the audio only mode
+	if m.IsAudioOnly() && track.Kind() == webrtc.RTPCodecTypeVideo {
+		return nil
+	}
+
+	if !m.SupportsCodec(track.Codec()) {
+		log.Printf(
+			"Unable to send %s track from %d to %d: %s is not supported",
+			track.Kind().String(),
+			from,
+			m.Id,
+			track.Codec().MimeType,
+		)
+		m.Socket.SendSubscriptionRejectedMessage(from, track.ID(), "unsupported-codec")
+		return ErrUnsupportedCodec
+	}
+
+	downTrack := track.NewDownTrack(m.outbound)
+	rtpSender, err := m.Conn.AddTrack(downTrack)
 	if err != nil {
+		track.RemoveDownTrack(downTrack)
 		log.Printf(
 			"Unable to add track to peer (%d) connection: %s",
 			m.Id,
@@ -220,7 +608,12 @@ func (m *Member) SendTrack(track *webrtc.TrackLocalStaticRTP) error {
 		)
 		return err
 	}
+	m.mu.Lock()
 	m.rtpSenders = append(m.rtpSenders, rtpSender)
+	m.subscriptions[track.ID()] = subscription{downTrack: downTrack, sender: rtpSender}
+	m.mu.Unlock()
+
+	m.Socket.SendTrackPublishedMessage(from, track.ID(), string(track.Source()))
 
 	// Read incoming RTCP packets
 	// Before these packets are returned they are processed by interceptors. For things
@@ -228,9 +621,9 @@ func (m *Member) SendTrack(track *webrtc.TrackLocalStaticRTP) error {
 	go func() {
 		utils.IncreaseThread()
 		defer utils.DecreaseThread()
-		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				log.Printf(
 					"Unable to read rtcp for peer %d: %s",
 					m.Id,
@@ -238,12 +631,285 @@ func (m *Member) SendTrack(track *webrtc.TrackLocalStaticRTP) error {
 				)
 				return
 			}
+
+			for _, packet := range packets {
+				switch packet := packet.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					track.RequestKeyframe()
+				case *rtcp.ReceiverReport:
+					for _, report := range packet.Reports {
+						if report.SSRC == uint32(downTrack.SSRC()) {
+							downTrack.HandleFractionLost(report.FractionLost)
+						}
+					}
+				}
+			}
 		}
 	}()
 
 	return nil
 }
 
+// stop receiving a track from another member without renegotiating the
+// peer connection.
+func (m *Member) PauseTrack(trackId string) error {
+	downTrack := m.getSubscription(trackId)
+	if downTrack == nil {
+		return errors.New("track not found")
+	}
+
+	m.mu.Lock()
+	m.paused[trackId] = true
+	m.mu.Unlock()
+
+	downTrack.Pause()
+	return nil
+}
+
+// continue receiving a paused track. A keyframe is requested from the
+// publisher so that the video can be rendered immediately.
+func (m *Member) ResumeTrack(trackId string) error {
+	downTrack := m.getSubscription(trackId)
+	if downTrack == nil {
+		return errors.New("track not found")
+	}
+
+	m.mu.Lock()
+	delete(m.paused, trackId)
+	audioOnly := m.AudioOnly
+	m.mu.Unlock()
+
+	// the video stays paused until the member leaves the audio only mode
+	if audioOnly && downTrack.Kind() == webrtc.RTPCodecTypeVideo {
+		return nil
+	}
+
+	downTrack.Resume()
+	return nil
+}
+
+func (m *Member) IsAudioOnly() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.AudioOnly
+}
+
+// stop (or continue) forwarding video to the member. The video tracks the
+// member is already receiving are paused (no renegotiation needed); new
+// video tracks are not sent to the member at all. Leaving the audio only
+// mode resumes the video tracks that were not paused by the member; the
+// caller should send the video tracks added in the meantime (see SendTrack).
+func (m *Member) SetAudioOnly(audioOnly bool) {
+	m.mu.Lock()
+	m.AudioOnly = audioOnly
+	downTracks := []*forward.DownTrack{}
+	for trackId, subscription := range m.subscriptions {
+		if subscription.downTrack.Kind() == webrtc.RTPCodecTypeVideo && !m.paused[trackId] {
+			downTracks = append(downTracks, subscription.downTrack)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, downTrack := range downTracks {
+		if audioOnly {
+			downTrack.Pause()
+		} else {
+			downTrack.Resume()
+		}
+	}
+}
+
+// set the highest spatial and temporal layers to receive from a scalable
+// (VP9/AV1 SVC) track. The server may forward lower layers in case of packet
+// loss.
+func (m *Member) SetTrackLayer(trackId string, layer forward.Layer) error {
+	downTrack := m.getSubscription(trackId)
+	if downTrack == nil {
+		return errors.New("track not found")
+	}
+	downTrack.SetTargetLayer(layer)
+	return nil
+}
+
+// the tracks published by the member.
+func (m *Member) GetTracks() []*forward.Track {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.Tracks)
+}
+
+// set the source of the track the member sends on the transceiver with the
+// given mid. The source applies to the tracks received afterwards.
+func (m *Member) SetTrackSource(mid string, source forward.Source) error {
+	if !source.IsValid() {
+		return errors.New("unknown track source")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metadata := m.declared[mid]
+	metadata.Source = string(source)
+	m.declared[mid] = metadata
+	return nil
+}
+
+var contentHints = []string{"", "motion", "detail", "text", "speech", "speech-recognition", "music"}
+
+// replace the tracks declared by the member. The audio and video state of the
+// member follows the declared microphone and camera tracks.
+func (m *Member) SetDeclaredTracks(tracks map[string]wss.TrackMetadata) error {
+	for _, metadata := range tracks {
+		if !forward.Source(metadata.Source).IsValid() {
+			return errors.New("unknown track source")
+		}
+		if !slices.Contains(contentHints, metadata.ContentHint) {
+			return errors.New("unknown content hint")
+		}
+	}
+
+	audio := false
+	video := false
+	for _, metadata := range tracks {
+		switch forward.Source(metadata.Source) {
+		case forward.SourceMicrophone:
+			audio = audio || !metadata.Muted
+		case forward.SourceCamera:
+			video = video || !metadata.Muted
+		}
+	}
+
+	m.mu.Lock()
+	m.declared = maps.Clone(tracks)
+	m.mu.Unlock()
+
+	m.SetAudio(audio)
+	m.SetVideo(video)
+	return nil
+}
+
+// the tracks declared by the member along with the id of their forwarded
+// track (once received).
+func (m *Member) GetDeclaredTracks() []wss.PublishedTrack {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tracks := []wss.PublishedTrack{}
+	for mid, metadata := range m.declared {
+		published := wss.PublishedTrack{TrackMetadata: metadata}
+		for track, trackMid := range m.trackMids {
+			if trackMid == mid {
+				published.Track = track.ID()
+			}
+		}
+		tracks = append(tracks, published)
+	}
+	return tracks
+}
+
+func (m *Member) getSubscription(trackId string) *forward.DownTrack {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.subscriptions[trackId].downTrack
+}
+
+// stop receiving a track that is no longer published by its member. The
+// track is removed from the peer connection which triggers a renegotiation.
+func (m *Member) Unsubscribe(track *forward.Track) {
+	m.mu.Lock()
+	subscription, ok := m.subscriptions[track.ID()]
+	if !ok || subscription.downTrack.Track() != track {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.subscriptions, track.ID())
+	m.rtpSenders = slices.DeleteFunc(m.rtpSenders, func(sender *webrtc.RTPSender) bool {
+		return sender == subscription.sender
+	})
+	m.mu.Unlock()
+
+	track.RemoveDownTrack(subscription.downTrack)
+	if err := m.Conn.RemoveTrack(subscription.sender); err != nil {
+		log.Printf("unable to remove track %s from %d: %s", track.ID(), m.Id, err)
+	}
+}
+
+// remove the tracks of the transceivers the member is no longer sending on
+// (inactive, recvonly or stopped in its latest offer).
+func (m *Member) UnpublishInactiveTracks() {
+	desc := m.Conn.RemoteDescription()
+	if desc == nil {
+		return
+	}
+
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		log.Printf("unable to parse the session description of %d: %s", m.Id, err)
+		return
+	}
+
+	inactive := map[string]bool{}
+	for _, media := range parsed.MediaDescriptions {
+		mid, _ := media.Attribute(sdp.AttrKeyMID)
+		_, recvonly := media.Attribute(sdp.AttrKeyRecvOnly)
+		_, disabled := media.Attribute(sdp.AttrKeyInactive)
+		// a zero port marks a stopped transceiver
+		if recvonly || disabled || media.MediaName.Port.Value == 0 {
+			inactive[mid] = true
+		}
+	}
+
+	m.mu.Lock()
+	unpublished := []*forward.Track{}
+	for track, mid := range m.trackMids {
+		if inactive[mid] {
+			unpublished = append(unpublished, track)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, track := range unpublished {
+		m.unpublish(track)
+	}
+}
+
+// remove a track published by the member and notify its subscribers (see
+// UnpublishedChannel). The subscribers of a member that left the session are
+// notified by the session publications instead.
+func (m *Member) unpublish(track *forward.Track) {
+	m.mu.Lock()
+	if !slices.Contains(m.Tracks, track) {
+		m.mu.Unlock()
+		return
+	}
+	m.Tracks = slices.DeleteFunc(m.Tracks, func(t *forward.Track) bool {
+		return t == track
+	})
+	delete(m.trackMids, track)
+	m.mu.Unlock()
+
+	log.Printf("member %d unpublished %s track %s", m.Id, track.Kind().String(), track.ID())
+	if track.Source() == forward.SourceScreen {
+		m.publications.RecordEvent(record.ToggleEvent(record.EventScreenShare, m.Id, false))
+	}
+	track.Close()
+	m.publications.Remove(track)
+	select {
+	case m.UnpublishedChannel <- track:
+	case <-m.left:
+		m.publications.Unpublished(m.Id, track)
+	}
+}
+
+// whether the member is publishing a screen share.
+func (m *Member) IsSharingScreen() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.ContainsFunc(m.Tracks, func(track *forward.Track) bool {
+		return track.Source() == forward.SourceScreen
+	})
+}
+
 func (m *Member) SetAudio(audio bool) {
 	m.Audio = audio
 }
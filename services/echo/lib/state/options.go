@@ -0,0 +1,94 @@
+package state
+
+import (
+	"echo/constants"
+	"echo/lib/codecs"
+	"echo/lib/netsim"
+	"errors"
+	"slices"
+)
+
+// per session settings. They can be changed by the admin api and will be
+// applied to the members joining the session afterwards. Sessions without
+// explicit options use the defaults from the environment.
+type Options struct {
+	// negotiate RTX retransmissions for video
+	RTX bool `json:"rtx"`
+	// forward error correction for video ("flexfec", "ulpfec" or empty to
+	// disable it)
+	FEC string `json:"fec"`
+	// negotiate redundant audio (opus red)
+	RED bool `json:"red"`
+	// opus settings: speech, music or low-bandwidth (empty keeps the browsers
+	// defaults)
+	AudioProfile string `json:"audioProfile"`
+	// allow more than one member to share its screen at the same time. Unlike
+	// the other options, it applies to the members already in the session.
+	MultipleScreenShares bool `json:"multipleScreenShares"`
+	// simulated network conditions of the members connections, for testing
+	// only (see constants.Features.EnableNetworkSimulation)
+	Simulation *netsim.Config `json:"simulation,omitempty"`
+	// simulated network conditions by member; they replace the session ones
+	MemberSimulations map[MemberId]netsim.Config `json:"memberSimulations,omitempty"`
+	// members allowed to control the session (e.g. start the recording); they
+	// are authenticated by their host token (see State.IssueHostToken)
+	Hosts []MemberId `json:"hosts"`
+	// the members agreed to be recorded; the session cannot be recorded
+	// otherwise
+	RecordingConsent bool `json:"recordingConsent"`
+}
+
+func DefaultOptions() Options {
+	return Options{
+		RTX:          constants.Protection.RTX,
+		FEC:          constants.Protection.FEC,
+		RED:          constants.Protection.RED,
+		AudioProfile: constants.AudioProfile,
+	}
+}
+
+func (o Options) Validate() error {
+	if o.FEC != "" && o.FEC != "flexfec" && o.FEC != "ulpfec" {
+		return errors.New("unsupported fec scheme")
+	}
+	if !codecs.IsAudioProfile(o.AudioProfile) {
+		return codecs.ErrUnknownAudioProfile
+	}
+
+	if o.Simulation == nil && len(o.MemberSimulations) == 0 {
+		return nil
+	}
+	if !constants.Features.EnableNetworkSimulation {
+		return errors.New("network simulation is disabled")
+	}
+	if o.Simulation != nil {
+		if err := o.Simulation.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, simulation := range o.MemberSimulations {
+		if err := simulation.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o Options) IsHost(mid MemberId) bool {
+	return slices.Contains(o.Hosts, mid)
+}
+
+// the simulated network conditions of a member connection, if any.
+func (o Options) SimulationFor(mid MemberId) (netsim.Config, bool) {
+	if !constants.Features.EnableNetworkSimulation {
+		return netsim.Config{}, false
+	}
+
+	if simulation, ok := o.MemberSimulations[mid]; ok {
+		return simulation, true
+	}
+	if o.Simulation != nil {
+		return *o.Simulation, true
+	}
+	return netsim.Config{}, false
+}
@@ -0,0 +1,382 @@
+package state
+
+import (
+	"crypto/subtle"
+	"echo/constants"
+	"echo/lib/codecs"
+	"echo/lib/forward"
+	"echo/lib/record"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Publications holds the forwarded tracks of the members of a session. There
+// is a single track per member and source (e.g. microphone or camera) that
+// is kept across renegotiations and reconnections of the member; the
+// subscribers keep receiving the same track instead of adding a new one for
+// every remote track of the publisher.
+//
+// Only one member can share its screen at a time unless the session allows
+// multiple screen shares.
+//
+// The published tracks are recorded while the session recording is started.
+// The camera and the microphone of a member are streamed live while the
+// live stream of the session follows the member.
+type Publications struct {
+	mu      sync.Mutex
+	session SessionId
+	tracks  map[publicationKey]*publication
+	// allow more than one member to share its screen at the same time
+	multipleScreenShares bool
+	// the current (or latest stopped) recording of the session; nil unless
+	// the session has been recorded
+	recording *record.Recording
+	// the live stream of the session; nil unless started
+	live *liveOutput
+	// notifies the subscribers of a track unpublished by a member that left
+	// the session
+	onUnpublished func(MemberId, *forward.Track)
+}
+
+// liveOutput is the live stream of a session following one of its members.
+type liveOutput struct {
+	stream *record.LiveStream
+	member MemberId
+	// authorizes the viewers of the stream
+	token string
+}
+
+var (
+	ErrScreenShareActive = errors.New("another member is sharing the screen")
+	ErrNotRecording      = errors.New("the session is not being recorded")
+	ErrRecordingFailed   = errors.New("unable to start recording")
+)
+
+type publicationKey struct {
+	member MemberId
+	source forward.Source
+}
+
+type publication struct {
+	track *forward.Track
+	// the member (connection) currently publishing the track
+	owner *Member
+	// removes the publication once the grace period ends
+	expiry *time.Timer
+}
+
+func NewPublications(sid SessionId, options Options) *Publications {
+	return &Publications{
+		session:              sid,
+		tracks:               map[publicationKey]*publication{},
+		multipleScreenShares: options.MultipleScreenShares,
+	}
+}
+
+// apply the session options that affect the published tracks.
+func (p *Publications) SetOptions(options Options) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.multipleScreenShares = options.MultipleScreenShares
+}
+
+// find the track published by the member from the given source or create a
+// new one. The existing track is only reused in case the new stream can be
+// forwarded to its subscribers as is (same codec); otherwise it is
+// unpublished before the new track replaces it. Returns true in case the
+// track has been reused.
+func (p *Publications) Acquire(
+	member *Member,
+	source forward.Source,
+	codec webrtc.RTPCodecCapability,
+	create func() *forward.Track,
+) (*forward.Track, bool, error) {
+	track, reused, replaced, err := p.acquire(member, source, codec, create)
+	// the subscribers drop the replaced track before they receive the new one
+	if replaced != nil {
+		replaced.owner.unpublish(replaced.track)
+	}
+	return track, reused, err
+}
+
+func (p *Publications) acquire(
+	member *Member,
+	source forward.Source,
+	codec webrtc.RTPCodecCapability,
+	create func() *forward.Track,
+) (*forward.Track, bool, *publication, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if source == forward.SourceScreen && !p.multipleScreenShares {
+		// the screen shares of the members that left are ignored (they
+		// are dropped unless the member rejoins in time)
+		for key, pub := range p.tracks {
+			if key.source == forward.SourceScreen && key.member != member.Id && pub.expiry == nil {
+				return nil, false, nil, ErrScreenShareActive
+			}
+		}
+	}
+
+	key := publicationKey{member: member.Id, source: source}
+	existing := p.tracks[key]
+	if existing != nil && existing.expiry != nil {
+		existing.expiry.Stop()
+		existing.expiry = nil
+	}
+
+	if existing != nil && codecs.Compatible(existing.track.Codec(), codec) {
+		existing.owner = member
+		return existing.track, true, nil, nil
+	}
+
+	track := create()
+	p.tracks[key] = &publication{track: track, owner: member}
+
+	if p.recording != nil {
+		if err := p.recording.AddTrack(member.Id, track); err != nil {
+			log.Printf("unable to record %s track of %d: %s", source, member.Id, err)
+		}
+	}
+	if p.live != nil && p.live.member == member.Id && isLiveSource(source) {
+		p.addLiveTrack(key, track)
+	}
+	return track, false, existing, nil
+}
+
+// set the handler notifying the subscribers of the tracks unpublished by
+// the members that left the session.
+func (p *Publications) OnUnpublished(handler func(MemberId, *forward.Track)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onUnpublished = handler
+}
+
+// notify the subscribers of a track unpublished by a member that left the
+// session.
+func (p *Publications) Unpublished(publisher MemberId, track *forward.Track) {
+	p.mu.Lock()
+	handler := p.onUnpublished
+	p.mu.Unlock()
+
+	if handler != nil {
+		handler(publisher, track)
+	}
+}
+
+// forget a track that is no longer published.
+func (p *Publications) Remove(track *forward.Track) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, pub := range p.tracks {
+		if pub.track != track {
+			continue
+		}
+		if pub.expiry != nil {
+			pub.expiry.Stop()
+		}
+		delete(p.tracks, key)
+	}
+}
+
+// keep the tracks published by a member (that left the session) for the
+// grace period; they are reused in case the member rejoins in time.
+// Otherwise the tracks are unpublished like the tracks removed by the
+// member.
+func (p *Publications) Release(member *Member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, pub := range p.tracks {
+		if pub.owner != member || pub.expiry != nil {
+			continue
+		}
+
+		pub.expiry = time.AfterFunc(constants.TrackGracePeriod, func() {
+			p.mu.Lock()
+			expired := p.tracks[key] == pub && pub.owner == member
+			if expired {
+				// the member can no longer reuse the track
+				delete(p.tracks, key)
+			}
+			p.mu.Unlock()
+
+			// nobody is going to publish the track again
+			if expired {
+				member.unpublish(pub.track)
+			}
+		})
+	}
+}
+
+func (p *Publications) RecordingStatus() record.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.recording == nil {
+		return record.StatusStopped
+	}
+	return p.recording.Status()
+}
+
+// the uploads of the current (or latest) recording; false in case the
+// session has not been recorded or the recordings are not uploaded.
+func (p *Publications) RecordingUpload() (record.UploadStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.recording == nil {
+		return record.UploadStatus{}, false
+	}
+	return p.recording.Upload()
+}
+
+// start, pause, resume or stop recording the published tracks. A stopped
+// recording is finalized; starting again creates a new recording. Returns
+// true in case the status changed.
+func (p *Publications) SetRecordingStatus(status record.Status) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := record.StatusStopped
+	if p.recording != nil {
+		current = p.recording.Status()
+	}
+	if current == status {
+		return false, nil
+	}
+
+	switch status {
+	case record.StatusRecording:
+		if current == record.StatusPaused {
+			p.recording.Resume()
+			return true, nil
+		}
+
+		recording, err := record.NewRecording(p.session, record.Options{
+			Directory:       constants.Recording.Directory,
+			SegmentDuration: constants.Recording.SegmentDuration,
+			Storage:         recordingStorage(),
+			MasterKey:       recordingMasterKey(),
+		})
+		if err != nil {
+			log.Printf("[record] unable to record %s: %s", p.session, err)
+			return false, ErrRecordingFailed
+		}
+		p.recording = recording
+		for key, pub := range p.tracks {
+			if err := p.recording.AddTrack(key.member, pub.track); err != nil {
+				log.Printf("unable to record %s track of %d: %s", key.source, key.member, err)
+			}
+		}
+	case record.StatusPaused:
+		if current == record.StatusStopped {
+			return false, ErrNotRecording
+		}
+		p.recording.Pause()
+	case record.StatusStopped:
+		p.recording.Close()
+	default:
+		return false, ErrInvalidRecordingStatus
+	}
+	return true, nil
+}
+
+// add an event to the timeline of the session recording (if any).
+func (p *Publications) RecordEvent(event record.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.recording != nil {
+		p.recording.AddEvent(event)
+	}
+}
+
+// the sources of a member streamed live.
+func isLiveSource(source forward.Source) bool {
+	return source == forward.SourceCamera || source == forward.SourceMicrophone
+}
+
+func (p *Publications) addLiveTrack(key publicationKey, track *forward.Track) {
+	if err := p.live.stream.AddTrack(track); err != nil {
+		log.Printf("unable to stream %s track of %d: %s", key.source, key.member, err)
+	}
+}
+
+// start streaming the session live following the member (or follow another
+// member). Returns the token of the stream.
+func (p *Publications) SetLiveMember(member MemberId) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.live == nil {
+		token, err := newToken()
+		if err != nil {
+			return "", err
+		}
+		p.live = &liveOutput{
+			stream: record.NewLiveStream(constants.Live.SegmentDuration),
+			member: member,
+			token:  token,
+		}
+	} else if p.live.member == member {
+		return p.live.token, nil
+	} else {
+		for key, pub := range p.tracks {
+			if key.member == p.live.member {
+				p.live.stream.RemoveTrack(pub.track)
+			}
+		}
+		p.live.member = member
+	}
+
+	for key, pub := range p.tracks {
+		if key.member == member && isLiveSource(key.source) {
+			p.addLiveTrack(key, pub.track)
+		}
+	}
+	return p.live.token, nil
+}
+
+// stop the live stream of the session. Returns false in case the session
+// was not streamed.
+func (p *Publications) StopLive() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.live == nil {
+		return false
+	}
+	p.live.stream.Close()
+	p.live = nil
+	return true
+}
+
+// the member followed by the live stream and the token of the stream; false
+// unless the session is streamed.
+func (p *Publications) LiveStatus() (MemberId, string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.live == nil {
+		return 0, "", false
+	}
+	return p.live.member, p.live.token, true
+}
+
+// the live stream authorized by the token; nil unless the session is
+// streamed with this token.
+func (p *Publications) LiveStream(token string) *record.LiveStream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.live == nil || subtle.ConstantTimeCompare([]byte(token), []byte(p.live.token)) != 1 {
+		return nil
+	}
+	return p.live.stream
+}
@@ -0,0 +1,106 @@
+package state
+
+import (
+	"context"
+	"echo/constants"
+	"echo/lib/record"
+	"echo/lib/utils"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// storage the recordings are uploaded to (nil keeps them in the recordings
+// directory); created once the settings are loaded
+var recordingStorage = sync.OnceValue(newRecordingStorage)
+
+// key the recordings are encrypted with (nil keeps them unencrypted)
+var recordingMasterKey = sync.OnceValue(newRecordingMasterKey)
+
+// never record in plaintext when the key is set but invalid.
+func newRecordingMasterKey() []byte {
+	if constants.Recording.MasterKey == "" {
+		return nil
+	}
+	key, err := record.ParseMasterKey(constants.Recording.MasterKey)
+	if err != nil {
+		log.Fatalf("[record] invalid RECORDING_MASTER_KEY: %s", err)
+	}
+	return key
+}
+
+func newRecordingStorage() record.Storage {
+	settings := constants.RecordingStorage
+	switch settings.Kind {
+	case "":
+		return nil
+	case "local":
+		if settings.Directory == "" || filepath.Clean(settings.Directory) == filepath.Clean(constants.Recording.Directory) {
+			log.Println("[record] the storage directory should differ from the recordings directory")
+			return nil
+		}
+		return record.LocalStorage{Directory: settings.Directory}
+	case "s3":
+		return &record.S3Storage{
+			Endpoint:  settings.Endpoint,
+			Region:    settings.Region,
+			Bucket:    settings.Bucket,
+			Prefix:    settings.Prefix,
+			AccessKey: settings.AccessKey,
+			SecretKey: settings.SecretKey,
+			PathStyle: settings.PathStyle,
+		}
+	default:
+		log.Printf("[record] unknown recording storage %q", settings.Kind)
+		return nil
+	}
+}
+
+// the recordings of the session, oldest first.
+func (s *State) ListSessionRecordings(sid SessionId) ([]record.Summary, error) {
+	return record.ListRecordings(constants.Recording.Directory, sid)
+}
+
+// the manifest of a recording of the session.
+func (s *State) GetSessionRecordingManifest(sid SessionId, id string) (record.Manifest, error) {
+	return record.ReadManifest(constants.Recording.Directory, sid, id)
+}
+
+// open a file of a recording of the session (see record.OpenFile).
+func (s *State) OpenSessionRecordingFile(ctx context.Context, sid SessionId, id string, file string, byteRange string) (record.Object, error) {
+	return record.OpenFile(ctx, constants.Recording.Directory, recordingStorage(), sid, id, file, byteRange)
+}
+
+// remove the plaintext segments left unfinished by a previous process (see
+// record.RemovePartialFiles).
+func (s *State) RemovePartialRecordingFiles() {
+	record.RemovePartialFiles(constants.Recording.Directory)
+}
+
+// upload the recordings left behind by a previous process (see
+// record.ResumeUploads).
+func (s *State) ResumeRecordingUploads() {
+	if recordingStorage() == nil {
+		return
+	}
+	record.ResumeUploads(constants.Recording.Directory, recordingStorage())
+}
+
+// delete the expired recordings periodically (see record.Retention).
+func (s *State) StartRecordingRetention() {
+	retention := record.Retention{
+		Directory: constants.Recording.Directory,
+		Storage:   recordingStorage(),
+		MaxAge:    constants.Recording.MaxAge,
+		Quota:     constants.Recording.Quota,
+	}
+	if retention.MaxAge <= 0 && retention.Quota <= 0 {
+		return
+	}
+
+	go func() {
+		utils.IncreaseThread()
+		defer utils.DecreaseThread()
+		retention.Run()
+	}()
+}
@@ -1,7 +1,11 @@
 package state
 
 import (
+	"echo/constants"
+	"echo/lib/forward"
+	"echo/lib/record"
 	"echo/lib/utils"
+	"echo/lib/wss"
 	"errors"
 	"log"
 	"slices"
@@ -12,9 +16,17 @@ import (
 
 type SessionId = string
 
+var (
+	ErrInvalidRecordingStatus = errors.New("invalid recording status")
+	ErrRecordingDisabled      = errors.New("recording is disabled")
+	ErrNoRecordingConsent     = errors.New("the members did not consent to be recorded")
+	ErrNotHost                = errors.New("the member is not a host of the session")
+)
+
 type Session struct {
 	Id      SessionId
 	Members []*Member
+	Options Options
 }
 
 func (s *Session) IsEmpty() bool {
@@ -68,6 +80,7 @@ func (s *Session) SetMemberVideo(mid MemberId, video bool) error {
 	}
 
 	member.SetVideo(video)
+	member.publications.RecordEvent(record.ToggleEvent(record.EventVideo, mid, video))
 
 	s.Broadcast(mid, func(member *Member) {
 		member.Socket.SendToggleVideoMessage(mid, video)
@@ -87,6 +100,7 @@ func (s *Session) SetMemberAudio(mid MemberId, audio bool) error {
 	}
 
 	member.SetAudio(audio)
+	member.publications.RecordEvent(record.ToggleEvent(record.EventAudio, mid, audio))
 
 	s.Broadcast(mid, func(member *Member) {
 		member.Socket.SendToggleAudioMessage(mid, audio)
@@ -95,14 +109,235 @@ func (s *Session) SetMemberAudio(mid MemberId, audio bool) error {
 	return nil
 }
 
+// switch a member to (or from) the audio only mode and let the other members
+// know they shouldn't expect video to reach that member. Leaving the audio
+// only mode sends the video tracks published in the meantime.
+func (s *Session) SetMemberAudioOnly(mid MemberId, audioOnly bool) error {
+	member := s.GetMember(mid)
+
+	if member == nil {
+		return errors.New("member not found")
+	}
+
+	member.SetAudioOnly(audioOnly)
+
+	s.Broadcast(mid, func(m *Member) {
+		if !audioOnly {
+			for _, track := range m.GetTracks() {
+				member.SendTrack(m.Id, track)
+			}
+		}
+		m.Socket.SendAudioOnlyMessage(mid, audioOnly)
+	})
+
+	return nil
+}
+
+// replace the tracks declared by a member and broadcast them to the other
+// members. The members are notified as well in case the declared tracks
+// turned the audio or video of the member on or off.
+func (s *Session) SetMemberTracks(mid MemberId, tracks map[string]wss.TrackMetadata) error {
+	member := s.GetMember(mid)
+
+	if member == nil {
+		return errors.New("member not found")
+	}
+
+	audio := member.Audio
+	video := member.Video
+	if err := member.SetDeclaredTracks(tracks); err != nil {
+		return err
+	}
+
+	if member.Audio != audio {
+		member.publications.RecordEvent(record.ToggleEvent(record.EventAudio, mid, member.Audio))
+	}
+	if member.Video != video {
+		member.publications.RecordEvent(record.ToggleEvent(record.EventVideo, mid, member.Video))
+	}
+
+	declared := member.GetDeclaredTracks()
+	s.Broadcast(mid, func(m *Member) {
+		m.Socket.SendMemberTracksMessage(mid, declared)
+		if member.Audio != audio {
+			m.Socket.SendToggleAudioMessage(mid, member.Audio)
+		}
+		if member.Video != video {
+			m.Socket.SendToggleVideoMessage(mid, member.Video)
+		}
+	})
+
+	return nil
+}
+
 type State struct {
 	mu       sync.Mutex
 	Sessions map[SessionId]*Session
+	// options of the sessions, kept even when the session is empty (or not
+	// started yet).
+	options map[SessionId]Options
+	// tracks published in the sessions, kept while the members reconnect.
+	publications map[SessionId]*Publications
+	// tokens authenticating the hosts of the sessions (see IssueHostToken)
+	hostTokens map[SessionId]map[MemberId]string
 }
 
 func New() State {
 	return State{
-		Sessions: make(map[SessionId]*Session),
+		Sessions:     make(map[SessionId]*Session),
+		options:      make(map[SessionId]Options),
+		publications: make(map[SessionId]*Publications),
+		hostTokens:   make(map[SessionId]map[MemberId]string),
+	}
+}
+
+func (s *State) GetSessionOptions(sid SessionId) Options {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	options, ok := s.options[sid]
+	if !ok {
+		return DefaultOptions()
+	}
+	return options
+}
+
+func (s *State) GetSessionPublications(sid SessionId) *Publications {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	publications, ok := s.publications[sid]
+	if !ok {
+		options, ok := s.options[sid]
+		if !ok {
+			options = DefaultOptions()
+		}
+		publications = NewPublications(sid, options)
+		publications.OnUnpublished(func(publisher MemberId, track *forward.Track) {
+			s.unpublishTrack(sid, publisher, track)
+		})
+		s.publications[sid] = publications
+	}
+	return publications
+}
+
+func (s *State) SetSessionOptions(sid SessionId, options Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.options[sid] = options
+	// the members who are no longer hosts lose their tokens
+	for mid := range s.hostTokens[sid] {
+		if !options.IsHost(mid) {
+			delete(s.hostTokens[sid], mid)
+		}
+	}
+	if session := s.Sessions[sid]; session != nil {
+		session.Options = options
+	}
+	if publications := s.publications[sid]; publications != nil {
+		publications.SetOptions(options)
+		// the members withdrew their consent
+		if !options.RecordingConsent {
+			s.stopRecording(sid, publications)
+			if publications.StopLive() {
+				log.Printf("session %s is no longer streamed live", sid)
+			}
+		}
+	}
+	return nil
+}
+
+// allow (or forbid) more than one member of the session to share its screen
+// at the same time and let its members know. The screen shares already
+// published are kept.
+func (s *State) SetSessionScreenShares(sid SessionId, multiple bool) error {
+	options := s.GetSessionOptions(sid)
+	if options.MultipleScreenShares == multiple {
+		return nil
+	}
+
+	options.MultipleScreenShares = multiple
+	if err := s.SetSessionOptions(sid, options); err != nil {
+		return err
+	}
+
+	for _, member := range s.GetSessionMembers(sid) {
+		member.Socket.SendScreenSharesMessage(multiple)
+	}
+	return nil
+}
+
+// start, pause, resume or stop recording a session and let its members know.
+// The session is only recorded in case its members consented (see
+// Options.RecordingConsent).
+func (s *State) SetSessionRecording(sid SessionId, status record.Status) error {
+	if !status.IsValid() {
+		return ErrInvalidRecordingStatus
+	}
+	if status != record.StatusStopped {
+		if !constants.Features.EnableRecording {
+			return ErrRecordingDisabled
+		}
+		if !s.GetSessionOptions(sid).RecordingConsent {
+			return ErrNoRecordingConsent
+		}
+	}
+
+	publications := s.GetSessionPublications(sid)
+	started := publications.RecordingStatus() == record.StatusStopped
+	changed, err := publications.SetRecordingStatus(status)
+	if err != nil {
+		return err
+	}
+
+	// the timeline of a new recording starts with the current state of the
+	// members
+	if changed && started {
+		for _, member := range s.GetSessionMembers(sid) {
+			publications.RecordEvent(record.MemberEvent(record.EventJoined, member.Id))
+			publications.RecordEvent(record.ToggleEvent(record.EventAudio, member.Id, member.Audio))
+			publications.RecordEvent(record.ToggleEvent(record.EventVideo, member.Id, member.Video))
+			if member.IsSharingScreen() {
+				publications.RecordEvent(record.ToggleEvent(record.EventScreenShare, member.Id, true))
+			}
+		}
+	}
+
+	if changed {
+		log.Printf("session %s recording is %s", sid, status)
+		for _, member := range s.GetSessionMembers(sid) {
+			member.Socket.SendRecordingMessage(string(status))
+		}
+	}
+	return nil
+}
+
+func (s *State) GetSessionRecording(sid SessionId) record.Status {
+	return s.GetSessionPublications(sid).RecordingStatus()
+}
+
+// the uploads of the current (or latest) recording of the session.
+func (s *State) GetSessionRecordingUpload(sid SessionId) (record.UploadStatus, bool) {
+	return s.GetSessionPublications(sid).RecordingUpload()
+}
+
+// stop the recording of the session; the caller holds the state lock.
+func (s *State) stopRecording(sid SessionId, publications *Publications) {
+	changed, err := publications.SetRecordingStatus(record.StatusStopped)
+	if err != nil || !changed {
+		return
+	}
+
+	log.Printf("session %s recording is %s", sid, record.StatusStopped)
+	if session := s.Sessions[sid]; session != nil {
+		for _, member := range session.Members {
+			member.Socket.SendRecordingMessage(string(record.StatusStopped))
+		}
 	}
 }
 
@@ -111,9 +346,15 @@ func (s *State) IsSessionExist(sid SessionId) bool {
 }
 
 func (s *State) NewSession(sid SessionId) *Session {
+	options, ok := s.options[sid]
+	if !ok {
+		options = DefaultOptions()
+	}
+
 	s.Sessions[sid] = &Session{
 		Id:      sid,
 		Members: []*Member{},
+		Options: options,
 	}
 	return s.Sessions[sid]
 }
@@ -148,6 +389,7 @@ func (s *State) AddSessionMember(sid SessionId, member *Member) {
 	}
 
 	utils.Unwrap(session.AddMember(member))
+	member.publications.RecordEvent(record.MemberEvent(record.EventJoined, member.Id))
 	s.react(sid, member)
 }
 
@@ -172,7 +414,25 @@ func (s *State) react(sid SessionId, curMember *Member) {
 					}
 
 					log.Printf("sending %s track from %d to %d", track.Kind().String(), curMember.Id, m.Id)
-					m.SendTrack(track)
+					m.SendTrack(curMember.Id, track)
+				}
+
+			// stop sending the removed track to the other members
+			case track := <-curMember.UnpublishedChannel:
+				s.unpublishTrack(sid, curMember.Id, track)
+
+			// let the other members know the track froze (or recovered)
+			case state := <-curMember.TrackStateChannel:
+				for _, m := range s.GetSessionMembers(sid) {
+					if m.Id == curMember.Id {
+						continue
+					}
+
+					if state.Stalled {
+						m.Socket.SendTrackStalledMessage(curMember.Id, state.Track.ID())
+					} else {
+						m.Socket.SendTrackResumedMessage(curMember.Id, state.Track.ID())
+					}
 				}
 
 			case cs := <-curMember.PeerConnectionState:
@@ -180,6 +440,7 @@ func (s *State) react(sid SessionId, curMember *Member) {
 					cs == webrtc.PeerConnectionStateDisconnected ||
 					cs == webrtc.PeerConnectionStateFailed {
 
+					curMember.Leave()
 					s.RemoveSessionMember(sid, curMember.Id)
 					members := s.GetSessionMembers(sid)
 					for _, member := range members {
@@ -193,6 +454,19 @@ func (s *State) react(sid SessionId, curMember *Member) {
 	}()
 }
 
+// stop sending a track that is no longer published to the other members of
+// the session.
+func (s *State) unpublishTrack(sid SessionId, publisher MemberId, track *forward.Track) {
+	for _, m := range s.GetSessionMembers(sid) {
+		if m.Id == publisher {
+			continue
+		}
+
+		m.Unsubscribe(track)
+		m.Socket.SendTrackUnpublishedMessage(publisher, track.ID())
+	}
+}
+
 func (s *State) RemoveSessionMember(sid SessionId, mid MemberId) {
 	session := s.Sessions[sid]
 	if session == nil {
@@ -201,6 +475,9 @@ func (s *State) RemoveSessionMember(sid SessionId, mid MemberId) {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if member := session.GetMember(mid); member != nil {
+		member.publications.RecordEvent(record.MemberEvent(record.EventLeft, mid))
+	}
 	session.RmvMember(mid)
 
 	if session.IsEmpty() {
@@ -12,13 +12,22 @@ import (
 type ClientMessageType int
 
 const (
-	ClientMessageTypeOffer        ClientMessageType = 1
-	ClientMessageTypeAnswer       ClientMessageType = 2
-	ClientMessageTypeCandidate    ClientMessageType = 3
-	ClientMessageTypeLeaveSession ClientMessageType = 4
-	ClientMessageTypeToggleVideo  ClientMessageType = 5
-	ClientMessageTypeToggleAudio  ClientMessageType = 6
-	ClientMessageTypeUnkown       ClientMessageType = -1
+	ClientMessageTypeOffer          ClientMessageType = 1
+	ClientMessageTypeAnswer         ClientMessageType = 2
+	ClientMessageTypeCandidate      ClientMessageType = 3
+	ClientMessageTypeLeaveSession   ClientMessageType = 4
+	ClientMessageTypeToggleVideo    ClientMessageType = 5
+	ClientMessageTypeToggleAudio    ClientMessageType = 6
+	ClientMessageTypePauseTrack     ClientMessageType = 7
+	ClientMessageTypeResumeTrack    ClientMessageType = 8
+	ClientMessageTypeSetTrackLayer  ClientMessageType = 9
+	ClientMessageTypeSetTrackSource ClientMessageType = 10
+	ClientMessageTypePublish        ClientMessageType = 11
+	ClientMessageTypeSetAudioOnly   ClientMessageType = 12
+	ClientMessageTypeSetRecording   ClientMessageType = 13
+	// a host allows (or forbids) multiple screen shares in the session
+	ClientMessageTypeSetScreenShares ClientMessageType = 14
+	ClientMessageTypeUnkown          ClientMessageType = -1
 )
 
 func (m ClientMessageType) String() string {
@@ -35,6 +44,22 @@ func (m ClientMessageType) String() string {
 		return "ClientMessageTypeToggleVideo"
 	case ClientMessageTypeToggleAudio:
 		return "ClientMessageTypeToggleAudio"
+	case ClientMessageTypePauseTrack:
+		return "ClientMessageTypePauseTrack"
+	case ClientMessageTypeResumeTrack:
+		return "ClientMessageTypeResumeTrack"
+	case ClientMessageTypeSetTrackLayer:
+		return "ClientMessageTypeSetTrackLayer"
+	case ClientMessageTypeSetTrackSource:
+		return "ClientMessageTypeSetTrackSource"
+	case ClientMessageTypePublish:
+		return "ClientMessageTypePublish"
+	case ClientMessageTypeSetAudioOnly:
+		return "ClientMessageTypeSetAudioOnly"
+	case ClientMessageTypeSetRecording:
+		return "ClientMessageTypeSetRecording"
+	case ClientMessageTypeSetScreenShares:
+		return "ClientMessageTypeSetScreenShares"
 	case ClientMessageTypeUnkown:
 		return "ClientMessageTypeUnkown"
 	default:
@@ -52,6 +77,37 @@ const (
 	ServerMessageTypeMemberLeft   ServerMessageType = 5
 	ServerMessageTypeToggleVideo  ServerMessageType = 6
 	ServerMessageTypeToggleAudio  ServerMessageType = 7
+	// the server cannot send a track to the member (e.g. the member cannot
+	// decode the track codec)
+	ServerMessageTypeSubscriptionRejected ServerMessageType = 8
+	// a member stopped publishing one of its tracks
+	ServerMessageTypeTrackUnpublished ServerMessageType = 9
+	// a track of another member has been added to the peer connection
+	ServerMessageTypeTrackPublished ServerMessageType = 10
+	// the server refused to forward a track published by the member (e.g.
+	// another member is already sharing the screen)
+	ServerMessageTypePublishRejected ServerMessageType = 11
+	// the tracks declared by a member (see PublishMessage)
+	ServerMessageTypeMemberTracks ServerMessageType = 12
+	// the audio profile (opus settings) applied to the member connection
+	ServerMessageTypeAudioProfile ServerMessageType = 13
+	// a member switched to (or from) the audio only mode; it doesn't receive
+	// video
+	ServerMessageTypeAudioOnly ServerMessageType = 14
+	// a track of a member stopped receiving packets (e.g. the camera froze)
+	ServerMessageTypeTrackStalled ServerMessageType = 15
+	// a stalled track is receiving packets again
+	ServerMessageTypeTrackResumed ServerMessageType = 16
+	// the session recording started, paused or stopped
+	ServerMessageTypeRecording ServerMessageType = 17
+	// the server refused to change the session recording (e.g. the member
+	// is not a host of the session)
+	ServerMessageTypeRecordingRejected ServerMessageType = 18
+	// the screen share policy of the session changed
+	ServerMessageTypeScreenShares ServerMessageType = 19
+	// the server refused to change the screen share policy (e.g. the member
+	// is not a host of the session)
+	ServerMessageTypeScreenSharesRejected ServerMessageType = 20
 )
 
 type ServerMessage struct {
@@ -73,6 +129,132 @@ type ToggleAudioMessage struct {
 	Audio bool `json:"audio"`
 }
 
+// client message body used to select the highest spatial and temporal
+// layers to receive from a scalable (VP9/AV1 SVC) track.
+type TrackLayerMessage struct {
+	Track    string `json:"track"`
+	Spatial  int    `json:"spatial"`
+	Temporal int    `json:"temporal"`
+}
+
+type SubscriptionRejectedMessage struct {
+	Mid    int    `json:"mid"`
+	Track  string `json:"track"`
+	Reason string `json:"reason"`
+}
+
+type TrackPublishedMessage struct {
+	Mid    int    `json:"mid"`
+	Track  string `json:"track"`
+	Source string `json:"source"`
+}
+
+type PublishRejectedMessage struct {
+	Track  string `json:"track"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+// client message body used to announce the source (microphone, camera,
+// screen or screen-audio) of the track sent on a transceiver. It should be
+// sent before the offer that adds the track; tracks without a source are
+// considered as the microphone or the camera.
+type TrackSourceMessage struct {
+	// mid of the transceiver
+	Transceiver string `json:"transceiver"`
+	Source      string `json:"source"`
+}
+
+type SimulcastLayer struct {
+	Rid        string `json:"rid"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	MaxBitrate int    `json:"maxBitrate,omitempty"`
+}
+
+// metadata of a track published by a member.
+type TrackMetadata struct {
+	// microphone, camera, screen or screen-audio
+	Source string `json:"source"`
+	// simulcast layers sent on the transceiver (if any) from the highest to
+	// the lowest quality
+	Layers []SimulcastLayer `json:"layers,omitempty"`
+	// content hint of the captured track (e.g. motion, detail, text, speech
+	// or music)
+	ContentHint string `json:"contentHint,omitempty"`
+	// the track is published but disabled by the member
+	Muted bool `json:"muted"`
+}
+
+// client message body used to declare all of the tracks the member is
+// publishing, mapped by the mid of their transceiver. It replaces the
+// previously declared tracks.
+type PublishMessage struct {
+	Tracks map[string]TrackMetadata `json:"tracks"`
+}
+
+type PublishedTrack struct {
+	// id of the forwarded track; empty in case the track has not been
+	// received yet
+	Track string `json:"track"`
+	TrackMetadata
+}
+
+type MemberTracksMessage struct {
+	Mid    int              `json:"mid"`
+	Tracks []PublishedTrack `json:"tracks"`
+}
+
+type AudioOnlyMessage struct {
+	Mid       int  `json:"mid"`
+	AudioOnly bool `json:"audioOnly"`
+}
+
+type AudioProfileMessage struct {
+	Profile string `json:"profile"`
+}
+
+type TrackUnpublishedMessage struct {
+	Mid   int    `json:"mid"`
+	Track string `json:"track"`
+}
+
+// a track published by a member (e.g. a stalled track).
+type MemberTrackMessage struct {
+	Mid   int    `json:"mid"`
+	Track string `json:"track"`
+}
+
+// client message body used by the hosts to start (recording), pause
+// (paused), resume (recording) or stop (stopped) the session recording. The
+// server message has the same body and is sent to all of the members.
+type RecordingMessage struct {
+	Status string `json:"status"`
+}
+
+type RecordingRejectedMessage struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// client message body used by the hosts to allow (or forbid) more than one
+// member to share its screen at the same time. The server message has the
+// same body and is sent to all of the members.
+type ScreenSharesMessage struct {
+	Multiple bool `json:"multiple"`
+}
+
+type ScreenSharesRejectedMessage struct {
+	Multiple bool   `json:"multiple"`
+	Reason   string `json:"reason"`
+}
+
+// client message body used to pause/resume a track received from another
+// member. The track id is the one announced in the server offer.
+type TrackMessage struct {
+	Track string `json:"track"`
+}
+
 // A proxy for the main socket connection. The proxy uses a mutex to ensure that
 // no concurrent writting into the socket is happening which is
 // prohibited/not-allowed.
@@ -90,6 +272,14 @@ func New(conn *websocket.Conn) Socket {
 		4:  ClientMessageTypeLeaveSession,
 		5:  ClientMessageTypeToggleVideo,
 		6:  ClientMessageTypeToggleAudio,
+		7:  ClientMessageTypePauseTrack,
+		8:  ClientMessageTypeResumeTrack,
+		9:  ClientMessageTypeSetTrackLayer,
+		10: ClientMessageTypeSetTrackSource,
+		11: ClientMessageTypePublish,
+		12: ClientMessageTypeSetAudioOnly,
+		13: ClientMessageTypeSetRecording,
+		14: ClientMessageTypeSetScreenShares,
 		-1: ClientMessageTypeUnkown,
 	}}
 }
@@ -111,6 +301,10 @@ func (s *Socket) Params(key string, defaultValue ...string) string {
 	return s.conn.Params(key, defaultValue...)
 }
 
+func (s *Socket) Query(key string, defaultValue ...string) string {
+	return s.conn.Query(key, defaultValue...)
+}
+
 func (s *Socket) WriteMessage(messageType int, data []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -151,3 +345,82 @@ func (s *Socket) SendToggleAudioMessage(mid int, audio bool) {
 		Audio: audio,
 	})
 }
+
+func (s *Socket) SendSubscriptionRejectedMessage(mid int, track string, reason string) {
+	s.SendTextMessage(ServerMessageTypeSubscriptionRejected, SubscriptionRejectedMessage{
+		Mid:    mid,
+		Track:  track,
+		Reason: reason,
+	})
+}
+
+func (s *Socket) SendTrackUnpublishedMessage(mid int, track string) {
+	s.SendTextMessage(ServerMessageTypeTrackUnpublished, TrackUnpublishedMessage{
+		Mid:   mid,
+		Track: track,
+	})
+}
+
+func (s *Socket) SendTrackPublishedMessage(mid int, track string, source string) {
+	s.SendTextMessage(ServerMessageTypeTrackPublished, TrackPublishedMessage{
+		Mid:    mid,
+		Track:  track,
+		Source: source,
+	})
+}
+
+func (s *Socket) SendPublishRejectedMessage(track string, source string, reason string) {
+	s.SendTextMessage(ServerMessageTypePublishRejected, PublishRejectedMessage{
+		Track:  track,
+		Source: source,
+		Reason: reason,
+	})
+}
+
+func (s *Socket) SendMemberTracksMessage(mid int, tracks []PublishedTrack) {
+	s.SendTextMessage(ServerMessageTypeMemberTracks, MemberTracksMessage{
+		Mid:    mid,
+		Tracks: tracks,
+	})
+}
+
+func (s *Socket) SendAudioProfileMessage(profile string) {
+	s.SendTextMessage(ServerMessageTypeAudioProfile, AudioProfileMessage{Profile: profile})
+}
+
+func (s *Socket) SendAudioOnlyMessage(mid int, audioOnly bool) {
+	s.SendTextMessage(ServerMessageTypeAudioOnly, AudioOnlyMessage{
+		Mid:       mid,
+		AudioOnly: audioOnly,
+	})
+}
+
+func (s *Socket) SendTrackStalledMessage(mid int, track string) {
+	s.SendTextMessage(ServerMessageTypeTrackStalled, MemberTrackMessage{Mid: mid, Track: track})
+}
+
+func (s *Socket) SendTrackResumedMessage(mid int, track string) {
+	s.SendTextMessage(ServerMessageTypeTrackResumed, MemberTrackMessage{Mid: mid, Track: track})
+}
+
+func (s *Socket) SendRecordingMessage(status string) {
+	s.SendTextMessage(ServerMessageTypeRecording, RecordingMessage{Status: status})
+}
+
+func (s *Socket) SendRecordingRejectedMessage(status string, reason string) {
+	s.SendTextMessage(ServerMessageTypeRecordingRejected, RecordingRejectedMessage{
+		Status: status,
+		Reason: reason,
+	})
+}
+
+func (s *Socket) SendScreenSharesMessage(multiple bool) {
+	s.SendTextMessage(ServerMessageTypeScreenShares, ScreenSharesMessage{Multiple: multiple})
+}
+
+func (s *Socket) SendScreenSharesRejectedMessage(multiple bool, reason string) {
+	s.SendTextMessage(ServerMessageTypeScreenSharesRejected, ScreenSharesRejectedMessage{
+		Multiple: multiple,
+		Reason:   reason,
+	})
+}
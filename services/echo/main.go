@@ -1,6 +1,7 @@
 package main
 
 import (
+	"echo/constants"
 	"echo/handlers"
 	"echo/lib/state"
 	"log"
@@ -11,15 +12,19 @@ import (
 )
 
 func main() {
-	app := fiber.New()
-	state := state.New()
 	err := godotenv.Load(".env")
 
 	if err != nil {
 		log.Println("unable to load the .env file")
 		panic(err)
 	}
+	constants.Load()
 
+	app := fiber.New()
+	state := state.New()
+	state.RemovePartialRecordingFiles()
+	state.ResumeRecordingUploads()
+	state.StartRecordingRetention()
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:3000, https://app.staging.litespace.org, https://app.litespace.org, https://echo.staging.litespace.org",
 		AllowCredentials: true,
@@ -27,6 +32,18 @@ func main() {
 
 	app.Static("/demo", "./public/demo.html")
 	app.Get("/stats", handlers.Stats(&state))
+	app.Get("/sessions/:sid/options", handlers.RequireApiKey, handlers.GetSessionOptions(&state))
+	app.Put("/sessions/:sid/options", handlers.RequireApiKey, handlers.SetSessionOptions(&state))
+	app.Post("/sessions/:sid/hosts/:mid/token", handlers.RequireApiKey, handlers.IssueSessionHostToken(&state))
+	app.Get("/sessions/:sid/recording", handlers.RequireApiKey, handlers.GetSessionRecording(&state))
+	app.Put("/sessions/:sid/recording", handlers.RequireApiKey, handlers.SetSessionRecording(&state))
+	app.Get("/sessions/:sid/recordings", handlers.RequireApiKey, handlers.ListSessionRecordings(&state))
+	app.Get("/sessions/:sid/recordings/:rid", handlers.RequireApiKey, handlers.GetSessionRecordingManifest(&state))
+	app.Get("/sessions/:sid/recordings/:rid/files/*", handlers.RequireApiKey, handlers.GetSessionRecordingFile(&state))
+	app.Get("/sessions/:sid/live", handlers.RequireApiKey, handlers.GetSessionLive(&state))
+	app.Put("/sessions/:sid/live", handlers.RequireApiKey, handlers.SetSessionLive(&state))
+	app.Delete("/sessions/:sid/live", handlers.RequireApiKey, handlers.StopSessionLive(&state))
+	app.Get("/live/:token/:file", handlers.GetLiveFile(&state))
 	app.Use("/ws", handlers.UpgradeWs)
 	app.Get("/ws/:sid/:mid", handlers.NewSocketConn(&state))
 